@@ -1,12 +1,13 @@
 // debug.go - HTTP 调试传输层
-// 这个文件定义了一个自定义的 http.Transport，用于拦截和打印 HTTP 请求和响应的详细信息。
+// 这个文件定义了一个自定义的 http.Transport，用于拦截 HTTP 请求和响应，并以 debug 级别记录它们的详细信息。
 // 这种实现方式是 Go 中进行网络调试的常用模式，它利用了装饰器模式，在不改变核心业务逻辑的情况下，为 HTTP 客户端增加了日志记录功能。
 package main
 
 import (
-	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -35,28 +36,24 @@ func NewDebugTransport() *debugTransport {
 // 当 http.Client 使用这个 transport 发送请求时，此方法会被调用。
 // 它的职责是“往返”一次 HTTP 事务：接收请求，获取响应。
 func (d *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// 请求的 context 中带有当前的 span，日志会带上 trace_id，可以和 Provider 的日志对应起来
+	ctx := req.Context()
+
 	// --- 请求记录 ---
-	fmt.Println("\n=== HTTP 请求 ===")
-	fmt.Printf("方法: %s\n", req.Method)
-	fmt.Printf("URL: %s\n", req.URL.String())
-	fmt.Println("请求头:")
-	for k, v := range req.Header {
-		fmt.Printf("  %s: %s\n", k, strings.Join(v, ", ")) // 将头部的值连接起来，以便更好地显示
-	}
+	// 方法、URL 和请求头记录在同一条日志中；请求头是一个字段组，pretty 格式会把它显示为缩进的 "名称: 值" 列表
+	attrs := []any{"method", req.Method, "url", req.URL.String(), headerAttrs("headers", req.Header)}
 
 	// --- 请求体处理 ---
 	// 检查请求方法是否为 "POST"，并且请求体 (req.Body) 是否存在。
 	// req.Body 是一个 io.ReadCloser，它的内容只能被读取一次。
+	var reqBody []byte
 	if req.Method == "POST" && req.Body != nil {
 		// 使用 io.ReadAll 读取请求体的所有内容。
 		bodyBytes, err := io.ReadAll(req.Body)
 		if err == nil {
-			// 打印原始的请求体内容。
-			fmt.Printf("请求体 (原始): %s\n", string(bodyBytes))
-
-			// 使用智能解码器尝试解析和格式化请求体。
-			// 这对于调试 JSON API 或查看 JWT 内容非常有用。
-			d.Decoder.SmartDecode("请求体 (解码后)", bodyBytes)
+			// 记录原始的请求体内容。
+			attrs = append(attrs, "body", string(bodyBytes))
+			reqBody = bodyBytes
 
 			// !!! 关键步骤：重建请求体 !!!
 			// 因为 req.Body 已经被读取完毕，如果不重新创建它，后续的 http.Transport 将无法读取到任何内容，导致请求失败。
@@ -65,6 +62,12 @@ func (d *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			req.Body = io.NopCloser(strings.NewReader(string(bodyBytes)))
 		}
 	}
+	slog.DebugContext(ctx, "=== HTTP 请求 ===", attrs...)
+	if reqBody != nil {
+		// 使用智能解码器尝试解析和格式化请求体。
+		// 这对于调试 JSON API 或查看 JWT 内容非常有用。
+		d.Decoder.SmartDecode(ctx, "请求体 (解码后)", reqBody)
+	}
 
 	// --- 实际的 HTTP 请求 ---
 	// 调用被包装的底层 Transport 的 RoundTrip 方法来实际发送请求。
@@ -72,29 +75,23 @@ func (d *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	resp, err := d.Transport.RoundTrip(req)
 	if err != nil {
 		// 如果请求过程中发生错误（例如，网络问题），记录错误并返回。
-		fmt.Printf("请求错误: %v\n", err)
+		slog.WarnContext(ctx, "请求错误", "url", req.URL.String(), "error", err)
 		return resp, err
 	}
 
 	// --- 响应记录 ---
-	fmt.Println("\n--- HTTP 响应 ---")
-	fmt.Printf("状态码: %s\n", resp.Status)
-	fmt.Println("响应头:")
-	for k, v := range resp.Header {
-		fmt.Printf("  %s: %s\n", k, strings.Join(v, ", "))
-	}
+	attrs = []any{"status", resp.Status, headerAttrs("headers", resp.Header)}
 
 	// --- 响应体处理 ---
 	// 同样，检查响应体是否存在。
+	var respBody []byte
 	if resp.Body != nil {
 		// 读取响应体的所有内容。
 		bodyBytes, err := io.ReadAll(resp.Body)
 		if err == nil {
-			// 打印原始的响应体。
-			fmt.Printf("响应体 (原始): %s\n", string(bodyBytes))
-
-			// 使用智能解码器解析和格式化响应体。
-			d.Decoder.SmartDecode("响应体 (解码后)", bodyBytes)
+			// 记录原始的响应体。
+			attrs = append(attrs, "body", string(bodyBytes))
+			respBody = bodyBytes
 
 			// !!! 关键步骤：重建响应体 !!!
 			// 与请求体一样，响应体也被读取完毕。为了让调用 http.Client 的代码能够正常处理响应，
@@ -102,9 +99,26 @@ func (d *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			resp.Body = io.NopCloser(strings.NewReader(string(bodyBytes)))
 		}
 	}
-	fmt.Println("==================")
-	fmt.Println() // 添加一个空行以分隔日志条目
+	slog.DebugContext(ctx, "--- HTTP 响应 ---", attrs...)
+	if respBody != nil {
+		// 使用智能解码器解析和格式化响应体。
+		d.Decoder.SmartDecode(ctx, "响应体 (解码后)", respBody)
+	}
 
 	// 返回最终的响应和错误（在这里错误为 nil）。
 	return resp, err
 }
+
+// headerAttrs 把 HTTP 头转换为一个字段组，按名称排序，多个值用逗号连接
+func headerAttrs(key string, h http.Header) slog.Attr {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attrs := make([]slog.Attr, len(names))
+	for i, name := range names {
+		attrs[i] = slog.String(name, strings.Join(h[name], ", ")) // 将头部的值连接起来，以便更好地显示
+	}
+	return slog.Attr{Key: key, Value: slog.GroupValue(attrs...)}
+}
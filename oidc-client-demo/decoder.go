@@ -1,10 +1,13 @@
 // decoder.go - 智能解码器
+// 解码结果以 debug 级别记录。JSON 以 json.RawMessage 的形式作为字段，pretty 格式会把它缩进排版，json 格式直接嵌入为对象
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"strings"
 	"time"
@@ -18,33 +21,33 @@ func NewSmartDecoder() *SmartDecoder {
 	return &SmartDecoder{}
 }
 
-// SmartDecode 智能解码和格式化数据
-func (s *SmartDecoder) SmartDecode(label string, data []byte) {
+// SmartDecode 智能解码和格式化数据，ctx 用于给日志带上请求的 trace 信息
+func (s *SmartDecoder) SmartDecode(ctx context.Context, label string, data []byte) {
 	content := string(data)
 
 	// 1. 尝试 JSON 格式化 (最常见)
-	if s.tryJSONFormat(label, data) {
+	if s.tryJSONFormat(ctx, label, data) {
 		return
 	}
 
 	// 2. 尝试 URL 解码
-	if s.tryURLDecode(label, content) {
+	if s.tryURLDecode(ctx, label, content) {
 		return
 	}
 
 	// 3. 尝试 Base64 解码
-	if s.tryBase64Decode(label, content) {
+	if s.tryBase64Decode(ctx, label, content) {
 		return
 	}
 
 	// 4. 尝试 JWT 解码
-	if s.tryJWTDecode(label, content) {
+	if s.tryJWTDecode(ctx, label, content) {
 		return
 	}
 }
 
 // tryJSONFormat 尝试 JSON 格式化
-func (s *SmartDecoder) tryJSONFormat(label string, data []byte) bool {
+func (s *SmartDecoder) tryJSONFormat(ctx context.Context, label string, data []byte) bool {
 	content := strings.TrimSpace(string(data))
 	if !strings.HasPrefix(content, "{") && !strings.HasPrefix(content, "[") {
 		return false
@@ -52,28 +55,27 @@ func (s *SmartDecoder) tryJSONFormat(label string, data []byte) bool {
 
 	var jsonData interface{}
 	if err := json.Unmarshal(data, &jsonData); err == nil {
-		prettyJSON, _ := json.MarshalIndent(jsonData, "", "  ")
-		fmt.Printf("🎨 格式化后的%s:\n%s\n", label, prettyJSON)
+		slog.DebugContext(ctx, "🎨 格式化后的"+label, "json", json.RawMessage(content))
 
 		// 检查JSON中是否包含JWT令牌字段
-		s.findAndDecodeJWTsInJSON(jsonData)
+		s.findAndDecodeJWTsInJSON(ctx, jsonData)
 		return true
 	}
 	return false
 }
 
 // tryURLDecode 尝试 URL 解码
-func (s *SmartDecoder) tryURLDecode(label string, content string) bool {
+func (s *SmartDecoder) tryURLDecode(ctx context.Context, label string, content string) bool {
 	if !strings.Contains(content, "%") {
 		return false
 	}
 
 	if decoded, err := url.QueryUnescape(content); err == nil && decoded != content {
-		fmt.Printf("🔓 URL解码后的%s: %s\n", label, decoded)
+		slog.DebugContext(ctx, "🔓 URL解码后的"+label, "decoded", decoded)
 
 		// 递归尝试解码解码后的内容
 		if strings.Contains(decoded, "%") {
-			s.tryURLDecode(label+"(再次解码)", decoded)
+			s.tryURLDecode(ctx, label+"(再次解码)", decoded)
 		}
 		return true
 	}
@@ -81,7 +83,7 @@ func (s *SmartDecoder) tryURLDecode(label string, content string) bool {
 }
 
 // tryBase64Decode 尝试 Base64 解码
-func (s *SmartDecoder) tryBase64Decode(label string, content string) bool {
+func (s *SmartDecoder) tryBase64Decode(ctx context.Context, label string, content string) bool {
 	// 简单检查是否可能是 Base64
 	if len(content) < 4 || len(content)%4 != 0 {
 		return false
@@ -95,46 +97,45 @@ func (s *SmartDecoder) tryBase64Decode(label string, content string) bool {
 
 	if decoded, err := base64.StdEncoding.DecodeString(content); err == nil {
 		decodedStr := string(decoded)
-		fmt.Printf("🔐 Base64解码后的%s: %s\n", label, decodedStr)
+		slog.DebugContext(ctx, "🔐 Base64解码后的"+label, "decoded", decodedStr)
 
 		// 递归尝试解码解码后的内容
-		s.SmartDecode(label+"(Base64解码后)", decoded)
+		s.SmartDecode(ctx, label+"(Base64解码后)", decoded)
 		return true
 	}
 	return false
 }
 
 // tryJWTDecode 尝试 JWT 解码
-func (s *SmartDecoder) tryJWTDecode(label string, content string) bool {
+func (s *SmartDecoder) tryJWTDecode(ctx context.Context, label string, content string) bool {
 	// JWT 格式: header.payload.signature
 	parts := strings.Split(content, ".")
 	if len(parts) != 3 {
 		return false
 	}
 
-	fmt.Printf("🎫 检测到JWT令牌:\n")
-
+	attrs := []any{"label", label}
 	// 解码 header
 	if headerData, err := base64.RawURLEncoding.DecodeString(parts[0]); err == nil {
-		fmt.Printf("  📋 Header: %s\n", headerData)
+		attrs = append(attrs, jsonOrString("header", headerData))
 	}
-
 	// 解码 payload
 	if payloadData, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
-		fmt.Printf("  📦 Payload: %s\n", payloadData)
-
-		// 尝试格式化 payload JSON
-		var payloadJSON interface{}
-		if err := json.Unmarshal(payloadData, &payloadJSON); err == nil {
-			prettyPayload, _ := json.MarshalIndent(payloadJSON, "    ", "  ")
-			fmt.Printf("  🎨 格式化的Payload:\n%s\n", prettyPayload)
-		}
+		attrs = append(attrs, jsonOrString("payload", payloadData))
 	}
-
-	fmt.Printf("  🔏 Signature: %s\n", parts[2])
+	attrs = append(attrs, "signature", parts[2])
+	slog.DebugContext(ctx, "🎫 检测到JWT令牌", attrs...)
 	return true
 }
 
+// jsonOrString 返回一个字段: data 是有效的 JSON 时作为 json.RawMessage，否则作为字符串
+func jsonOrString(key string, data []byte) slog.Attr {
+	if json.Valid(data) {
+		return slog.Any(key, json.RawMessage(data))
+	}
+	return slog.String(key, string(data))
+}
+
 // containsOnlyChars 检查字符串是否只包含指定字符
 func (s *SmartDecoder) containsOnlyChars(str, chars string) bool {
 	for _, r := range str {
@@ -146,24 +147,23 @@ func (s *SmartDecoder) containsOnlyChars(str, chars string) bool {
 }
 
 // findAndDecodeJWTsInJSON 在JSON数据中查找并解码JWT令牌
-func (s *SmartDecoder) findAndDecodeJWTsInJSON(data interface{}) {
+func (s *SmartDecoder) findAndDecodeJWTsInJSON(ctx context.Context, data interface{}) {
 	switch v := data.(type) {
 	case map[string]interface{}:
 		for key, value := range v {
 			if str, ok := value.(string); ok {
 				// 检查常见的JWT字段名
 				if s.isJWTField(key) && s.looksLikeJWT(str) {
-					fmt.Printf("\n🎫 发现%s中的JWT令牌: %s\n", key, key)
-					s.decodeJWTDetailed(str)
+					s.decodeJWTDetailed(ctx, key, str)
 				}
 			} else {
 				// 递归检查嵌套对象
-				s.findAndDecodeJWTsInJSON(value)
+				s.findAndDecodeJWTsInJSON(ctx, value)
 			}
 		}
 	case []interface{}:
 		for _, item := range v {
-			s.findAndDecodeJWTsInJSON(item)
+			s.findAndDecodeJWTsInJSON(ctx, item)
 		}
 	}
 }
@@ -190,78 +190,70 @@ func (s *SmartDecoder) looksLikeJWT(str string) bool {
 	return len(parts) == 3 && len(str) > 50 // JWT通常比较长
 }
 
-// decodeJWTDetailed 详细解码JWT令牌
-func (s *SmartDecoder) decodeJWTDetailed(token string) {
+// decodeJWTDetailed 详细解码JWT令牌，field 是令牌所在的 JSON 字段名
+func (s *SmartDecoder) decodeJWTDetailed(ctx context.Context, field, token string) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
 		return
 	}
 
-	fmt.Printf("┌─ JWT解码详情 ─────────────────────────────────\n")
+	attrs := []any{"field", field}
 
 	// 解码 Header
 	if headerData, err := base64.RawURLEncoding.DecodeString(parts[0]); err == nil {
-		var headerJSON interface{}
-		if err := json.Unmarshal(headerData, &headerJSON); err == nil {
-			prettyHeader, _ := json.MarshalIndent(headerJSON, "│ ", "  ")
-			fmt.Printf("│ 📋 Header:\n│ %s\n", prettyHeader)
-		} else {
-			fmt.Printf("│ 📋 Header: %s\n", headerData)
-		}
+		attrs = append(attrs, jsonOrString("header", headerData))
 	}
 
-	fmt.Printf("├─────────────────────────────────────────────────\n")
-
 	// 解码 Payload
 	if payloadData, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
-		var payloadJSON interface{}
-		if err := json.Unmarshal(payloadData, &payloadJSON); err == nil {
-			prettyPayload, _ := json.MarshalIndent(payloadJSON, "│ ", "  ")
-			fmt.Printf("│ 📦 Payload:\n│ %s\n", prettyPayload)
-
-			// 解析常见的JWT声明
-			if claims, ok := payloadJSON.(map[string]interface{}); ok {
-				s.explainJWTClaims(claims)
+		attrs = append(attrs, jsonOrString("payload", payloadData))
+
+		// 解析常见的JWT声明
+		var claims map[string]interface{}
+		if err := json.Unmarshal(payloadData, &claims); err == nil {
+			if explained := s.explainJWTClaims(claims); len(explained) > 0 {
+				attrs = append(attrs, slog.Attr{Key: "claims", Value: slog.GroupValue(explained...)})
 			}
-		} else {
-			fmt.Printf("│ 📦 Payload: %s\n", payloadData)
 		}
 	}
 
-	fmt.Printf("├─────────────────────────────────────────────────\n")
-	fmt.Printf("│ 🔏 Signature: %s\n", parts[2])
-	fmt.Printf("└─────────────────────────────────────────────────\n\n")
+	attrs = append(attrs, "signature", parts[2])
+	slog.DebugContext(ctx, "🎫 发现"+field+"中的JWT令牌", attrs...)
 }
 
-// explainJWTClaims 解释JWT中的常见声明
-func (s *SmartDecoder) explainJWTClaims(claims map[string]interface{}) {
-	fmt.Printf("│ 💡 JWT声明解释:\n")
-
-	claimExplanations := map[string]string{
-		"iss":                "颁发者 (Issuer)",
-		"sub":                "主题/用户ID (Subject)",
-		"aud":                "受众/客户端ID (Audience)",
-		"exp":                "过期时间 (Expiration)",
-		"iat":                "颁发时间 (Issued At)",
-		"nbf":                "生效时间 (Not Before)",
-		"jti":                "JWT ID",
-		"name":               "用户姓名",
-		"email":              "用户邮箱",
-		"picture":            "用户头像",
-		"preferred_username": "首选用户名",
-	}
+// claimExplanations 是常见的JWT声明及其说明，按输出的顺序排列
+var claimExplanations = []struct{ claim, explanation string }{
+	{"iss", "颁发者 (Issuer)"},
+	{"sub", "主题/用户ID (Subject)"},
+	{"aud", "受众/客户端ID (Audience)"},
+	{"exp", "过期时间 (Expiration)"},
+	{"iat", "颁发时间 (Issued At)"},
+	{"nbf", "生效时间 (Not Before)"},
+	{"jti", "JWT ID"},
+	{"name", "用户姓名"},
+	{"email", "用户邮箱"},
+	{"picture", "用户头像"},
+	{"preferred_username", "首选用户名"},
+}
 
-	for claim, value := range claims {
-		if explanation, exists := claimExplanations[claim]; exists {
-			// 处理时间戳
-			if claim == "exp" || claim == "iat" || claim == "nbf" {
-				if timestamp, ok := value.(float64); ok {
-					t := time.Unix(int64(timestamp), 0)
-					fmt.Printf("│   • %s (%s): %v → %s\n", claim, explanation, value, t.Format("2006-01-02 15:04:05"))
-					continue
-				}
+// explainJWTClaims 解释JWT中的常见声明，每个声明是一个字段，键为 "声明 (说明)"，在日志中显示为 claims 字段组
+func (s *SmartDecoder) explainJWTClaims(claims map[string]interface{}) []slog.Attr {
+	var attrs []slog.Attr
+	for _, c := range claimExplanations {
+		value, exists := claims[c.claim]
+		if !exists {
+			continue
+		}
+		key := fmt.Sprintf("%s (%s)", c.claim, c.explanation)
+		// 处理时间戳
+		if c.claim == "exp" || c.claim == "iat" || c.claim == "nbf" {
+			if timestamp, ok := value.(float64); ok {
+				t := time.Unix(int64(timestamp), 0)
+				attrs = append(attrs, slog.String(key, fmt.Sprintf("%d → %s", int64(timestamp), t.Format("2006-01-02 15:04:05"))))
+				continue
 			}
-			fmt.Printf("│   • %s (%s): %v\n", claim, explanation, value)
 		}
+		attrs = append(attrs, slog.String(key, fmt.Sprint(value)))
 	}
+	return attrs
 }
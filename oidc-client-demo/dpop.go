@@ -0,0 +1,90 @@
+// dpop.go - DPoP 证明传输层 (RFC 9449)
+// 与 debug.go 一样，这里也是一个包装 http.RoundTripper 的装饰器。
+// 它为每个发出的请求用客户端自己的私钥签名一个 DPoP 证明，并放入 DPoP 请求头中，
+// 这样 Provider 签发的令牌就会绑定到这把密钥上，即使令牌被截获也无法被他人重放。
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// dpopTransport 在请求发出前为其附加 DPoP 证明
+type dpopTransport struct {
+	// Transport 是被包装的底层 http.RoundTripper
+	Transport http.RoundTripper
+	// signer 使用客户端的 DPoP 私钥签名，并把对应的公钥嵌入到证明的 jwk 头中
+	signer jose.Signer
+}
+
+// NewDPoPKey 生成一把新的 P-256 密钥，作为本客户端的 DPoP 密钥
+func NewDPoPKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// NewDPoPTransport 创建一个使用 key 签名证明的 dpopTransport，包装 next
+func NewDPoPTransport(key *ecdsa.PrivateKey, next http.RoundTripper) (*dpopTransport, error) {
+	opts := (&jose.SignerOptions{EmbedJWK: true}).WithType("dpop+jwt")
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("创建 DPoP 签名器失败: %v", err)
+	}
+	return &dpopTransport{Transport: next, signer: signer}, nil
+}
+
+// RoundTrip 为请求生成 DPoP 证明后交给底层 Transport 发送
+func (d *dpopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// 访问受保护资源时 (Authorization: DPoP <token>)，证明中还需要包含令牌的哈希 ath
+	var accessToken string
+	if scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "DPoP") {
+		accessToken = token
+	}
+
+	proof, err := d.newProof(req.Method, req.URL.Scheme+"://"+req.URL.Host+req.URL.Path, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTripper 不应修改传入的请求，所以先克隆一份
+	req = req.Clone(req.Context())
+	req.Header.Set("DPoP", proof)
+	return d.Transport.RoundTrip(req)
+}
+
+// newProof 签名一个针对 htm/htu 的 DPoP 证明
+func (d *dpopTransport) newProof(htm, htu, accessToken string) (string, error) {
+	jti, err := generateRandomString(16)
+	if err != nil {
+		return "", err
+	}
+	claims := map[string]interface{}{
+		"jti": jti,
+		"htm": htm,
+		"htu": htu,
+		"iat": time.Now().Unix(),
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	jws, err := d.signer.Sign(payload)
+	if err != nil {
+		return "", fmt.Errorf("签名 DPoP 证明失败: %v", err)
+	}
+	return jws.CompactSerialize()
+}
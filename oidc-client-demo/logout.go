@@ -0,0 +1,106 @@
+// logout.go - 接收 Provider 的 back-channel logout 通知
+// 用户在 Provider 退出登录时，Provider 会在服务器之间直接 POST 一个签名的 logout_token 到 /backchannel-logout。
+// 我们像验证 ID Token 一样验证它 (签名、iss、aud、有效期)，再检查 events 声明，
+// 然后删除与其中 sid 或 sub 匹配的本地会话，用户下一次访问时就会看到未登录页面。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// backchannelLogoutEvent 是 logout_token 的 events 声明中必须包含的事件类型
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logoutTokenClaims 是我们关心的 logout_token 声明
+type logoutTokenClaims struct {
+	Subject   string                     `json:"sub"`
+	SessionID string                     `json:"sid"`
+	ID        string                     `json:"jti"`
+	Events    map[string]json.RawMessage `json:"events"`
+	// Nonce 必须不存在，用来防止把 ID Token 当作 logout_token 使用
+	Nonce *string `json:"nonce"`
+}
+
+var (
+	// 已处理过的 logout_token jti，用于防重放
+	seenLogoutJTIs   = make(map[string]time.Time)
+	seenLogoutJTIsMu sync.Mutex
+)
+
+// handleBackchannelLogout 处理 Provider 发来的 logout_token (OIDC Back-Channel Logout 第 2.8 节)
+func handleBackchannelLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodPost {
+		http.Error(w, "只接受 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := verifyLogoutToken(r.Context(), r.PostFormValue("logout_token"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "❌ 拒绝 back-channel logout", "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":             "invalid_request",
+			"error_description": err.Error(),
+		})
+		return
+	}
+
+	count := deleteSessionsByProvider(claims.SessionID, claims.Subject)
+	slog.InfoContext(r.Context(), "🚪 收到 back-channel logout", "sid", claims.SessionID, "sub", claims.Subject, "deleted_sessions", count)
+	w.WriteHeader(http.StatusOK)
+}
+
+// verifyLogoutToken 验证 logout_token 并返回其中的声明
+func verifyLogoutToken(ctx context.Context, rawToken string) (*logoutTokenClaims, error) {
+	if rawToken == "" {
+		return nil, errors.New("缺少 logout_token")
+	}
+
+	// 1. 签名 (通过 Provider 的 JWKS)、iss、aud 和 exp 的检查与 ID Token 完全相同
+	token, err := idTokenVerifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("logout_token 验证失败: %v", err)
+	}
+
+	var claims logoutTokenClaims
+	if err := token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("解析 logout_token 失败: %v", err)
+	}
+
+	// 2. logout_token 特有的检查
+	if _, ok := claims.Events[backchannelLogoutEvent]; !ok {
+		return nil, errors.New("logout_token 缺少 back-channel logout 事件")
+	}
+	if claims.Nonce != nil {
+		return nil, errors.New("logout_token 不能包含 nonce")
+	}
+	if claims.SessionID == "" && claims.Subject == "" {
+		return nil, errors.New("logout_token 必须包含 sid 或 sub")
+	}
+	if claims.ID == "" {
+		return nil, errors.New("logout_token 缺少 jti")
+	}
+
+	// 3. 防重放: 同一个 jti 只处理一次
+	seenLogoutJTIsMu.Lock()
+	defer seenLogoutJTIsMu.Unlock()
+	for jti, exp := range seenLogoutJTIs {
+		if time.Now().After(exp) {
+			delete(seenLogoutJTIs, jti)
+		}
+	}
+	if _, seen := seenLogoutJTIs[claims.ID]; seen {
+		return nil, errors.New("logout_token 已被使用过")
+	}
+	seenLogoutJTIs[claims.ID] = token.Expiry
+	return &claims, nil
+}
@@ -5,17 +5,27 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"golang.org/x/oauth2"
 )
 
@@ -33,20 +43,96 @@ var (
 	// --- 连接到我们自己 OP 的配置 ---
 	clientID     = "my-client-app"
 	clientSecret = "my-client-secret"
-	redirectURL  = "http://127.0.0.1:8080/auth/callback"
+	// redirectURL 和 postLogoutRedirectURL 在 main 函数中按是否启用 TLS 设置
+	redirectURL           string
+	postLogoutRedirectURL string
+
+	// Provider 的颁发者 URL (通过 -provider 参数设置)，以及要额外信任的 Provider 证书 (例如 Provider 的自签名证书)
+	providerURL = flag.String("provider", "http://127.0.0.1:9090", "OIDC Provider 的颁发者 URL")
+	providerCA  = flag.String("provider-ca", "", "额外信任的 Provider 证书 (PEM 文件)，例如 Provider 的 tls.self_signed 证书")
+	// 以 HTTPS 方式监听 (通过 -tls-cert/-tls-key 或 -tls-self-signed 参数开启)，见 server.go
+	tlsCert       = flag.String("tls-cert", "", "TLS 证书文件，与 -tls-key 一起设置时以 HTTPS 方式监听")
+	tlsKey        = flag.String("tls-key", "", "TLS 私钥文件")
+	tlsSelfSigned = flag.Bool("tls-self-signed", false, "使用自动生成的自签名证书 (只用于开发)，同时设置 -tls-cert/-tls-key 时保存到这两个文件")
+
+	// 是否使用 DPoP 把令牌绑定到客户端自己的密钥上 (通过 -dpop 参数开启)
+	useDPoP = flag.Bool("dpop", false, "生成 DPoP 密钥并为令牌交换和 API 调用签名 DPoP 证明")
+	// 要求的认证级别 (通过 -acr 参数设置)，例如 urn:simple-oidc-provider:acr:mfa 要求用户完成两步验证
+	acrValues = flag.String("acr", "", "授权请求中的 acr_values，登录后检查 ID Token 的 acr 是否满足")
+	// 希望 Provider 页面使用的语言 (通过 -ui-locales 参数设置)，例如 "en zh"；不设置时由浏览器的 Accept-Language 决定
+	uiLocales = flag.String("ui-locales", "", "授权请求中的 ui_locales，按优先级用空格分隔，例如 \"en zh\"")
+	// OpenTelemetry span 的输出方式 (通过 -trace 和 -trace-file 参数设置)，见 tracing.go
+	traceExporter = flag.String("trace", "none", "span 的输出方式: none、stdout 或 otlp-file")
+	traceFile     = flag.String("trace-file", "client-traces.jsonl", "-trace otlp-file 时追加写入的文件")
+	// 日志的格式和级别 (通过 -log-format 和 -log-level 参数设置)，见 logging.go
+	logFormat = flag.String("log-format", "pretty", "日志格式: pretty、text 或 json")
+	logLevel  = flag.String("log-level", "debug", "日志级别: debug (包括 HTTP 请求和响应的详细内容)、info、warn 或 error")
 
 	// 全局变量，在 main 函数中初始化
 	oauth2Config    *oauth2.Config
 	idTokenVerifier *oidc.IDTokenVerifier
+	oidcProvider    *oidc.Provider
+	// endSessionURL 是 Provider 的 end_session_endpoint，退出登录时把用户带到这里结束 Provider 会话
+	endSessionURL string
+	// dpopKey 是客户端的 DPoP 私钥，仅在启用 DPoP 时生成
+	dpopKey *ecdsa.PrivateKey
+	// jwksKeys 缓存 Provider 的公钥，也用于就绪检查
+	jwksKeys *jwksKeySet
 )
 
 func main() {
-	ctx := context.Background()
+	flag.Parse()
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("无效的参数", errors.New("-tls-cert 和 -tls-key 必须同时设置"))
+	}
+	baseURL := "http://127.0.0.1:8080"
+	if *tlsCert != "" || *tlsSelfSigned {
+		baseURL = "https://127.0.0.1:8080"
+	}
+	redirectURL = baseURL + "/auth/callback"
+	postLogoutRedirectURL = baseURL + "/"
+	if *providerCA != "" {
+		if err := trustProviderCA(*providerCA); err != nil {
+			fatal("无法读取 Provider 证书", err)
+		}
+	}
+	shutdownTracing, err := setupTracing(*traceExporter, *traceFile)
+	if err != nil {
+		fatal("无法设置追踪", err)
+	}
+	defer shutdownTracing(context.Background())
+	// 获取发现文档的请求也会记录为 span
+	ctx := oidc.ClientContext(context.Background(), tracedHTTPClient)
 
 	// 1. 初始化 OIDC Provider - 连接到我们本地运行的认证服务
-	provider, err := oidc.NewProvider(ctx, "http://127.0.0.1:9090")
+	provider, err := oidc.NewProvider(ctx, *providerURL)
 	if err != nil {
-		log.Fatalf("无法连接到 OIDC Provider: %v", err)
+		fatal("无法连接到 OIDC Provider", err)
+	}
+	oidcProvider = provider
+
+	// 读取 discovery 文档中 go-oidc 没有直接暴露的 end_session_endpoint
+	// 以及创建验证器所需的 issuer 和 jwks_uri
+	var providerClaims struct {
+		Issuer             string `json:"issuer"`
+		JWKSURI            string `json:"jwks_uri"`
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := provider.Claims(&providerClaims); err != nil {
+		fatal("无法解析发现文档", err)
+	}
+	endSessionURL = providerClaims.EndSessionEndpoint
+
+	// 1.1 如果启用了 DPoP，为本客户端生成一把密钥 (只保存在内存中)
+	if *useDPoP {
+		dpopKey, err = NewDPoPKey()
+		if err != nil {
+			fatal("无法生成 DPoP 密钥", err)
+		}
+		slog.Info("已启用 DPoP: 令牌将绑定到客户端的 DPoP 密钥")
 	}
 
 	// 2. 配置 OAuth2 客户端
@@ -60,24 +146,38 @@ func main() {
 		Scopes: []string{oidc.ScopeOpenID, "profile", "email"},
 	}
 
-	// 3. 创建 ID 令牌验证器
-	idTokenVerifier = provider.Verifier(&oidc.Config{ClientID: clientID})
+	// 3. 创建 ID 令牌验证器。公钥由 jwksKeySet 在验证时获取，获取请求属于当前请求的 trace
+	jwksKeys = &jwksKeySet{url: providerClaims.JWKSURI}
+	idTokenVerifier = oidc.NewVerifier(providerClaims.Issuer, jwksKeys, &oidc.Config{ClientID: clientID})
 
 	// 4. 设置 HTTP 路由
 	http.HandleFunc("/", handleHome)
 	http.HandleFunc("/login", handleLogin)
 	http.HandleFunc("/auth/callback", handleCallback)
 	http.HandleFunc("/logout", handleLogout)
+	http.HandleFunc("/backchannel-logout", handleBackchannelLogout)
+	http.HandleFunc("GET /metrics", handleMetrics)
+	http.HandleFunc("GET /healthz", handleHealthz)
+	http.HandleFunc("GET /readyz", handleReadyz)
 
-	fmt.Println("OIDC Client App (客户端应用) 正在监听 http://127.0.0.1:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// 5. 启动 HTTP 服务器，收到 SIGTERM 或 SIGINT 后等待进行中的请求完成再退出
+	srv, err := newServer(":8080", withRequestLog(withTracing(withMetrics(http.DefaultServeMux))))
+	if err != nil {
+		fatal("无法创建 HTTP 服务器", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	slog.Info("OIDC Client App (客户端应用) 正在监听", "url", baseURL, "provider", *providerURL)
+	if err := runServer(ctx, srv); err != nil {
+		fatal("HTTP 服务器已停止", err)
+	}
 }
 
 // handleHome 是主页处理器，根据用户是否登录显示不同内容。
 func handleHome(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("user-info")
-	// 如果没有会话 Cookie，显示未登录页面
-	if err != nil {
+	sess := currentSession(r)
+	// 如果没有有效的会话 (未登录，或已被 back-channel logout 删除)，显示未登录页面
+	if sess == nil {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
 		io.WriteString(w, `
@@ -90,14 +190,12 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 如果已登录，解码用户信息并显示欢迎页面
-	var userInfo UserInfo
-	data, _ := base64.StdEncoding.DecodeString(cookie.Value)
-	json.Unmarshal(data, &userInfo)
+	// 如果已登录，从会话中取出用户信息并显示欢迎页面
+	userInfo := sess.UserInfo
 
 	var pictureHTML string
 	if userInfo.Picture != "" {
-		pictureHTML = fmt.Sprintf(`<img src="%s" alt="Profile Picture" style="width:100px; border-radius: 50%%; margin-top: 10px;">`, html.EscapeString(userInfo.Picture))
+		pictureHTML = fmt.Sprintf(`<img src="%s" alt="头像" style="width:100px; border-radius: 50%%; margin-top: 10px;">`, html.EscapeString(userInfo.Picture))
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -106,9 +204,10 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 		<h2>欢迎, %s!</h2>
 		<p>您的身份已由我们自己的 OIDC Provider 成功验证。</p>
 		<p>邮箱: %s</p>
+		<p>认证方式: %s</p>
 		%s
 		<p style="margin-top: 20px;"><a href="/logout">退出登录</a></p>
-	`, html.EscapeString(userInfo.Name), html.EscapeString(userInfo.Email), pictureHTML))
+	`, html.EscapeString(userInfo.Name), html.EscapeString(userInfo.Email), html.EscapeString(strings.Join(sess.AMR, " + ")), pictureHTML))
 }
 
 // handleLogin 启动 OIDC 登录流程。
@@ -136,21 +235,41 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 	})
 
 	// 3. 将用户重定向到 OIDC Provider 的授权页面。
-	target := oauth2Config.AuthCodeURL(state)
-	fmt.Printf("重定向用户到 OIDC Provider 的授权页面: %s\n", target)
+	var opts []oauth2.AuthCodeOption
+	if *acrValues != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("acr_values", *acrValues))
+	}
+	if *uiLocales != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("ui_locales", *uiLocales))
+	}
+	// 记住本次登录的 trace，回调时继续使用
+	saveLoginTrace(w, r)
+	target := oauth2Config.AuthCodeURL(state, opts...)
+	slog.InfoContext(r.Context(), "重定向用户到 OIDC Provider 的授权页面", "url", target)
 	http.Redirect(w, r, target, http.StatusFound)
 }
 
 // handleCallback 是 OIDC 流程中的回调地址。
 func handleCallback(w http.ResponseWriter, r *http.Request) {
 	// 创建自定义 HTTP 客户端，用于调试网络请求
+	var transport http.RoundTripper = NewDebugTransport()
+	// 启用 DPoP 时，在调试传输层外再包一层，为每个请求附加 DPoP 证明
+	if dpopKey != nil {
+		dt, err := NewDPoPTransport(dpopKey, transport)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		transport = dt
+	}
 	debugClient := &http.Client{
-		Transport: NewDebugTransport(),
+		// 最外层为每个请求创建 span 并附带 traceparent，调试输出中也能看到这个请求头
+		Transport: otelhttp.NewTransport(transport),
 		Timeout:   30 * time.Second,
 	}
 
-	// 将自定义客户端绑定到 context
-	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, debugClient)
+	// 将自定义客户端绑定到 context。context 来自当前请求，其中带有回调请求的 span
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, debugClient)
 
 	// 1. 验证 state 参数，确保请求是由我们自己发起的，防止 CSRF。
 	stateFromCookie, err := r.Cookie("oauth-state")
@@ -168,28 +287,30 @@ func handleCallback(w http.ResponseWriter, r *http.Request) {
 	code := r.URL.Query().Get("code")
 
 	// 添加简单的调试信息
-	fmt.Printf("\n🚀 开始令牌交换...\n")
-	fmt.Printf("🔑 授权码: %s\n", code)
-	fmt.Printf("⏰ 时间: %s\n", time.Now().Format("15:04:05"))
+	slog.DebugContext(ctx, "🚀 开始令牌交换...", "code", code)
 
 	startTime := time.Now()
 
 	// Exchange() 方法会使用授权码与 OIDC Provider 交换访问令牌和 ID Token
-	oauth2Token, err := oauth2Config.Exchange(ctx, code)
+	exchangeCtx, span := tracer.Start(ctx, "token exchange")
+	oauth2Token, err := oauth2Config.Exchange(exchangeCtx, code)
+	endSpan(span, err)
 
 	duration := time.Since(startTime)
-	fmt.Printf("⏱️ 请求耗时: %v\n", duration)
+	exchangeDuration.observe(duration.Seconds(), resultLabel(err))
 
 	if err != nil {
-		fmt.Printf("❌ 令牌交换失败: %v\n", err)
+		exchangeErrors.inc(oauthErrorCode(err))
+		slog.ErrorContext(ctx, "❌ 令牌交换失败", "duration", duration, "error", err)
 		http.Error(w, "交换令牌失败: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Printf("✅ 令牌交换成功!\n")
-	fmt.Printf("🎫 AccessToken 前缀: %s...\n", oauth2Token.AccessToken[:min(20, len(oauth2Token.AccessToken))])
-	fmt.Printf("🏷️ TokenType: %s\n", oauth2Token.TokenType)
-	fmt.Printf("⏰ 过期时间: %s\n", oauth2Token.Expiry.Format("15:04:05"))
+	slog.InfoContext(ctx, "✅ 令牌交换成功!",
+		"duration", duration,
+		"access_token_prefix", oauth2Token.AccessToken[:min(20, len(oauth2Token.AccessToken))]+"...",
+		"token_type", oauth2Token.TokenType,
+		"expiry", oauth2Token.Expiry.Format("15:04:05"))
 
 	// 3. 从令牌响应中提取 ID Token。
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
@@ -200,7 +321,11 @@ func handleCallback(w http.ResponseWriter, r *http.Request) {
 
 	// 4. 验证 ID Token。这是 OIDC 的核心安全步骤。
 	// Verifier 会检查签名、颁发者(iss)、受众(aud)、有效期等。
-	idToken, err := idTokenVerifier.Verify(ctx, rawIDToken)
+	verifyStart := time.Now()
+	verifyCtx, span := tracer.Start(ctx, "verify ID token")
+	idToken, err := idTokenVerifier.Verify(verifyCtx, rawIDToken)
+	endSpan(span, err)
+	verifyDuration.observe(time.Since(verifyStart).Seconds(), resultLabel(err))
 	if err != nil {
 		http.Error(w, "验证 ID Token 失败: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -212,36 +337,62 @@ func handleCallback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "解析用户信息失败: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// sid 是 Provider 端的会话 ID，back-channel logout 时用它找到对应的本地会话；
+	// acr 和 amr 说明用户是如何完成认证的
+	var sessionClaims struct {
+		SID string   `json:"sid"`
+		ACR string   `json:"acr"`
+		AMR []string `json:"amr"`
+	}
+	idToken.Claims(&sessionClaims)
 
-	// 6. 将用户信息存入一个安全的会话 Cookie，标志用户已登录。
-	jsonData, err := json.Marshal(claims)
-	if err != nil {
-		http.Error(w, "序列化用户信息失败", http.StatusInternalServerError)
+	// acr_values 对 Provider 来说只是一个请求，客户端必须自己检查实际达到的认证级别
+	if *acrValues != "" && !slices.Contains(strings.Fields(*acrValues), sessionClaims.ACR) {
+		http.Error(w, "认证级别不满足要求: acr="+sessionClaims.ACR, http.StatusForbidden)
 		return
 	}
-	encodedData := base64.StdEncoding.EncodeToString(jsonData)
-	http.SetCookie(w, &http.Cookie{
-		Name:     "user-info",
-		Value:    encodedData,
-		Path:     "/",
-		MaxAge:   int(time.Hour.Seconds()),
-		HttpOnly: true,
+	slog.InfoContext(ctx, "🔐 认证方式", "amr", sessionClaims.AMR, "acr", sessionClaims.ACR)
+
+	// 5.1 用访问令牌调用 UserInfo 端点 (使用 DPoP 时会自动附带带有 ath 的证明)。
+	// 这一步只用于演示受保护资源的访问，失败不影响登录。
+	if userInfo, err := oidcProvider.UserInfo(ctx, oauth2.StaticTokenSource(oauth2Token)); err != nil {
+		slog.WarnContext(ctx, "⚠️ 调用 UserInfo 失败", "error", err)
+	} else {
+		slog.InfoContext(ctx, "👤 UserInfo 返回的用户", "sub", userInfo.Subject, "email", userInfo.Email)
+	}
+
+	// 6. 创建服务器端会话，Cookie 中只保存会话 ID，标志用户已登录。
+	err = createSession(w, &Session{
+		UserInfo:    claims,
+		Subject:     idToken.Subject,
+		ProviderSID: sessionClaims.SID,
+		AMR:         sessionClaims.AMR,
+		RawIDToken:  rawIDToken,
 	})
+	if err != nil {
+		http.Error(w, "创建会话失败", http.StatusInternalServerError)
+		return
+	}
 
 	// 7. 重定向到主页，此时用户已经是登录状态。
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-// handleLogout 用于清除会话 Cookie，实现退出登录。
+// handleLogout 删除本地会话，然后把用户带到 Provider 结束其会话 (RP-Initiated Logout)。
+// Provider 会通知其他参与的客户端，最后再重定向回我们的主页。
 func handleLogout(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "user-info",
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Unix(0, 0), // 设置为过去的某个时间点，使 Cookie立即失效
-		HttpOnly: true,
-	})
-	http.Redirect(w, r, "/", http.StatusFound)
+	sess := deleteSession(w, r)
+	if sess == nil || endSessionURL == "" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	params := url.Values{
+		"client_id":                {clientID},
+		"id_token_hint":            {sess.RawIDToken},
+		"post_logout_redirect_uri": {postLogoutRedirectURL},
+	}
+	http.Redirect(w, r, endSessionURL+"?"+params.Encode(), http.StatusFound)
 }
 
 // generateRandomString 是一个生成随机字符串的工具函数。
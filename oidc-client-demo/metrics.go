@@ -0,0 +1,240 @@
+// metrics.go - Prometheus 格式的运行指标
+// GET /metrics 以 Prometheus 文本格式 (text/plain; version=0.0.4) 输出每个路由的请求数和延迟，
+// 以及与 Provider 交互的耗时: 用授权码交换令牌、验证 ID Token，交换失败时按 OAuth 错误码计数。
+// 和 Provider 一样，为了不引入依赖，这里只实现了所需的计数器和直方图。
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// latencyBuckets 是请求延迟直方图的桶上限 (秒)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// counterVec 是一组按标签值区分的计数器
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // 键是以 \xff 连接的标签值
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// inc 将标签值对应的计数器加 1，标签值的顺序与创建时的 labels 相同
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\xff")]++
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec 是一组按标签值区分的直方图
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // 每个桶 (不累计) 的观测数，最后一个是 +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+// observe 记录一次观测值 v (秒)
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	hist.counts[sort.SearchFloat64s(h.buckets, v)]++
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(hist.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+// writeGauge 输出一个没有标签的瞬时值
+func writeGauge(b *strings.Builder, name, help string, v float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// formatLabels 把标签名和以 \xff 连接的标签值组合成 {a="x",b="y"}，extraName 不为空时追加一个标签 (直方图的 le)
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], strconv.Quote(v)))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 客户端的指标
+var (
+	httpRequests = newCounterVec("oidc_client_http_requests_total",
+		"HTTP requests by route and status code.", "handler", "code")
+	httpDuration = newHistogramVec("oidc_client_http_request_duration_seconds",
+		"HTTP request latency by route.", latencyBuckets, "handler")
+	exchangeDuration = newHistogramVec("oidc_client_token_exchange_duration_seconds",
+		"Latency of exchanging the authorization code at the token endpoint.", latencyBuckets, "result")
+	exchangeErrors = newCounterVec("oidc_client_token_exchange_errors_total",
+		"Failed token exchanges by OAuth error code (\"transport\" when there was no OAuth error response).", "error")
+	verifyDuration = newHistogramVec("oidc_client_id_token_verification_duration_seconds",
+		"Latency of verifying the ID token, including fetching the JWKS when needed.", latencyBuckets, "result")
+)
+
+// resultLabel 把错误转换为 result 标签的值
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// oauthErrorCode 返回令牌端点返回的 OAuth 错误码 (例如 invalid_grant)，没有 OAuth 错误响应时返回 "transport"
+func oauthErrorCode(err error) string {
+	var re *oauth2.RetrieveError
+	if errors.As(err, &re) && re.ErrorCode != "" {
+		return re.ErrorCode
+	}
+	return "transport"
+}
+
+// statusRecorder 记录处理器写出的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap 让 http.ResponseController 可以访问原始的 ResponseWriter
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// withMetrics 统计每个请求的状态码和延迟，路由标签使用 ServeMux 匹配到的模式而不是原始路径。
+// next 必须把同一个 *http.Request 交给 ServeMux，否则看不到匹配到的模式
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// ServeMux 会在请求上记录匹配到的模式
+		handler := r.Pattern
+		if handler == "" {
+			handler = "unmatched"
+		}
+		httpRequests.inc(handler, strconv.Itoa(rec.status))
+		httpDuration.observe(time.Since(start).Seconds(), handler)
+	})
+}
+
+// handleMetrics 输出所有指标
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	httpRequests.write(&b)
+	httpDuration.write(&b)
+	exchangeDuration.write(&b)
+	exchangeErrors.write(&b)
+	verifyDuration.write(&b)
+
+	now := time.Now()
+	active := 0
+	sessionsMu.Lock()
+	for _, sess := range sessions {
+		if now.Before(sess.Expiry) {
+			active++
+		}
+	}
+	sessionsMu.Unlock()
+	writeGauge(&b, "oidc_client_active_sessions", "Local sessions that have not expired.", float64(active))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, b.String())
+}
@@ -0,0 +1,211 @@
+// server.go - HTTP 服务器的生命周期
+// 客户端使用带有超时设置的 http.Server。收到 SIGTERM 或 SIGINT 时优雅退出:
+// /readyz 立即开始返回 503，服务器不再接受新的连接，最多等待 15 秒让进行中的请求 (例如正在交换令牌的回调) 完成。
+//
+// GET /healthz 是存活检查；GET /readyz 是就绪检查，能拿到 Provider 的签名公钥 (已缓存或现在获取成功)
+// 并且没有在退出时返回 200。会话只保存在内存中，不需要检查。
+//
+// -tls-cert/-tls-key 以 HTTPS 方式监听，-tls-self-signed 使用自动生成的自签名证书 (只用于开发)。
+// Provider 使用自签名证书时，用 -provider-ca 指定它的证书文件，客户端会信任这个证书。
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 服务器的超时设置
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 30 * time.Second
+	// writeTimeout 需要比向 Provider 交换令牌等请求的超时 (tracedHTTPClient.Timeout) 长
+	writeTimeout    = 60 * time.Second
+	idleTimeout     = 2 * time.Minute
+	shutdownTimeout = 15 * time.Second
+)
+
+// shuttingDown 在收到退出信号后为 true，/readyz 据此返回 503
+var shuttingDown atomic.Bool
+
+// newServer 创建 HTTP 服务器。-tls-self-signed 时在这里准备好证书
+func newServer(addr string, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	if *tlsSelfSigned {
+		cert, err := selfSignedCertificate(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return srv, nil
+}
+
+// runServer 开始处理请求，直到 ctx 结束 (收到退出信号) 后优雅退出。监听失败时返回错误
+func runServer(ctx context.Context, srv *http.Server) error {
+	errc := make(chan error, 1)
+	go func() {
+		switch {
+		case srv.TLSConfig != nil:
+			errc <- srv.ListenAndServeTLS("", "")
+		case *tlsCert != "":
+			errc <- srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		default:
+			errc <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true)
+	slog.Info("收到退出信号，等待进行中的请求完成", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("等待请求完成超时，强制关闭剩余的连接", "error", err)
+		srv.Close()
+	}
+	slog.Info("HTTP 服务器已停止")
+	return nil
+}
+
+// trustProviderCA 让发给 Provider 的请求 (都经过 http.DefaultTransport) 额外信任 caFile 中的证书
+func trustProviderCA(caFile string) error {
+	pemData, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemData) {
+		return fmt.Errorf("%s 中没有 PEM 格式的证书", caFile)
+	}
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+	return nil
+}
+
+// --- 健康检查 ---
+
+// handleHealthz 是存活检查: 能处理请求就说明进程还活着
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, "ok", nil)
+}
+
+// handleReadyz 是就绪检查: 没有 Provider 的公钥就无法验证 ID Token，登录一定会失败
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"provider_keys": "ok", "server": "ok"}
+	ready := true
+	if err := jwksKeys.ready(r.Context()); err != nil {
+		checks["provider_keys"], ready = err.Error(), false
+	}
+	if shuttingDown.Load() {
+		checks["server"], ready = "正在退出", false
+	}
+	if !ready {
+		writeHealth(w, http.StatusServiceUnavailable, "unavailable", checks)
+		return
+	}
+	writeHealth(w, http.StatusOK, "ready", checks)
+}
+
+func writeHealth(w http.ResponseWriter, status int, state string, checks map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks,omitempty"`
+	}{state, checks})
+}
+
+// --- 自签名证书 ---
+
+// selfSignedCertificate 返回 127.0.0.1 和 localhost 的自签名证书。设置了 certFile 和 keyFile 时，
+// 第一次启动生成证书并写入这两个文件，之后直接读取它们；否则每次启动在内存中生成新的证书
+func selfSignedCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" {
+		if _, err := os.Stat(certFile); err == nil {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return tls.Certificate{}, fmt.Errorf("无法读取自签名证书: %w", err)
+			}
+			return cert, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return tls.Certificate{}, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "127.0.0.1", Organization: []string{"oidc-client-demo development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if certFile != "" {
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, fmt.Errorf("无法保存自签名证书的私钥: %w", err)
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, fmt.Errorf("无法保存自签名证书: %w", err)
+		}
+		slog.Info("已生成自签名证书", "cert_file", certFile)
+	} else {
+		slog.Info("已在内存中生成自签名证书，重启后会变化")
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,120 @@
+// session.go - 客户端的服务器端会话
+// 以前登录状态完全保存在浏览器的 user-info Cookie 中，服务器无法主动让它失效。
+// 现在 Cookie 中只保存一个随机的会话 ID，用户信息以及 Provider 的 sid/sub 都保存在服务器内存中，
+// 这样收到 Provider 的 back-channel logout 通知时，我们就可以直接删除对应的会话。
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionCookieName 是保存会话 ID 的 Cookie 名称
+	sessionCookieName = "session-id"
+	// sessionLifetime 是本地会话的有效期
+	sessionLifetime = time.Hour
+)
+
+// Session 是用户在本客户端应用中的一次登录会话
+type Session struct {
+	ID       string
+	UserInfo UserInfo
+	// Subject 和 ProviderSID 来自 ID Token 的 sub 和 sid，用于匹配 logout_token
+	Subject     string
+	ProviderSID string
+	// AMR 是 ID Token 中的 amr 声明，即用户在 Provider 完成的认证方式
+	AMR []string
+	// RawIDToken 在退出登录时作为 id_token_hint 发给 Provider
+	RawIDToken string
+	Expiry     time.Time
+}
+
+var (
+	// 存储所有的本地会话，键为会话 ID
+	sessions   = make(map[string]*Session)
+	sessionsMu sync.Mutex
+)
+
+// createSession 保存一个新会话，并通过 Cookie 把会话 ID 交给浏览器
+func createSession(w http.ResponseWriter, sess *Session) error {
+	id, err := generateRandomString(32)
+	if err != nil {
+		return err
+	}
+	sess.ID = id
+	sess.Expiry = time.Now().Add(sessionLifetime)
+
+	sessionsMu.Lock()
+	sessions[id] = sess
+	sessionsMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// currentSession 返回请求对应的有效会话，没有登录或会话已失效时返回 nil
+func currentSession(r *http.Request) *Session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sess, ok := sessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(sess.Expiry) {
+		delete(sessions, sess.ID)
+		return nil
+	}
+	return sess
+}
+
+// deleteSession 删除请求对应的会话并清除 Cookie，返回被删除的会话 (可能为 nil)
+func deleteSession(w http.ResponseWriter, r *http.Request) *Session {
+	sess := currentSession(r)
+	if sess != nil {
+		sessionsMu.Lock()
+		delete(sessions, sess.ID)
+		sessionsMu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0), // 设置为过去的某个时间点，使 Cookie 立即失效
+		HttpOnly: true,
+	})
+	return sess
+}
+
+// deleteSessionsByProvider 删除与 Provider 会话匹配的所有本地会话。
+// sid 不为空时按 sid 匹配 (若 sub 也不为空则两者都要匹配)，否则删除该 sub 的所有会话。返回删除的数量。
+func deleteSessionsByProvider(sid, sub string) int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	count := 0
+	for id, sess := range sessions {
+		if sid != "" && sess.ProviderSID != sid {
+			continue
+		}
+		if sub != "" && sess.Subject != sub {
+			continue
+		}
+		delete(sessions, id)
+		count++
+	}
+	return count
+}
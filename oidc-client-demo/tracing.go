@@ -0,0 +1,263 @@
+// tracing.go - OpenTelemetry 分布式追踪
+// 客户端处理的每个请求都是一个 span；发给 Provider 的请求 (发现文档、JWKS、令牌交换、UserInfo) 是它们的子 span，
+// 并通过 W3C traceparent 头把 trace 传给 Provider，Provider 的 span 会加入同一个 trace。
+//
+// 登录要经过浏览器的多次重定向，浏览器不会携带 traceparent。所以 /login 把自己的 trace 上下文保存在 Cookie 中，
+// 回到 /auth/callback 时继续这个 trace，这样一次登录 (包括 Provider 的 /token、/userinfo) 就是一个完整的 trace。
+// 用户在 Provider 页面上的操作 (登录、同意) 不经过客户端，它们在 Provider 中是单独的 trace。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	// tracingServiceName 是 span 中的 service.name
+	tracingServiceName = "oidc-client-demo"
+	// loginTraceCookieName 保存 /login 的 traceparent，供 /auth/callback 继续同一个 trace
+	loginTraceCookieName = "oauth-trace"
+)
+
+// tracer 用于创建令牌交换、ID Token 验证等内部步骤的 span
+var tracer = otel.Tracer(tracingServiceName)
+
+// setupTracing 设置全局的 TracerProvider 和 W3C Trace Context 传播方式。
+// exporter 为 none (不记录 span，但仍然转发 traceparent)、stdout 或 otlp-file (每行一个 OTLP JSON 格式的 ExportTraceServiceRequest)。
+// 返回的函数在退出前调用，把还在缓冲中的 span 输出
+func setupTracing(exporterName, file string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName {
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp-file":
+		exporter, err = otlptrace.New(context.Background(), &otlpFileClient{path: file})
+	case "none", "":
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("未知的 span 输出 %q (可选 none、stdout 或 otlp-file)", exporterName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无法创建 span 输出: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		// 演示环境中请求不多，每秒输出一次，方便边操作边查看
+		sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(time.Second)),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracingServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// otlpFileClient 实现 otlptrace.Client，把每批 span 以 OTLP JSON 的形式作为一行追加到文件中
+type otlpFileClient struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (c *otlpFileClient) Start(ctx context.Context) error {
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	c.file = f
+	return nil
+}
+
+func (c *otlpFileClient) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+func (c *otlpFileClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	line, err := protojson.Marshal(&coltracepb.ExportTraceServiceRequest{ResourceSpans: spans})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.file.Write(append(line, '\n'))
+	return err
+}
+
+// probePaths 是监控系统频繁访问的路径，它们的 span 只会淹没有用的 trace
+var probePaths = map[string]bool{"/metrics": true, "/healthz": true, "/readyz": true}
+
+// withTracing 为每个请求创建一个服务端 span，在路由匹配后命名为 "方法 路由" (例如 "GET /auth/callback")。
+// /metrics 的抓取和健康检查不记录
+func withTracing(next http.Handler) http.Handler {
+	traced := otelhttp.NewHandler(next, "http.server",
+		otelhttp.WithFilter(func(r *http.Request) bool { return !probePaths[r.URL.Path] }),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return spanName(r) }),
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 回调请求来自浏览器，没有 traceparent: 用 /login 保存的 trace 上下文作为父 span
+		if r.URL.Path == "/auth/callback" && r.Header.Get("traceparent") == "" {
+			if c, err := r.Cookie(loginTraceCookieName); err == nil {
+				r.Header.Set("traceparent", c.Value)
+			}
+		}
+		traced.ServeHTTP(w, r)
+	})
+}
+
+// spanName 返回服务端 span 的名称。otelhttp 在开始时 (还没有匹配路由) 和处理完请求后各调用一次，
+// 后一次 ServeMux 已经在请求上记录了匹配到的模式
+func spanName(r *http.Request) string {
+	if r.Pattern == "" {
+		return r.Method
+	}
+	// 模式可能带有方法前缀，例如 "GET /metrics"
+	route := r.Pattern
+	if i := strings.Index(route, " "); i >= 0 {
+		route = route[i+1:]
+	}
+	return r.Method + " " + route
+}
+
+// saveLoginTrace 把当前请求的 trace 上下文保存到 Cookie 中，有效期与 oauth-state 相同
+func saveLoginTrace(w http.ResponseWriter, r *http.Request) {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(r.Context(), carrier)
+	if carrier["traceparent"] == "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginTraceCookieName,
+		Value:    carrier["traceparent"],
+		Path:     "/auth/callback",
+		MaxAge:   int(10 * time.Minute.Seconds()),
+		HttpOnly: true,
+	})
+}
+
+// endSpan 结束 span，err 不为 nil 时把 span 标记为失败
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedHTTPClient 是发给 Provider 的请求使用的客户端，每个请求都是一个客户端 span 并带有 traceparent
+var tracedHTTPClient = &http.Client{
+	Transport: otelhttp.NewTransport(http.DefaultTransport),
+	Timeout:   30 * time.Second,
+}
+
+// jwksKeySet 实现 oidc.KeySet，用于验证 Provider 签名的 ID Token 和 logout_token。
+// go-oidc 自带的 RemoteKeySet 用创建时的 context 获取 JWKS，获取请求不会出现在登录的 trace 中；
+// 这里改为使用验证时的 context，遇到未知的 kid 时 (例如 Provider 轮换了密钥) 重新获取
+type jwksKeySet struct {
+	url  string
+	mu   sync.Mutex
+	keys []jose.JSONWebKey
+}
+
+func (k *jwksKeySet) VerifySignature(ctx context.Context, rawJWT string) ([]byte, error) {
+	jws, err := jose.ParseSigned(rawJWT, []jose.SignatureAlgorithm{jose.RS256, jose.RS384, jose.RS512, jose.ES256, jose.ES384, jose.ES512, jose.PS256})
+	if err != nil {
+		return nil, fmt.Errorf("无法解析 JWT: %w", err)
+	}
+	kid := jws.Signatures[0].Header.KeyID
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if payload, ok := verifyWithKeys(jws, k.keys, kid); ok {
+		return payload, nil
+	}
+	// 缓存中没有能验证签名的密钥，从 Provider 重新获取
+	keys, err := fetchJWKS(ctx, k.url)
+	if err != nil {
+		return nil, err
+	}
+	k.keys = keys
+	if payload, ok := verifyWithKeys(jws, k.keys, kid); ok {
+		return payload, nil
+	}
+	return nil, errors.New("没有能验证签名的密钥")
+}
+
+// ready 在缓存中没有公钥时从 Provider 获取，用于就绪检查
+func (k *jwksKeySet) ready(ctx context.Context) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) > 0 {
+		return nil
+	}
+	keys, err := fetchJWKS(ctx, k.url)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("Provider 没有公布任何公钥")
+	}
+	k.keys = keys
+	return nil
+}
+
+// verifyWithKeys 用 kid 相同的密钥 (kid 为空时用所有密钥) 验证签名
+func verifyWithKeys(jws *jose.JSONWebSignature, keys []jose.JSONWebKey, kid string) ([]byte, bool) {
+	for _, key := range keys {
+		if kid != "" && key.KeyID != kid {
+			continue
+		}
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, true
+		}
+	}
+	return nil, false
+}
+
+// fetchJWKS 获取 Provider 的公钥集合
+func fetchJWKS(ctx context.Context, url string) ([]jose.JSONWebKey, error) {
+	ctx, span := tracer.Start(ctx, "fetch JWKS")
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := tracedHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("获取 JWKS 失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取 JWKS 失败: %s", resp.Status)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("解析 JWKS 失败: %w", err)
+	}
+	return set.Keys, nil
+}
@@ -0,0 +1,848 @@
+// admin.go - 管理 API
+// /admin/api 下的接口供运维和测试脚本调用，请求必须带上 Authorization: Bearer <admin.token>。
+// 没有配置 admin.token 时管理 API 不可用。接口的完整说明见 openapi.yaml (GET /admin/api/openapi.yaml)。
+// 客户端和用户的请求体与配置文件中的格式相同 (JSON 或 YAML)；返回的 JSON 不包含密钥和密码哈希。
+// 每个 realm 的管理 API 在 /realms/{name}/admin/api 下，只管理这个 realm；管理令牌是所有 realm 共用的。
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AdminConfig 是管理 API 的配置
+type AdminConfig struct {
+	// Token 是调用管理 API 的 Bearer 令牌，为空时管理 API 不可用
+	Token string `yaml:"token"`
+}
+
+//go:embed openapi.yaml
+var adminOpenAPI []byte
+
+// maxAdminBody 是管理 API 请求体的大小上限
+const maxAdminBody = 1 << 20
+
+// registerAdminRoutes 注册管理 API 的路由
+func registerAdminRoutes() {
+	http.HandleFunc("GET /admin/api/openapi.yaml", requireAdmin(handleAdminOpenAPI))
+
+	http.HandleFunc("GET /admin/api/clients", requireAdmin(handleAdminListClients))
+	http.HandleFunc("POST /admin/api/clients", requireAdmin(handleAdminCreateClient))
+	http.HandleFunc("GET /admin/api/clients/{id}", requireAdmin(handleAdminGetClient))
+	http.HandleFunc("PUT /admin/api/clients/{id}", requireAdmin(handleAdminPutClient))
+	http.HandleFunc("DELETE /admin/api/clients/{id}", requireAdmin(handleAdminDeleteClient))
+
+	http.HandleFunc("GET /admin/api/users", requireAdmin(handleAdminListUsers))
+	http.HandleFunc("POST /admin/api/users", requireAdmin(handleAdminCreateUser))
+	http.HandleFunc("GET /admin/api/users/{username}", requireAdmin(handleAdminGetUser))
+	http.HandleFunc("PUT /admin/api/users/{username}", requireAdmin(handleAdminPutUser))
+	http.HandleFunc("DELETE /admin/api/users/{username}", requireAdmin(handleAdminDeleteUser))
+	http.HandleFunc("DELETE /admin/api/users/{username}/sessions", requireAdmin(handleAdminEndUserSessions))
+	http.HandleFunc("DELETE /admin/api/users/{username}/mfa", requireAdmin(handleAdminResetMFA))
+
+	http.HandleFunc("GET /admin/api/sessions", requireAdmin(handleAdminListSessions))
+	http.HandleFunc("DELETE /admin/api/sessions/{sid}", requireAdmin(handleAdminEndSession))
+
+	http.HandleFunc("GET /admin/api/tokens", requireAdmin(handleAdminListTokens))
+	http.HandleFunc("DELETE /admin/api/tokens", requireAdmin(handleAdminRevokeTokens))
+	http.HandleFunc("DELETE /admin/api/tokens/{jti}", requireAdmin(handleAdminRevokeToken))
+
+	http.HandleFunc("GET /admin/api/keys", requireAdmin(handleAdminGetKeys))
+	http.HandleFunc("POST /admin/api/keys/rotate", requireAdmin(handleAdminRotateKey))
+
+	http.HandleFunc("GET /admin/api/lockouts", requireAdmin(handleAdminListLockouts))
+	http.HandleFunc("DELETE /admin/api/lockouts/{kind}/{value}", requireAdmin(handleAdminUnlock))
+
+	http.HandleFunc("GET /admin/api/audit", requireAdmin(handleAdminAudit))
+
+	http.HandleFunc("POST /admin/api/reset", requireAdmin(handleAdminReset))
+}
+
+// requireAdmin 检查管理令牌，通过后才调用 next。realm 设置了自己的 admin.token 时只接受它 (见 realm.go)
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := requestRealm(r).currentConfig().Admin.Token
+		if token == "" {
+			writeAdminError(w, http.StatusNotFound, "管理 API 未启用 (没有配置 admin.token)")
+			return
+		}
+		scheme, presented, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || !secretsEqual(presented, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeAdminError(w, http.StatusUnauthorized, "无效的管理令牌")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminOpenAPI 返回管理 API 的 OpenAPI 描述
+func handleAdminOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(adminOpenAPI)
+}
+
+// --- 客户端 ---
+
+// clientView 是管理 API 返回的客户端，不包含 secret
+type clientView struct {
+	ID                                    string             `json:"id"`
+	RedirectURIs                          []string           `json:"redirect_uris,omitempty"`
+	RequireDPoP                           bool               `json:"require_dpop"`
+	TokenExchange                         *tokenExchangeView `json:"token_exchange,omitempty"`
+	PostLogoutRedirectURIs                []string           `json:"post_logout_redirect_uris,omitempty"`
+	BackchannelLogoutURI                  string             `json:"backchannel_logout_uri,omitempty"`
+	FrontchannelLogoutURI                 string             `json:"frontchannel_logout_uri,omitempty"`
+	BackchannelTokenDeliveryMode          string             `json:"backchannel_token_delivery_mode,omitempty"`
+	BackchannelClientNotificationEndpoint string             `json:"backchannel_client_notification_endpoint,omitempty"`
+	// Configured 表示客户端来自配置文件，重新加载配置时会被配置中的设置覆盖
+	Configured bool `json:"configured"`
+}
+
+// tokenExchangeView 的字段与 TokenExchangePolicy 相同，只是加上了 JSON 名称
+type tokenExchangeView struct {
+	SubjectClients     []string `json:"subject_clients"`
+	Audiences          []string `json:"audiences"`
+	AllowImpersonation bool     `json:"allow_impersonation"`
+	AllowDelegation    bool     `json:"allow_delegation"`
+	ActorClients       []string `json:"actor_clients"`
+}
+
+func (rlm *realm) newClientView(client Client) clientView {
+	v := clientView{
+		ID:                                    client.ID,
+		RedirectURIs:                          client.RedirectURIs,
+		RequireDPoP:                           client.RequireDPoP,
+		PostLogoutRedirectURIs:                client.PostLogoutRedirectURIs,
+		BackchannelLogoutURI:                  client.BackchannelLogoutURI,
+		FrontchannelLogoutURI:                 client.FrontchannelLogoutURI,
+		BackchannelTokenDeliveryMode:          client.BackchannelTokenDeliveryMode,
+		BackchannelClientNotificationEndpoint: client.BackchannelClientNotificationEndpoint,
+	}
+	if client.TokenExchange != nil {
+		te := tokenExchangeView(*client.TokenExchange)
+		v.TokenExchange = &te
+	}
+	for _, c := range rlm.currentConfig().Clients {
+		if c.ID == client.ID {
+			v.Configured = true
+		}
+	}
+	return v
+}
+
+func handleAdminListClients(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	clients, err := rlm.store.ListClients()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "读取客户端失败: "+err.Error())
+		return
+	}
+	list := make([]clientView, len(clients))
+	for i, client := range clients {
+		list[i] = rlm.newClientView(client)
+	}
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+func handleAdminGetClient(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	client, ok := adminLookup(w, rlm.store.GetClient, r.PathValue("id"), "客户端")
+	if !ok {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, rlm.newClientView(client))
+}
+
+// handleAdminCreateClient 注册新的客户端，ID 已存在时返回 409
+func handleAdminCreateClient(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	var client Client
+	if !decodeAdminBody(w, r, &client) {
+		return
+	}
+	if _, err := rlm.saveClient(client, true); err != nil {
+		writeAdminFailure(w, err)
+		return
+	}
+	auditAdmin(r, "", "created")
+	writeAdminJSON(w, http.StatusCreated, rlm.newClientView(client))
+}
+
+// handleAdminPutClient 创建或整体替换客户端。替换时 secret 可以省略，表示沿用原来的值
+func handleAdminPutClient(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	rlm := requestRealm(r)
+	var client Client
+	if !decodeAdminBody(w, r, &client) {
+		return
+	}
+	if client.ID == "" {
+		client.ID = id
+	} else if client.ID != id {
+		writeAdminError(w, http.StatusBadRequest, "请求体中的 id 与路径不一致")
+		return
+	}
+	replaced, err := rlm.saveClient(client, false)
+	if err != nil {
+		writeAdminFailure(w, err)
+		return
+	}
+	status, action := http.StatusCreated, "created"
+	if replaced {
+		status, action = http.StatusOK, "replaced"
+	}
+	auditAdmin(r, "", action)
+	writeAdminJSON(w, status, rlm.newClientView(client))
+}
+
+// handleAdminDeleteClient 删除客户端，同时撤销它持有的访问令牌和用户对它的授权
+func handleAdminDeleteClient(w http.ResponseWriter, r *http.Request) {
+	revoked, err := deleteClient(r, r.PathValue("id"))
+	if err != nil {
+		writeAdminFailure(w, err)
+		return
+	}
+	auditAdmin(r, "", fmt.Sprintf("deleted, tokens=%d", revoked))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveClient 检查并保存客户端，管理 API 和管理控制台共用。create 为 true 时客户端必须是新的；
+// 否则覆盖同 ID 的客户端，secret 为空时沿用原来的值。返回是否覆盖了已有的客户端
+func (rlm *realm) saveClient(client Client, create bool) (bool, error) {
+	existing, err := rlm.store.GetClient(client.ID)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return false, err
+	}
+	found := err == nil
+	if found && create {
+		return false, &adminError{Status: http.StatusConflict, Message: "客户端 " + client.ID + " 已存在"}
+	}
+	if found && client.Secret == "" {
+		client.Secret = existing.Secret
+	}
+
+	problems := clientProblems(client)
+	if client.ID == "" {
+		problems = append([]string{"id 不能为空"}, problems...)
+	}
+	if len(problems) > 0 {
+		return false, &adminError{Status: http.StatusBadRequest, Message: "客户端设置无效", Problems: problems}
+	}
+	return found, rlm.store.SaveClient(client)
+}
+
+// deleteClient 删除客户端，同时撤销它持有的访问令牌，并删除所有用户对它的授权 (之后同 ID 的新客户端不会继承它们)。
+// 返回撤销的令牌数量
+func deleteClient(r *http.Request, id string) (int, error) {
+	rlm := requestRealm(r)
+	if _, err := rlm.store.GetClient(id); err != nil {
+		return 0, notFoundError(err, "客户端", id)
+	}
+	if err := rlm.store.DeleteClient(id); err != nil {
+		return 0, err
+	}
+	revoked, err := revokeTokens(r, "", id, "client deleted")
+	if err != nil {
+		return 0, err
+	}
+	users, err := rlm.store.ListUsers()
+	if err != nil {
+		return revoked, err
+	}
+	for _, user := range users {
+		if err := rlm.store.DeleteGrant(user.Username, id); err != nil {
+			return revoked, err
+		}
+	}
+	return revoked, nil
+}
+
+// --- 用户 ---
+
+// userView 是管理 API 返回的用户，不包含密码哈希和两步验证的密钥
+type userView struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Picture  string `json:"picture,omitempty"`
+	// Claims 是用户的自定义声明，Admin 表示用户可以登录管理控制台
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	Admin  bool                   `json:"admin"`
+	// TOTPEnabled 和 RecoveryCodes 是两步验证的状态，Passkeys 是已注册的通行密钥的名称
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	RecoveryCodes int      `json:"recovery_codes"`
+	Passkeys      []string `json:"passkeys"`
+	// Identities 是用户关联的上游账号，见 broker.go
+	Identities []FederatedIdentity `json:"identities"`
+	// Configured 表示用户来自配置文件，重新加载配置时会被配置中的设置覆盖
+	Configured bool `json:"configured"`
+}
+
+func (rlm *realm) newUserView(user User) userView {
+	v := userView{
+		ID:            user.ID,
+		Username:      user.Username,
+		Name:          user.Name,
+		Email:         user.Email,
+		Picture:       user.Picture,
+		Claims:        user.Claims,
+		Admin:         user.Admin,
+		TOTPEnabled:   user.TOTPSecret != "",
+		RecoveryCodes: len(user.RecoveryCodes),
+		Passkeys:      make([]string, len(user.Passkeys)),
+		Identities:    user.Identities,
+	}
+	for i, pk := range user.Passkeys {
+		v.Passkeys[i] = pk.Name
+	}
+	for _, u := range rlm.currentConfig().Users {
+		if u.Username == user.Username {
+			v.Configured = true
+		}
+	}
+	return v
+}
+
+func handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	users, err := rlm.store.ListUsers()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "读取用户失败: "+err.Error())
+		return
+	}
+	list := make([]userView, len(users))
+	for i, user := range users {
+		list[i] = rlm.newUserView(user)
+	}
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+func handleAdminGetUser(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	user, ok := adminLookup(w, rlm.store.GetUser, r.PathValue("username"), "用户")
+	if !ok {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, rlm.newUserView(user))
+}
+
+// handleAdminCreateUser 创建新的用户，用户名已存在时返回 409
+func handleAdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	var user User
+	if !decodeAdminBody(w, r, &user) {
+		return
+	}
+	saved, _, err := rlm.saveUser(user, true)
+	if err != nil {
+		writeAdminFailure(w, err)
+		return
+	}
+	auditAdmin(r, "", "created")
+	writeAdminJSON(w, http.StatusCreated, rlm.newUserView(saved))
+}
+
+// handleAdminPutUser 创建或整体替换用户。替换时可以省略 password 和 password_hash，表示沿用原来的密码
+func handleAdminPutUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	rlm := requestRealm(r)
+	var user User
+	if !decodeAdminBody(w, r, &user) {
+		return
+	}
+	if user.Username == "" {
+		user.Username = username
+	} else if user.Username != username {
+		writeAdminError(w, http.StatusBadRequest, "请求体中的 username 与路径不一致")
+		return
+	}
+	saved, replaced, err := rlm.saveUser(user, false)
+	if err != nil {
+		writeAdminFailure(w, err)
+		return
+	}
+	status, action := http.StatusCreated, "created"
+	if replaced {
+		status, action = http.StatusOK, "replaced"
+	}
+	auditAdmin(r, "", action)
+	writeAdminJSON(w, status, rlm.newUserView(saved))
+}
+
+// handleAdminDeleteUser 删除用户，同时结束其会话、撤销其访问令牌和授权
+func handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	ended, revoked, err := deleteUser(r, r.PathValue("username"))
+	if err != nil {
+		writeAdminFailure(w, err)
+		return
+	}
+	auditAdmin(r, "", fmt.Sprintf("deleted, sessions=%d tokens=%d", ended, revoked))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminResetMFA 清除用户的 TOTP 密钥、恢复码和通行密钥，例如用户丢失了设备。
+// 用户之后用密码登录，可以重新启用两步验证。配置文件中设置了 totp_secret 的用户在重新加载配置时会恢复它
+func handleAdminResetMFA(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	var user User
+	err := rlm.store.UpdateUser(r.PathValue("username"), func(u *User) error {
+		u.TOTPSecret, u.TOTPLastStep, u.RecoveryCodes, u.Passkeys = "", 0, nil, nil
+		user = *u
+		return nil
+	})
+	if errors.Is(err, errNotFound) {
+		writeAdminError(w, http.StatusNotFound, "用户 "+r.PathValue("username")+" 不存在")
+		return
+	} else if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "保存用户失败: "+err.Error())
+		return
+	}
+	auditAdmin(r, user.Username, "two-step verification and passkeys reset")
+	slog.InfoContext(r.Context(), "管理员重置了用户的两步验证", "username", user.Username)
+	writeAdminJSON(w, http.StatusOK, rlm.newUserView(user))
+}
+
+// saveUser 检查并保存用户，管理 API 和管理控制台共用。create 为 true 时用户名必须是新的；
+// 否则覆盖同名的用户: 没有设置密码时沿用原来的密码，并保留用户自己启用的两步验证、通行密钥和关联的上游账号
+// (和重新加载配置时一样，见 prepareConfiguredUsers；重置两步验证见 handleAdminResetMFA)。返回保存的用户和是否覆盖了已有的用户
+func (rlm *realm) saveUser(user User, create bool) (User, bool, error) {
+	existing, err := rlm.store.GetUser(user.Username)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return User{}, false, err
+	}
+	found := err == nil
+	if found && create {
+		return User{}, false, &adminError{Status: http.StatusConflict, Message: "用户 " + user.Username + " 已存在"}
+	}
+	if found {
+		if user.Password == "" && user.PasswordHash == "" {
+			user.PasswordHash = existing.PasswordHash
+		}
+		if user.TOTPSecret == "" || user.TOTPSecret == existing.TOTPSecret {
+			user.TOTPSecret, user.TOTPLastStep, user.RecoveryCodes = existing.TOTPSecret, existing.TOTPLastStep, existing.RecoveryCodes
+		}
+		user.Passkeys, user.Identities = existing.Passkeys, existing.Identities
+	}
+
+	problems := userProblems(user)
+	if user.Username == "" {
+		problems = append([]string{"username 不能为空"}, problems...)
+	}
+	if user.ID == "" {
+		problems = append([]string{"id 不能为空"}, problems...)
+	}
+	// 通过管理 API 或控制台设置的明文密码必须符合密码策略 (配置文件中的只会打印警告)
+	if user.Password != "" && user.PasswordHash == "" {
+		if err := rlm.currentConfig().PasswordPolicy.check(user.Password); err != nil {
+			problems = append(problems, "password: "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return User{}, false, &adminError{Status: http.StatusBadRequest, Message: "用户设置无效", Problems: problems}
+	}
+	if other, ok := rlm.findUserByID(user.ID); ok && other.Username != user.Username {
+		return User{}, false, &adminError{Status: http.StatusConflict, Message: fmt.Sprintf("id %s 已被用户 %s 使用", user.ID, other.Username)}
+	}
+
+	if user.Password != "" {
+		if user.PasswordHash, err = hashPassword(user.Password); err != nil {
+			return User{}, false, err
+		}
+		user.Password = ""
+	}
+	return user, found, rlm.store.SaveUser(user)
+}
+
+// deleteUser 删除用户，同时结束其会话 (发送 back-channel logout)、撤销其访问令牌和授权。
+// 返回结束的会话数量和撤销的令牌数量
+func deleteUser(r *http.Request, username string) (int, int, error) {
+	rlm := requestRealm(r)
+	user, err := rlm.store.GetUser(username)
+	if err != nil {
+		return 0, 0, notFoundError(err, "用户", username)
+	}
+	// 先结束会话: 发送 back-channel logout 时还需要读取用户
+	ended, err := endUserSessions(r, user.Username, "")
+	if err != nil {
+		return ended, 0, err
+	}
+	if err := rlm.store.DeleteUser(user.Username); err != nil {
+		return ended, 0, err
+	}
+	revoked, err := revokeTokens(r, user.ID, "", "user deleted")
+	if err != nil {
+		return ended, 0, err
+	}
+	grants, err := rlm.store.ListGrants(user.Username)
+	if err != nil {
+		return ended, revoked, err
+	}
+	for _, grant := range grants {
+		if err := rlm.store.DeleteGrant(user.Username, grant.ClientID); err != nil {
+			return ended, revoked, err
+		}
+	}
+	return ended, revoked, nil
+}
+
+// --- 会话 ---
+
+// sessionView 是管理 API 返回的会话
+type sessionView struct {
+	// Sid 是令牌和审计事件中的 sid，也用来指定要结束的会话。会话 Cookie 的值不会出现在管理 API 中
+	Sid       string    `json:"sid"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	AMR       []string  `json:"amr"`
+	// Clients 是在本会话中获得过授权的客户端，结束会话时会通知它们
+	Clients []string `json:"clients"`
+}
+
+// handleAdminListSessions 列出未过期的会话，可以用 ?username= 过滤
+func handleAdminListSessions(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	sessions, err := requestRealm(r).store.ListSessions()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "读取会话失败: "+err.Error())
+		return
+	}
+	now := time.Now()
+	list := make([]sessionView, 0, len(sessions))
+	for _, sess := range sessions {
+		if now.After(sess.Expiry) || (username != "" && sess.UserID != username) {
+			continue
+		}
+		list = append(list, sessionView{sess.Sid, sess.UserID, sess.CreatedAt, sess.Expiry, sess.AMR, sess.Clients})
+	}
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+// handleAdminEndSession 按 sid 强制结束一个会话，并向参与的客户端发送 back-channel logout。
+// 投递状态可以通过 /logout/deliveries?sid= 查询
+func handleAdminEndSession(w http.ResponseWriter, r *http.Request) {
+	sess, ok := adminLookup(w, requestRealm(r).findSessionBySid, r.PathValue("sid"), "会话")
+	if !ok {
+		return
+	}
+	if _, err := terminateSession(r, &sess); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "结束会话失败: "+err.Error())
+		return
+	}
+	auditAdmin(r, "", "session of "+sess.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminEndUserSessions 强制结束用户的所有会话
+func handleAdminEndUserSessions(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	ended, err := endUserSessions(r, username, "")
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "结束会话失败: "+err.Error())
+		return
+	}
+	auditAdmin(r, "", fmt.Sprintf("sessions=%d", ended))
+	writeAdminJSON(w, http.StatusOK, map[string]int{"ended": ended})
+}
+
+// endUserSessions 结束用户的所有会话 (ID 为 keepID 的会话除外)，返回结束的数量
+func endUserSessions(r *http.Request, username, keepID string) (int, error) {
+	sessions, err := requestRealm(r).store.ListSessions()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, sess := range sessions {
+		if sess.UserID != username || (keepID != "" && sess.ID == keepID) {
+			continue
+		}
+		if _, err := terminateSession(r, &sess); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// --- 访问令牌 ---
+
+// tokenView 是管理 API 返回的访问令牌记录
+type tokenView struct {
+	ID        string    `json:"jti"`
+	ClientID  string    `json:"client_id"`
+	Subject   string    `json:"sub"`
+	Scope     string    `json:"scope"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleAdminListTokens 列出未过期的访问令牌，可以用 ?sub= 和 ?client_id= 过滤
+func handleAdminListTokens(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	tokens, err := requestRealm(r).store.ListTokens()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "读取访问令牌失败: "+err.Error())
+		return
+	}
+	now := time.Now()
+	list := make([]tokenView, 0, len(tokens))
+	for _, token := range tokens {
+		if now.After(token.Expiry) || !token.matches(q.Get("sub"), q.Get("client_id")) {
+			continue
+		}
+		list = append(list, tokenView{token.ID, token.ClientID, token.Subject, token.Scope, token.IssuedAt, token.Expiry})
+	}
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+// handleAdminRevokeToken 按 jti 撤销一个访问令牌
+func handleAdminRevokeToken(w http.ResponseWriter, r *http.Request) {
+	token, ok := adminLookup(w, requestRealm(r).store.GetToken, r.PathValue("jti"), "访问令牌")
+	if !ok {
+		return
+	}
+	if err := revokeToken(r, token.ID, "admin"); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "撤销访问令牌失败: "+err.Error())
+		return
+	}
+	auditAdmin(r, "", "revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminRevokeTokens 撤销某个用户 (?sub=) 或某个客户端 (?client_id=) 的所有访问令牌，两者可以同时使用
+func handleAdminRevokeTokens(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("sub") == "" && q.Get("client_id") == "" {
+		writeAdminError(w, http.StatusBadRequest, "至少需要 sub 或 client_id 参数")
+		return
+	}
+	n, err := revokeTokens(r, q.Get("sub"), q.Get("client_id"), "admin")
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "撤销访问令牌失败: "+err.Error())
+		return
+	}
+	auditAdmin(r, "", fmt.Sprintf("sub=%s client_id=%s revoked=%d", q.Get("sub"), q.Get("client_id"), n))
+	writeAdminJSON(w, http.StatusOK, map[string]int{"revoked": n})
+}
+
+// --- 签名密钥 ---
+
+// keysView 描述当前的签名密钥
+type keysView struct {
+	// Current 是当前签名密钥的 kid，Retired 是仍在 JWKS 中发布的旧公钥的 kid
+	Current string   `json:"current"`
+	Retired []string `json:"retired"`
+	// Source 是当前密钥的来源: file (signing_key_file)、generated (启动时生成) 或 rotated (通过管理 API 轮换)
+	Source string `json:"source"`
+}
+
+func (rlm *realm) newKeysView(keys *signingKeys) keysView {
+	v := keysView{Current: keys.keyID, Retired: make([]string, len(keys.retired)), Source: "generated"}
+	for i, k := range keys.retired {
+		v.Retired[i] = k.KeyID
+	}
+	switch {
+	case keys.rotated:
+		v.Source = "rotated"
+	case rlm.currentConfig().Keys.SigningKeyFile != "":
+		v.Source = "file"
+	}
+	return v
+}
+
+func handleAdminGetKeys(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	writeAdminJSON(w, http.StatusOK, rlm.newKeysView(rlm.currentKeys()))
+}
+
+// handleAdminRotateKey 生成新的签名密钥。密钥来自文件时返回 409: 应替换文件并修改 key_id
+func handleAdminRotateKey(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	if rlm.currentConfig().Keys.SigningKeyFile != "" {
+		writeAdminError(w, http.StatusConflict, "签名密钥来自 signing_key_file，请替换该文件并修改 key_id 来轮换")
+		return
+	}
+	keys, err := rlm.rotateSigningKey()
+	if err != nil {
+		writeAdminError(w, http.StatusConflict, "轮换签名密钥失败: "+err.Error())
+		return
+	}
+	slog.InfoContext(r.Context(), "签名密钥已轮换", "key_id", keys.keyID)
+	auditAdmin(r, "", "kid="+keys.keyID)
+	writeAdminJSON(w, http.StatusOK, rlm.newKeysView(keys))
+}
+
+// --- 登录失败记录 ---
+
+// handleAdminListLockouts 列出当前的登录失败记录，包括已锁定的用户名和 IP
+func handleAdminListLockouts(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, requestRealm(r).listLoginFailures(time.Now()))
+}
+
+// handleAdminUnlock 解锁一个用户名 (/admin/api/lockouts/users/{用户名}) 或 IP (/admin/api/lockouts/ips/{地址})，
+// 同时清除其失败计数
+func handleAdminUnlock(w http.ResponseWriter, r *http.Request) {
+	key, ok := parseThrottleKey(r.PathValue("kind"), r.PathValue("value"))
+	if !ok {
+		writeAdminError(w, http.StatusBadRequest, "路径应为 /admin/api/lockouts/users/{username} 或 /admin/api/lockouts/ips/{ip}")
+		return
+	}
+	if !requestRealm(r).clearLoginFailures(key) {
+		writeAdminError(w, http.StatusNotFound, "没有 "+key+" 的失败记录")
+		return
+	}
+	ev := AuditEvent{Type: auditAdminUnlock, Detail: key}
+	audit(r, ev)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- 重置 ---
+
+// handleAdminReset 把 realm 恢复为配置文件中的状态，见 resetState
+func handleAdminReset(w http.ResponseWriter, r *http.Request) {
+	if err := resetState(r); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "重置失败: "+err.Error())
+		return
+	}
+	auditAdmin(r, "", "reset")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resetState 把请求所属的 realm 恢复为配置文件中的状态，其他 realm 不受影响: 存储中只留下配置的客户端和用户 (用户自己启用的两步验证、
+// 通行密钥和修改过的密码也被清除)，授权码、访问令牌、授权记录和会话全部删除，
+// 内存中的 CIBA 请求、两步验证和通行密钥的进行中状态、登录失败记录和 back-channel logout 投递记录也一并清空。
+// 会话结束前会向参与的客户端发送 back-channel logout。签名密钥和 DPoP 防重放记录保持不变
+func resetState(r *http.Request) error {
+	rlm := requestRealm(r)
+	cfg := rlm.currentConfig()
+	users := make([]User, len(cfg.Users))
+	for i, user := range cfg.Users {
+		if user.Password != "" {
+			hash, err := hashPassword(user.Password)
+			if err != nil {
+				return err
+			}
+			user.PasswordHash, user.Password = hash, ""
+		}
+		users[i] = user
+	}
+
+	mu.Lock()
+	rlm.logoutDeliveries = nil
+	rlm.cibaRequests = make(map[string]*CIBARequest)
+	rlm.mfaChallenges = make(map[string]*MFAChallenge)
+	rlm.passkeyCeremonies = make(map[string]*passkeyCeremony)
+	rlm.loginFailures = make(map[string]*LoginFailures)
+	mu.Unlock()
+
+	sessions, err := rlm.store.ListSessions()
+	if err != nil {
+		return err
+	}
+	for _, sess := range sessions {
+		if _, err := terminateSession(r, &sess); err != nil {
+			return err
+		}
+	}
+	if err := rlm.store.Reset(cfg.Clients, users); err != nil {
+		return err
+	}
+	slog.InfoContext(r.Context(), "已重置为配置中的状态", "clients", len(cfg.Clients), "users", len(users))
+	return nil
+}
+
+// --- 辅助函数 ---
+
+// adminError 是管理操作被拒绝的原因，Status 是对应的 HTTP 状态码。其他错误都是内部错误 (500)
+type adminError struct {
+	Status   int
+	Message  string
+	Problems []string
+}
+
+func (e *adminError) Error() string {
+	if len(e.Problems) > 0 {
+		return e.Message + ": " + strings.Join(e.Problems, "; ")
+	}
+	return e.Message
+}
+
+// notFoundError 把存储返回的 errNotFound 转换为 404 的 adminError，其他错误原样返回
+func notFoundError(err error, kind, id string) error {
+	if errors.Is(err, errNotFound) {
+		return &adminError{Status: http.StatusNotFound, Message: kind + " " + id + " 不存在"}
+	}
+	return err
+}
+
+// adminLookup 从存储中读取一条记录。不存在时返回 404，读取失败时返回 500，两种情况都返回 false
+func adminLookup[T any](w http.ResponseWriter, get func(string) (T, error), id, kind string) (T, bool) {
+	v, err := get(id)
+	if errors.Is(err, errNotFound) {
+		writeAdminError(w, http.StatusNotFound, kind+" "+id+" 不存在")
+		return v, false
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, "读取"+kind+"失败: "+err.Error())
+		return v, false
+	}
+	return v, true
+}
+
+// decodeAdminBody 解析请求体。和配置文件一样用 YAML 解析器读取 (JSON 是 YAML 的子集)，未知的字段会报错。
+// 解析失败时返回 400 和 false
+func decodeAdminBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := yaml.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			writeAdminError(w, http.StatusBadRequest, "请求体不能为空")
+		} else {
+			writeAdminError(w, http.StatusBadRequest, "无法解析请求体: "+err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+// auditAdmin 记录一次通过管理 API 或管理控制台进行的修改。username 是控制台中登录的管理员，
+// 通过管理 API (只有管理令牌) 修改时为空；detail 说明结果
+func auditAdmin(r *http.Request, username, detail string) {
+	audit(r, AuditEvent{Type: auditAdminChange, Username: username, Detail: r.Method + " " + r.URL.Path + ": " + detail})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
+
+// writeAdminFailure 返回管理操作失败的原因。adminError 使用它自己的状态码，请求体无效时用 problems 列出每个问题
+func writeAdminFailure(w http.ResponseWriter, err error) {
+	var ae *adminError
+	if !errors.As(err, &ae) {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(ae.Problems) > 0 {
+		writeAdminJSON(w, ae.Status, map[string]interface{}{"error": ae.Message, "problems": ae.Problems})
+		return
+	}
+	writeAdminError(w, ae.Status, ae.Message)
+}
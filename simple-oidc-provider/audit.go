@@ -0,0 +1,325 @@
+// audit.go - 审计事件
+// 与认证相关的每一个决定 (登录、同意授权、授权码的签发和兑换、访问令牌的签发和撤销、退出登录、管理操作)
+// 都记录为一条结构化的审计事件，以 JSON 行的格式写入配置的输出 (标准输出或文件)，方便安全团队筛选和统计。
+// 最近的事件还保留在内存中，可以通过管理 API 的 GET /admin/api/audit 查询，合规测试可以据此断言 Provider 的行为。
+//
+// 每个 HTTP 请求都有一个关联 ID: 请求带有 X-Correlation-ID 头时沿用它，否则生成一个新的，并在响应头中返回。
+// 同一个请求产生的事件带有相同的 correlation_id；同一次浏览器登录产生的事件 (登录、授权码、令牌、退出) 还可以通过 sid 关联。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 审计事件的类型
+const (
+	auditLoginSuccess   = "login.success"
+	auditLoginFailure   = "login.failure"
+	auditLoginThrottled = "login.throttled"
+	auditLoginLocked    = "login.locked"
+	auditAdminUnlock    = "admin.unlock"
+	auditAdminChange    = "admin.change"
+	auditConsentGranted = "consent.granted"
+	auditConsentDenied  = "consent.denied"
+	auditConsentRevoked = "consent.revoked"
+	auditCodeIssued     = "code.issued"
+	auditCodeRedeemed   = "code.redeemed"
+	auditCodeRejected   = "code.rejected"
+	auditCodeReplayed   = "code.replayed"
+	auditTokenIssued    = "token.issued"
+	auditTokenRevoked   = "token.revoked"
+	auditLogout         = "logout"
+	// 关联和解除关联上游账号，以及为上游账号创建本地用户，见 broker.go
+	auditIdentityLinked   = "identity.linked"
+	auditIdentityUnlinked = "identity.unlinked"
+	auditUserProvisioned  = "user.provisioned"
+)
+
+// correlationHeader 是传递关联 ID 的请求头和响应头
+const correlationHeader = "X-Correlation-ID"
+
+// AuditEvent 是一条审计事件
+type AuditEvent struct {
+	// ID 是事件的序号，进程内单调递增，重启后从 1 开始
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Realm 是事件所属的 realm，默认 realm 为空
+	Realm string `json:"realm,omitempty"`
+	// CorrelationID 是产生事件的 HTTP 请求的关联 ID
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Username      string `json:"username,omitempty"`
+	// Subject 是用户的 sub，用于用户名不方便获得的事件 (例如签发访问令牌)
+	Subject   string `json:"sub,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	// Detail 补充说明事件的原因或结果，例如登录失败的原因、需要等待的时间
+	Detail string `json:"detail,omitempty"`
+}
+
+// AuditConfig 是审计事件的设置
+type AuditConfig struct {
+	// Sink 是事件的输出位置: stdout (默认，作为消息为 "AUDIT" 的日志与其他日志一起输出)、
+	// file (追加写入 File，每行一个 JSON 对象) 或 none (只保留在内存中供查询)
+	Sink string `yaml:"sink"`
+	File string `yaml:"file"`
+	// Retain 是内存中保留的最近事件的数量，为 0 时 /admin/api/audit 总是返回空列表
+	Retain int `yaml:"retain"`
+}
+
+// auditLog 是审计事件的输出和内存中的最近事件，随配置一起热加载
+type auditLog struct {
+	mu     sync.Mutex
+	output auditOutput
+	events []AuditEvent
+	retain int
+	nextID int64
+}
+
+// auditOutput 是打开的审计事件输出
+type auditOutput struct {
+	sink string
+	w    io.Writer // 输出到标准输出时不使用，事件通过日志输出
+	file *os.File  // 输出到文件时用于关闭
+}
+
+var auditor = &auditLog{output: auditOutput{sink: "stdout"}, retain: 1000}
+
+// openAuditOutput 按配置打开审计事件的输出
+func openAuditOutput(cfg AuditConfig) (auditOutput, error) {
+	switch cfg.Sink {
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return auditOutput{}, fmt.Errorf("无法打开审计日志文件: %w", err)
+		}
+		return auditOutput{sink: cfg.Sink, w: f, file: f}, nil
+	case "none":
+		return auditOutput{sink: cfg.Sink, w: io.Discard}, nil
+	default:
+		return auditOutput{sink: "stdout"}, nil
+	}
+}
+
+// close 关闭输出的文件 (如果有)
+func (o auditOutput) close() {
+	if o.file != nil {
+		o.file.Close()
+	}
+}
+
+// replace 换成新的输出并关闭原来的，retain 变小时丢弃较早的事件
+func (a *auditLog) replace(output auditOutput, retain int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.output.close()
+	a.output, a.retain = output, retain
+	if len(a.events) > retain {
+		a.events = append([]AuditEvent(nil), a.events[len(a.events)-retain:]...)
+	}
+}
+
+// audit 记录一条审计事件。r 是产生事件的请求，用于填写关联 ID 和来源 IP (事件中没有设置 IP 时)
+func audit(r *http.Request, ev AuditEvent) {
+	ev.Time = time.Now().UTC()
+	if r != nil {
+		ev.Realm = requestRealm(r).name
+		ev.CorrelationID = correlationID(r.Context())
+		if ev.IP == "" {
+			ev.IP = clientIP(r)
+		}
+	}
+
+	auditEvents.inc(ev.Type)
+
+	a := auditor
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nextID++
+	ev.ID = a.nextID
+	if a.retain > 0 {
+		if len(a.events) >= a.retain {
+			a.events = append(a.events[:0], a.events[len(a.events)-a.retain+1:]...)
+		}
+		a.events = append(a.events, ev)
+	}
+
+	if a.output.sink == "stdout" {
+		ctx := context.Background()
+		if r != nil {
+			ctx = r.Context()
+		}
+		logAuditEvent(ctx, ev)
+		return
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("审计事件序列化失败", "error", err)
+		return
+	}
+	if _, err := fmt.Fprintf(a.output.w, "%s\n", line); err != nil {
+		slog.Error("写入审计事件失败", "error", err)
+	}
+}
+
+// logAuditEvent 把事件作为一条消息为 "AUDIT" 的日志输出，使用当前的日志格式，事件的字段是日志的字段，
+// 另外带上 ctx 中当前 span 的 trace_id 和 span_id。审计事件不受 log.level 影响，总是输出
+func logAuditEvent(ctx context.Context, ev AuditEvent) {
+	rec := slog.NewRecord(ev.Time.Local(), slog.LevelInfo, "AUDIT", 0)
+	rec.AddAttrs(slog.Int64("id", ev.ID), slog.String("type", ev.Type))
+	for _, f := range []struct{ key, value string }{
+		{"realm", ev.Realm},
+		{"correlation_id", ev.CorrelationID},
+		{"username", ev.Username},
+		{"sub", ev.Subject},
+		{"client_id", ev.ClientID},
+		{"sid", ev.SessionID},
+		{"ip", ev.IP},
+		{"detail", ev.Detail},
+	} {
+		if f.value != "" {
+			rec.AddAttrs(slog.String(f.key, f.value))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	// 事件中已经有关联 ID，不再通过 contextHandler 添加请求的字段
+	slog.Default().Handler().Handle(context.Background(), rec)
+}
+
+// AuditQuery 是查询审计事件的条件，空的字段匹配任意值 (Realm 除外，它总是精确匹配)
+type AuditQuery struct {
+	Realm string
+	// Type 是事件类型，以 "." 结尾时按前缀匹配 (例如 "login." 匹配所有登录事件)
+	Type          string
+	CorrelationID string
+	Username      string
+	Subject       string
+	ClientID      string
+	SessionID     string
+	// AfterID 只返回序号更大的事件，用于增量读取
+	AfterID int64
+	Since   time.Time
+	// Limit 是最多返回的事件数量，超出时返回最新的那些
+	Limit int
+}
+
+func (q AuditQuery) matches(ev AuditEvent) bool {
+	typeOK := q.Type == "" || ev.Type == q.Type || (strings.HasSuffix(q.Type, ".") && strings.HasPrefix(ev.Type, q.Type))
+	return typeOK && ev.Realm == q.Realm &&
+		(q.CorrelationID == "" || ev.CorrelationID == q.CorrelationID) &&
+		(q.Username == "" || ev.Username == q.Username) &&
+		(q.Subject == "" || ev.Subject == q.Subject) &&
+		(q.ClientID == "" || ev.ClientID == q.ClientID) &&
+		(q.SessionID == "" || ev.SessionID == q.SessionID) &&
+		ev.ID > q.AfterID && !ev.Time.Before(q.Since)
+}
+
+// queryAudit 按时间顺序返回内存中符合条件的事件
+func queryAudit(q AuditQuery) []AuditEvent {
+	a := auditor
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := []AuditEvent{}
+	for _, ev := range a.events {
+		if q.matches(ev) {
+			list = append(list, ev)
+		}
+	}
+	if q.Limit > 0 && len(list) > q.Limit {
+		list = list[len(list)-q.Limit:]
+	}
+	return list
+}
+
+// --- 关联 ID ---
+
+type correlationKey struct{}
+
+// withCorrelationID 为每个请求设置关联 ID。客户端提供的 X-Correlation-ID 只接受不超过 64 个字符的字母、数字和 ._-，
+// 否则生成新的，避免日志被注入任意内容
+func withCorrelationID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(correlationHeader)
+		if !validCorrelationID(id) {
+			id, _ = generateRandomString(16)
+		}
+		w.Header().Set(correlationHeader, id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("correlation_id", id))
+		ctx := context.WithValue(r.Context(), correlationKey{}, id)
+		// 处理这个请求时记录的日志都带有关联 ID 和请求的方法、路径
+		ctx = withLogAttrs(ctx, slog.String("correlation_id", id), slog.Group("request", slog.String("method", r.Method), slog.String("path", r.URL.Path)))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// correlationID 返回请求的关联 ID，不是通过 withCorrelationID 进来的请求返回空字符串
+func correlationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// --- 管理 API ---
+
+// handleAdminAudit 查询内存中的审计事件，参数见 AuditQuery: ?type=&correlation_id=&username=&sub=&client_id=&sid=&after_id=&since=&limit=
+// limit 默认为 100。只返回请求所在 realm 的事件
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := AuditQuery{
+		Realm:         requestRealm(r).name,
+		Type:          v.Get("type"),
+		CorrelationID: v.Get("correlation_id"),
+		Username:      v.Get("username"),
+		Subject:       v.Get("sub"),
+		ClientID:      v.Get("client_id"),
+		SessionID:     v.Get("sid"),
+		Limit:         100,
+	}
+	var err error
+	if s := v.Get("after_id"); s != "" {
+		if q.AfterID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "after_id 必须是整数")
+			return
+		}
+	}
+	if s := v.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeAdminError(w, http.StatusBadRequest, "since 必须是 RFC 3339 格式的时间")
+			return
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 {
+			writeAdminError(w, http.StatusBadRequest, "limit 必须是正整数")
+			return
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, queryAudit(q))
+}
@@ -0,0 +1,431 @@
+// boltstore.go - 基于 BoltDB 的文件存储
+// 所有数据保存在一个本地文件中，每类数据一个 bucket，值为 JSON 编码的结构体。
+// BoltDB 是嵌入式的键值数据库，不需要单独部署数据库服务，Provider 重启后状态依然保留。
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketClients   = []byte("clients")
+	bucketUsers     = []byte("users")
+	bucketAuthCodes = []byte("auth_codes")
+	bucketTokens    = []byte("tokens")
+	bucketGrants    = []byte("grants")
+	bucketSessions  = []byte("sessions")
+
+	allBuckets = [][]byte{bucketClients, bucketUsers, bucketAuthCodes, bucketTokens, bucketGrants, bucketSessions}
+)
+
+// boltStore 是 Store 的 BoltDB 实现
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore 打开 (或创建) 数据库文件并确保所有 bucket 都存在
+func newBoltStore(path string) (*boltStore, error) {
+	// 同一个文件只能被一个进程打开，设置超时避免另一个 Provider 进程占用时一直阻塞
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range allBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// get 读取并解码一条记录，不存在时返回 errNotFound
+func (s *boltStore) get(bucket []byte, key string, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(key))
+		if data == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// put 编码并写入一条记录
+func (s *boltStore) put(bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+// del 删除一条记录，记录不存在时不报错
+func (s *boltStore) del(bucket []byte, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// list 按键的顺序解码 bucket 中的所有记录，每条记录交给 fn 处理
+func (s *boltStore) list(bucket []byte, fn func(data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, data []byte) error {
+			return fn(data)
+		})
+	})
+}
+
+func (s *boltStore) GetClient(id string) (Client, error) {
+	var client Client
+	err := s.get(bucketClients, id, &client)
+	return client, err
+}
+
+func (s *boltStore) ListClients() ([]Client, error) {
+	var list []Client
+	err := s.list(bucketClients, func(data []byte) error {
+		var client Client
+		if err := json.Unmarshal(data, &client); err != nil {
+			return err
+		}
+		list = append(list, client)
+		return nil
+	})
+	return list, err
+}
+
+func (s *boltStore) SaveClient(client Client) error {
+	return s.put(bucketClients, client.ID, client)
+}
+
+func (s *boltStore) DeleteClient(id string) error {
+	return s.del(bucketClients, id)
+}
+
+func (s *boltStore) GetUser(username string) (User, error) {
+	var user User
+	err := s.get(bucketUsers, username, &user)
+	return user, err
+}
+
+func (s *boltStore) ListUsers() ([]User, error) {
+	var list []User
+	err := s.list(bucketUsers, func(data []byte) error {
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+		list = append(list, user)
+		return nil
+	})
+	return list, err
+}
+
+func (s *boltStore) SaveUser(user User) error {
+	return s.put(bucketUsers, user.Username, user)
+}
+
+// UpdateUser 在同一个读写事务中读取、修改并写回用户，BoltDB 同一时间只有一个读写事务
+func (s *boltStore) UpdateUser(username string, fn func(user *User) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUsers)
+		raw := b.Get([]byte(username))
+		if raw == nil {
+			return errNotFound
+		}
+		var user User
+		if err := json.Unmarshal(raw, &user); err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(username), data)
+	})
+}
+
+func (s *boltStore) DeleteUser(username string) error {
+	return s.del(bucketUsers, username)
+}
+
+func (s *boltStore) SaveAuthCode(code string, data AuthCodeData) error {
+	return s.put(bucketAuthCodes, code, data)
+}
+
+// TakeAuthCode 在同一个事务中读取并删除授权码，两个并发的请求不可能同时拿到同一个授权码
+func (s *boltStore) TakeAuthCode(code string) (AuthCodeData, error) {
+	var data AuthCodeData
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAuthCodes)
+		raw := b.Get([]byte(code))
+		if raw == nil {
+			return errNotFound
+		}
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return err
+		}
+		return b.Delete([]byte(code))
+	})
+	return data, err
+}
+
+func (s *boltStore) CountAuthCodes(now time.Time) (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAuthCodes).ForEach(func(k, data []byte) error {
+			var record struct{ Expiry time.Time }
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if now.Before(record.Expiry) {
+				n++
+			}
+			return nil
+		})
+	})
+	return n, err
+}
+
+func (s *boltStore) SaveToken(token TokenRecord) error {
+	return s.put(bucketTokens, token.ID, token)
+}
+
+func (s *boltStore) GetToken(id string) (TokenRecord, error) {
+	var token TokenRecord
+	err := s.get(bucketTokens, id, &token)
+	return token, err
+}
+
+func (s *boltStore) ListTokens() ([]TokenRecord, error) {
+	var list []TokenRecord
+	err := s.list(bucketTokens, func(data []byte) error {
+		var token TokenRecord
+		if err := json.Unmarshal(data, &token); err != nil {
+			return err
+		}
+		list = append(list, token)
+		return nil
+	})
+	return list, err
+}
+
+func (s *boltStore) DeleteToken(id string) error {
+	return s.del(bucketTokens, id)
+}
+
+func (s *boltStore) DeleteTokens(subject, clientID string) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTokens)
+		var matched [][]byte
+		err := b.ForEach(func(k, data []byte) error {
+			var token TokenRecord
+			if err := json.Unmarshal(data, &token); err != nil {
+				return err
+			}
+			if token.matches(subject, clientID) {
+				matched = append(matched, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range matched {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(matched)
+		return nil
+	})
+	return n, err
+}
+
+// grantPrefix 是用户全部授权记录的键前缀。登录名和客户端 ID 之间用 NUL 分隔，按前缀扫描时不会匹配到其他用户
+func grantPrefix(userID string) string {
+	return userID + "\x00"
+}
+
+func (s *boltStore) GetGrant(userID, clientID string) (Grant, error) {
+	var grant Grant
+	err := s.get(bucketGrants, grantPrefix(userID)+clientID, &grant)
+	return grant, err
+}
+
+func (s *boltStore) ListGrants(userID string) ([]Grant, error) {
+	var list []Grant
+	prefix := []byte(grantPrefix(userID))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketGrants).Cursor()
+		for k, data := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, data = c.Next() {
+			var grant Grant
+			if err := json.Unmarshal(data, &grant); err != nil {
+				return err
+			}
+			list = append(list, grant)
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (s *boltStore) SaveGrant(grant Grant) error {
+	return s.put(bucketGrants, grantPrefix(grant.UserID)+grant.ClientID, grant)
+}
+
+func (s *boltStore) DeleteGrant(userID, clientID string) error {
+	return s.del(bucketGrants, grantPrefix(userID)+clientID)
+}
+
+func (s *boltStore) SaveSession(sess Session) error {
+	return s.put(bucketSessions, sess.ID, sess)
+}
+
+func (s *boltStore) GetSession(id string) (Session, error) {
+	var sess Session
+	err := s.get(bucketSessions, id, &sess)
+	return sess, err
+}
+
+// ListSessions 按会话 ID 遍历后再按创建时间排序，和内存存储的顺序一致
+func (s *boltStore) ListSessions() ([]Session, error) {
+	var list []Session
+	err := s.list(bucketSessions, func(data []byte) error {
+		var sess Session
+		if err := json.Unmarshal(data, &sess); err != nil {
+			return err
+		}
+		list = append(list, sess)
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, err
+}
+
+func (s *boltStore) DeleteSession(id string) error {
+	return s.del(bucketSessions, id)
+}
+
+func (s *boltStore) ReplaceConfigured(clients []Client, users []User, removedClients, removedUsers []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		cb, ub := tx.Bucket(bucketClients), tx.Bucket(bucketUsers)
+		for _, id := range removedClients {
+			if err := cb.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		for _, username := range removedUsers {
+			if err := ub.Delete([]byte(username)); err != nil {
+				return err
+			}
+		}
+		return putConfigured(tx, clients, users)
+	})
+}
+
+// Reset 删除并重新创建所有 bucket，然后写入给出的客户端和用户
+func (s *boltStore) Reset(clients []Client, users []User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range allBuckets {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return putConfigured(tx, clients, users)
+	})
+}
+
+// putConfigured 在事务中写入客户端和用户，覆盖同 ID 的记录
+func putConfigured(tx *bolt.Tx, clients []Client, users []User) error {
+	cb, ub := tx.Bucket(bucketClients), tx.Bucket(bucketUsers)
+	for _, client := range clients {
+		data, err := json.Marshal(client)
+		if err != nil {
+			return err
+		}
+		if err := cb.Put([]byte(client.ID), data); err != nil {
+			return err
+		}
+	}
+	for _, user := range users {
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		if err := ub.Put([]byte(user.Username), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteExpired 只需要读取每条记录的 Expiry 字段，授权码、令牌和会话都有这个字段
+func (s *boltStore) DeleteExpired(now time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketAuthCodes, bucketTokens, bucketSessions} {
+			b := tx.Bucket(name)
+			var expired [][]byte
+			err := b.ForEach(func(k, data []byte) error {
+				var record struct{ Expiry time.Time }
+				if err := json.Unmarshal(data, &record); err != nil {
+					return err
+				}
+				if now.After(record.Expiry) {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			// 不能在 ForEach 中修改 bucket，所以先收集再删除
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			n += len(expired)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Ping 在只读事务中确认所有的 bucket 都存在。数据库已经关闭时 bolt 会返回错误
+func (s *boltStore) Ping() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range allBuckets {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("bucket %s 不存在", name)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
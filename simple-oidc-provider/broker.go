@@ -0,0 +1,636 @@
+// broker.go - 身份代理 (identity brokering)
+// Provider 自己也可以作为依赖方 (RP)，把登录委托给配置中的上游 OIDC Provider，例如公司的 IdP，
+// 或者另一个本项目的实例。登录页面上每个上游显示一个 "使用 xxx 登录" 的按钮:
+//  1. /broker/{id}/login 用授权码流程重定向到上游，state 保存在 Cookie 中，另外带上 PKCE
+//  2. 上游回调 /broker/{id}/callback，我们兑换授权码、验证 ID Token，按 claim_mapping 读取用户信息
+//  3. 找到本地用户: 已关联这个上游账号的用户 -> (link_by_email) 邮箱相同的用户 -> (provision) 新建用户
+//  4. 创建本地会话 (amr ["fed"])，继续原来的授权请求；用户启用了两步验证时仍然要完成第二步
+//
+// 已登录的用户也可以在 /account/identities 把自己的账号关联到上游账号，或者解除关联。
+// 上游返回的 amr 不会被采用: 客户端要求多因素认证时，用户需要在本地完成第二步。
+// 在本地退出登录不会结束上游的会话。
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// amrFederated 表示用户在上游 Provider 完成了认证。RFC 8176 没有定义这种情况，这是本项目自己的取值
+	amrFederated = "fed"
+
+	// brokerCookieName 保存进行中的上游登录的 state，brokerLoginTTL 是允许用户在上游停留的最长时间
+	brokerCookieName = "op-broker"
+	brokerLoginTTL   = 10 * time.Minute
+)
+
+// identityProviderIDPattern 限制上游的 ID，ID 会出现在回调地址中
+var identityProviderIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// brokerHTTPClient 用于访问上游的发现文档、JWKS、令牌端点和 UserInfo 端点
+var brokerHTTPClient = &http.Client{Timeout: 10 * time.Second, Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// IdentityProvider 是 identity_providers 中的一项: 一个上游 OIDC Provider
+type IdentityProvider struct {
+	// ID 出现在回调地址 <issuer>/broker/<id>/callback 中，需要在上游为客户端注册这个地址
+	ID string `yaml:"id"`
+	// Name 是登录页面的按钮上显示的名称，默认与 ID 相同
+	Name         string `yaml:"name"`
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// Scopes 默认为 openid profile email
+	Scopes       []string     `yaml:"scopes"`
+	ClaimMapping ClaimMapping `yaml:"claim_mapping"`
+	// LinkByEmail 表示第一次登录时关联邮箱相同的本地用户。只有上游声明 email_verified 为 true 时才会关联，
+	// 上游不发送 email_verified 时 (例如本项目的 Provider)，可以设置 TrustEmail 表示信任上游的邮箱
+	LinkByEmail bool `yaml:"link_by_email"`
+	TrustEmail  bool `yaml:"trust_email"`
+	// Provision 表示为还没有关联的上游账号自动创建本地用户 (just-in-time provisioning)
+	Provision bool `yaml:"provision"`
+}
+
+// ClaimMapping 指定从上游的哪个声明读取本地用户的属性，空的字段使用括号中的默认声明。
+// name、email 和 picture 只在创建用户时复制；Claims 中的自定义声明每次通过上游登录时都会更新
+type ClaimMapping struct {
+	// Username 是新建用户的用户名 (preferred_username)，上游没有这个声明时依次使用 email 和 "<id>-<sub>"
+	Username string `yaml:"username"`
+	Name     string `yaml:"name"`    // name
+	Email    string `yaml:"email"`   // email
+	Picture  string `yaml:"picture"` // picture
+	// Claims 把上游的声明复制为本地用户的自定义声明，键为本地的声明名称，值为上游的声明名称
+	Claims map[string]string `yaml:"claims"`
+}
+
+// FederatedIdentity 是用户关联的一个上游账号
+type FederatedIdentity struct {
+	// Provider 是 IdentityProvider 的 ID，Subject 是上游账号的 sub
+	Provider string    `json:"provider"`
+	Subject  string    `json:"sub"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+// identityProviderProblems 检查单个上游的设置 (不包括 id)
+func identityProviderProblems(idp IdentityProvider) []string {
+	var problems []string
+	if !isAbsoluteURL(idp.Issuer) {
+		problems = append(problems, fmt.Sprintf("issuer %q 不是绝对 URL", idp.Issuer))
+	}
+	if idp.ClientID == "" || idp.ClientSecret == "" {
+		problems = append(problems, "必须设置 client_id 和 client_secret")
+	}
+	if len(idp.Scopes) > 0 && !containsString(idp.Scopes, oidc.ScopeOpenID) {
+		problems = append(problems, "scopes 必须包含 openid")
+	}
+	for local := range idp.ClaimMapping.Claims {
+		if containsString(reservedClaims, local) {
+			problems = append(problems, fmt.Sprintf("claim_mapping.claims 不能覆盖标准声明 %s", local))
+		}
+	}
+	return problems
+}
+
+// identityProvider 返回配置中 ID 为 id 的上游
+func (c *Config) identityProvider(id string) (IdentityProvider, bool) {
+	for _, idp := range c.IdentityProviders {
+		if idp.ID == id {
+			return idp, true
+		}
+	}
+	return IdentityProvider{}, false
+}
+
+// displayName 是按钮和页面上显示的上游名称
+func (idp IdentityProvider) displayName() string {
+	if idp.Name != "" {
+		return idp.Name
+	}
+	return idp.ID
+}
+
+// --- 上游 ---
+
+// upstream 是读取过发现文档的上游
+type upstream struct {
+	idp      IdentityProvider
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	oauth2   *oauth2.Config
+}
+
+// upstream 返回 id 对应的上游。发现文档在第一次使用时才读取 (上游可能是同一个进程中的另一个 realm，
+// 启动时还无法访问)，结果缓存到配置重新加载为止
+func (rlm *realm) upstream(id string) (*upstream, error) {
+	cfg := rlm.currentConfig()
+	idp, ok := cfg.identityProvider(id)
+	if !ok {
+		return nil, errNotFound
+	}
+	mu.Lock()
+	if rlm.upstreamsConfig != cfg {
+		rlm.upstreams, rlm.upstreamsConfig = make(map[string]*upstream), cfg
+	}
+	u := rlm.upstreams[id]
+	mu.Unlock()
+	if u != nil {
+		return u, nil
+	}
+
+	// JWKS 会在以后的请求中按需获取，所以这里不能使用请求的 context
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), brokerHTTPClient), idp.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取上游 %s 的发现文档: %w", id, err)
+	}
+	scopes := idp.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	u = &upstream{
+		idp:      idp,
+		provider: provider,
+		verifier: provider.Verifier(&oidc.Config{ClientID: idp.ClientID}),
+		oauth2: &oauth2.Config{
+			ClientID:     idp.ClientID,
+			ClientSecret: idp.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  rlm.issuer + "/broker/" + id + "/callback",
+			Scopes:       scopes,
+		},
+	}
+	mu.Lock()
+	if rlm.upstreamsConfig == cfg {
+		rlm.upstreams[id] = u
+	}
+	mu.Unlock()
+	return u, nil
+}
+
+// --- 登录 ---
+
+// brokerButton 是登录页面上的一个 "使用 xxx 登录" 按钮
+type brokerButton struct {
+	Name, LoginURL string
+}
+
+// brokerButtons 返回登录页面上每个上游的按钮，按钮带上登录页面的查询参数，登录后继续原来的授权请求
+func (rlm *realm) brokerButtons(r *http.Request) []brokerButton {
+	var buttons []brokerButton
+	for _, idp := range rlm.currentConfig().IdentityProviders {
+		buttons = append(buttons, brokerButton{idp.displayName(), rlm.path("/broker/" + idp.ID + "/login?" + r.URL.RawQuery)})
+	}
+	return buttons
+}
+
+// brokerLogin 是一次进行中的上游登录，保存在进程内存中，键为 state
+type brokerLogin struct {
+	Provider string
+	// Verifier 是 PKCE 的 code_verifier
+	Verifier string
+	// Nonce 随授权请求发给上游，上游的 ID Token 中必须带着同一个值，防止重放别的登录的 ID Token
+	Nonce string
+	// Query 是本地登录页面的查询参数 (授权请求的参数或 return_to)，登录完成后据此继续
+	Query string
+	// LinkUser 不为空时表示已登录的用户在 /account/identities 关联上游账号，而不是登录
+	LinkUser string
+	Expiry   time.Time
+}
+
+// startBrokerLogin 保存 login 并把浏览器重定向到上游的授权端点
+func (rlm *realm) startBrokerLogin(w http.ResponseWriter, r *http.Request, u *upstream, login brokerLogin) {
+	state, err := generateRandomString(24)
+	if err != nil {
+		http.Error(w, "生成 state 失败", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := generateRandomString(24)
+	if err != nil {
+		http.Error(w, "生成 nonce 失败", http.StatusInternalServerError)
+		return
+	}
+	login.Provider = u.idp.ID
+	login.Verifier = oauth2.GenerateVerifier()
+	login.Nonce = nonce
+	login.Expiry = time.Now().Add(brokerLoginTTL)
+	mu.Lock()
+	rlm.brokerLogins[state] = &login
+	mu.Unlock()
+
+	// 上游回调是跨站的顶层导航，SameSite=Lax 的 Cookie 会被发送
+	rlm.setCookie(w, &http.Cookie{
+		Name:     brokerCookieName,
+		Value:    state,
+		Path:     "/broker/",
+		MaxAge:   int(brokerLoginTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	slog.InfoContext(r.Context(), "重定向用户到上游 Provider", "idp", u.idp.ID, "link_user", login.LinkUser)
+	http.Redirect(w, r, u.oauth2.AuthCodeURL(state, oauth2.S256ChallengeOption(login.Verifier), oidc.Nonce(login.Nonce)), http.StatusFound)
+}
+
+// takeBrokerLogin 取出并删除回调对应的登录。state 必须与发起登录的浏览器的 Cookie 相同，并且只能使用一次
+func takeBrokerLogin(w http.ResponseWriter, r *http.Request) (*brokerLogin, bool) {
+	rlm := requestRealm(r)
+	cookie, err := rlm.cookie(r, brokerCookieName)
+	if err != nil || cookie.Value != r.URL.Query().Get("state") {
+		return nil, false
+	}
+	rlm.setCookie(w, &http.Cookie{Name: brokerCookieName, Value: "", Path: "/broker/", MaxAge: -1, HttpOnly: true})
+
+	mu.Lock()
+	login, ok := rlm.brokerLogins[cookie.Value]
+	delete(rlm.brokerLogins, cookie.Value)
+	mu.Unlock()
+	if !ok || login.Provider != r.PathValue("id") || time.Now().After(login.Expiry) {
+		return nil, false
+	}
+	return login, true
+}
+
+// handleBrokerLogin 开始通过上游登录，查询参数与 /login 相同
+func handleBrokerLogin(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	u, err := rlm.upstream(r.PathValue("id"))
+	if errors.Is(err, errNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "无法连接上游 Provider", "idp", r.PathValue("id"), "error", err)
+		http.Error(w, "无法连接上游 Provider", http.StatusBadGateway)
+		return
+	}
+	rlm.startBrokerLogin(w, r, u, brokerLogin{Query: r.URL.RawQuery})
+}
+
+// handleBrokerCallback 是上游的回调地址: 兑换授权码，验证 ID Token，然后登录或关联本地用户
+func handleBrokerCallback(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	id := r.PathValue("id")
+	login, ok := takeBrokerLogin(w, r)
+	if !ok {
+		http.Error(w, "上游登录已过期或 state 无效，请重新登录", http.StatusBadRequest)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		audit(r, AuditEvent{Type: auditLoginFailure, Username: login.LinkUser, Detail: fmt.Sprintf("idp=%s error=%s", id, e)})
+		http.Error(w, "上游 Provider 拒绝了登录: "+e, http.StatusForbidden)
+		return
+	}
+	u, err := rlm.upstream(id)
+	if err != nil {
+		http.Error(w, "无法连接上游 Provider", http.StatusBadGateway)
+		return
+	}
+
+	sub, claims, err := u.exchange(r, login)
+	if err != nil {
+		audit(r, AuditEvent{Type: auditLoginFailure, Username: login.LinkUser, Detail: fmt.Sprintf("idp=%s %v", id, err)})
+		slog.WarnContext(r.Context(), "上游登录失败", "idp", id, "error", err)
+		http.Error(w, "上游登录失败: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if login.LinkUser != "" {
+		linkIdentity(w, r, u.idp, sub, login.LinkUser)
+		return
+	}
+
+	user, err := rlm.brokeredUser(r, u.idp, sub, claims)
+	if err != nil {
+		audit(r, AuditEvent{Type: auditLoginFailure, Detail: fmt.Sprintf("idp=%s sub=%s %v", id, sub, err)})
+		var le *localizedError
+		if errors.As(err, &le) {
+			http.Error(w, translate(r, le.Key, le.Args...), http.StatusForbidden)
+			return
+		}
+		http.Error(w, "读取用户失败", http.StatusInternalServerError)
+		return
+	}
+
+	// 和密码登录一样，用户启用了两步验证时先完成第二步
+	if user.hasSecondFactor() {
+		audit(r, AuditEvent{Type: auditLoginSuccess, Username: user.Username, Detail: "idp=" + id + ", second factor required"})
+		if err := rlm.startMFAChallenge(w, user.Username, "", amrFederated); err != nil {
+			http.Error(w, "创建验证失败", http.StatusInternalServerError)
+			return
+		}
+		rlm.redirect(w, r, "/login/mfa?"+login.Query)
+		return
+	}
+
+	amr := []string{amrFederated}
+	sess, err := rlm.createSession(w, user.Username, amr)
+	if err != nil {
+		http.Error(w, "创建会话失败", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Type: auditLoginSuccess, Username: user.Username, SessionID: sess.Sid, Detail: "amr=" + amrFederated + " idp=" + id})
+	nextURL := loginNextURLFor(login.Query)
+	slog.InfoContext(r.Context(), "用户通过上游 Provider 登录成功", "username", user.Username, "idp", id, "redirect", nextURL)
+	rlm.redirect(w, r, nextURL)
+}
+
+// exchange 用授权码换取令牌并验证 ID Token (包括 login 的 nonce)，返回上游账号的 sub 和声明。
+// UserInfo 端点返回的声明用于补充 ID Token 中没有的声明，失败时忽略
+func (u *upstream) exchange(r *http.Request, login *brokerLogin) (string, map[string]interface{}, error) {
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, brokerHTTPClient)
+	token, err := u.oauth2.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		return "", nil, fmt.Errorf("兑换授权码失败: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", nil, errors.New("令牌响应中没有 id_token")
+	}
+	idToken, err := u.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return "", nil, fmt.Errorf("ID Token 无效: %w", err)
+	}
+	if !secretsEqual(idToken.Nonce, login.Nonce) {
+		return "", nil, errors.New("ID Token 的 nonce 与登录请求不符")
+	}
+	claims := make(map[string]interface{})
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil, fmt.Errorf("无法解析 ID Token: %w", err)
+	}
+
+	info, err := u.provider.UserInfo(oidc.ClientContext(r.Context(), brokerHTTPClient), oauth2.StaticTokenSource(token))
+	if err != nil {
+		slog.DebugContext(r.Context(), "读取上游的 UserInfo 失败", "idp", u.idp.ID, "error", err)
+	} else if info.Subject == idToken.Subject {
+		extra := make(map[string]interface{})
+		if err := info.Claims(&extra); err == nil {
+			for name, value := range extra {
+				if _, ok := claims[name]; !ok {
+					claims[name] = value
+				}
+			}
+		}
+	}
+	return idToken.Subject, claims, nil
+}
+
+// --- 本地用户 ---
+
+// brokeredUser 找到上游账号对应的本地用户，按上游的设置关联已有的用户或创建新用户
+func (rlm *realm) brokeredUser(r *http.Request, idp IdentityProvider, sub string, claims map[string]interface{}) (User, error) {
+	m := idp.ClaimMapping
+	if user, ok := rlm.findUserByIdentity(idp.ID, sub); ok {
+		if m.updateClaims(&user, claims) {
+			if err := rlm.store.SaveUser(user); err != nil {
+				return User{}, err
+			}
+		}
+		return user, nil
+	}
+
+	if idp.LinkByEmail {
+		verified, _ := claims["email_verified"].(bool)
+		if email := claimString(claims, m.claim(m.Email, "email")); email != "" && (verified || idp.TrustEmail) {
+			if user, ok := rlm.findUserByEmail(email); ok {
+				user.Identities = append(user.Identities, FederatedIdentity{Provider: idp.ID, Subject: sub, LinkedAt: time.Now()})
+				m.updateClaims(&user, claims)
+				if err := rlm.store.SaveUser(user); err != nil {
+					return User{}, err
+				}
+				audit(r, AuditEvent{Type: auditIdentityLinked, Username: user.Username, Detail: fmt.Sprintf("idp=%s sub=%s by email", idp.ID, sub)})
+				slog.InfoContext(r.Context(), "按邮箱关联了上游账号", "username", user.Username, "idp", idp.ID, "sub", sub)
+				return user, nil
+			}
+		}
+	}
+
+	if !idp.Provision {
+		return User{}, &localizedError{msg("broker.not_linked", idp.displayName())}
+	}
+	user := User{
+		ID:         idp.ID + "-" + sub,
+		Username:   m.username(idp.ID, sub, claims),
+		Name:       claimString(claims, m.claim(m.Name, "name")),
+		Email:      claimString(claims, m.claim(m.Email, "email")),
+		Picture:    claimString(claims, m.claim(m.Picture, "picture")),
+		Identities: []FederatedIdentity{{Provider: idp.ID, Subject: sub, LinkedAt: time.Now()}},
+	}
+	m.updateClaims(&user, claims)
+	if _, err := rlm.store.GetUser(user.Username); err == nil {
+		return User{}, &localizedError{msg("broker.username_taken", user.Username, idp.displayName())}
+	}
+	if _, taken := rlm.findUserByID(user.ID); taken {
+		return User{}, &localizedError{msg("broker.username_taken", user.ID, idp.displayName())}
+	}
+	if err := rlm.store.SaveUser(user); err != nil {
+		return User{}, err
+	}
+	audit(r, AuditEvent{Type: auditUserProvisioned, Username: user.Username, Detail: fmt.Sprintf("idp=%s sub=%s", idp.ID, sub)})
+	slog.InfoContext(r.Context(), "为上游账号创建了本地用户", "username", user.Username, "idp", idp.ID, "sub", sub)
+	return user, nil
+}
+
+// linkIdentity 把上游账号关联到当前登录的用户 username，然后返回 /account/identities
+func linkIdentity(w http.ResponseWriter, r *http.Request, idp IdentityProvider, sub, username string) {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess == nil || sess.UserID != username {
+		http.Error(w, "会话已经改变，请重新关联", http.StatusBadRequest)
+		return
+	}
+	if other, ok := rlm.findUserByIdentity(idp.ID, sub); ok {
+		if other.Username != username {
+			http.Error(w, translate(r, "broker.linked_elsewhere", idp.displayName()), http.StatusConflict)
+			return
+		}
+		rlm.redirect(w, r, "/account/identities")
+		return
+	}
+	user, err := rlm.store.GetUser(username)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+	user.Identities = append(user.Identities, FederatedIdentity{Provider: idp.ID, Subject: sub, LinkedAt: time.Now()})
+	if err := rlm.store.SaveUser(user); err != nil {
+		http.Error(w, "保存用户失败", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Type: auditIdentityLinked, Username: username, SessionID: sess.Sid, Detail: fmt.Sprintf("idp=%s sub=%s", idp.ID, sub)})
+	slog.InfoContext(r.Context(), "用户关联了上游账号", "username", username, "idp", idp.ID, "sub", sub)
+	rlm.redirect(w, r, "/account/identities")
+}
+
+// findUserByIdentity 在 realm 中查找关联了上游账号 (provider, sub) 的用户
+func (rlm *realm) findUserByIdentity(provider, sub string) (User, bool) {
+	list, err := rlm.store.ListUsers()
+	if err != nil {
+		return User{}, false
+	}
+	for _, user := range list {
+		for _, fi := range user.Identities {
+			if fi.Provider == provider && fi.Subject == sub {
+				return user, true
+			}
+		}
+	}
+	return User{}, false
+}
+
+// findUserByEmail 在 realm 中查找邮箱为 email 的用户 (不区分大小写)。有多个用户使用这个邮箱时不知道该关联哪一个，视为没有找到
+func (rlm *realm) findUserByEmail(email string) (User, bool) {
+	list, err := rlm.store.ListUsers()
+	if err != nil {
+		return User{}, false
+	}
+	var found []User
+	for _, user := range list {
+		if strings.EqualFold(user.Email, email) {
+			found = append(found, user)
+		}
+	}
+	if len(found) != 1 {
+		return User{}, false
+	}
+	return found[0], true
+}
+
+// claim 返回映射中设置的声明名称，没有设置时为 def
+func (m ClaimMapping) claim(name, def string) string {
+	if name != "" {
+		return name
+	}
+	return def
+}
+
+// username 返回为上游账号新建的用户的用户名
+func (m ClaimMapping) username(provider, sub string, claims map[string]interface{}) string {
+	for _, name := range []string{m.claim(m.Username, "preferred_username"), "email"} {
+		if s := claimString(claims, name); s != "" {
+			return s
+		}
+	}
+	return provider + "-" + sub
+}
+
+// updateClaims 用上游的值更新用户的自定义声明，返回是否有变化
+func (m ClaimMapping) updateClaims(user *User, claims map[string]interface{}) bool {
+	changed := false
+	for local, remote := range m.Claims {
+		value, ok := claims[remote]
+		if !ok {
+			continue
+		}
+		if user.Claims == nil {
+			user.Claims = make(map[string]interface{})
+		}
+		if fmt.Sprint(user.Claims[local]) != fmt.Sprint(value) {
+			user.Claims[local] = value
+			changed = true
+		}
+	}
+	return changed
+}
+
+// claimString 返回字符串类型的声明，声明不存在或不是字符串时为空
+func claimString(claims map[string]interface{}, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// --- 账号关联页面 ---
+
+// identityRow 是 /account/identities 页面中的一行
+type identityRow struct {
+	ID, Name string
+	// Configured 为 false 表示上游已经从配置中删除，只能解除关联
+	Configured bool
+	Linked     *FederatedIdentity
+}
+
+// handleIdentitySettings 列出配置的上游和用户关联的上游账号，可以关联新的账号或解除关联
+func handleIdentitySettings(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess == nil {
+		rlm.redirect(w, r, "/login?return_to=/account/identities")
+		return
+	}
+	user, err := rlm.store.GetUser(sess.UserID)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+
+	var message Message
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		id := r.PostForm.Get("provider")
+		switch r.PostForm.Get("action") {
+		case "link":
+			u, err := rlm.upstream(id)
+			if err != nil {
+				http.Error(w, "无法连接上游 Provider", http.StatusBadGateway)
+				return
+			}
+			rlm.startBrokerLogin(w, r, u, brokerLogin{LinkUser: user.Username})
+			return
+		case "unlink":
+			message = rlm.unlinkIdentity(r, &user, id)
+		}
+	}
+
+	var rows []identityRow
+	for _, idp := range rlm.currentConfig().IdentityProviders {
+		rows = append(rows, identityRow{ID: idp.ID, Name: idp.displayName(), Configured: true})
+	}
+	for i, fi := range user.Identities {
+		found := false
+		for j := range rows {
+			if rows[j].ID == fi.Provider {
+				rows[j].Linked, found = &user.Identities[i], true
+			}
+		}
+		if !found {
+			rows = append(rows, identityRow{ID: fi.Provider, Name: fi.Provider, Linked: &user.Identities[i]})
+		}
+	}
+	renderPage(w, r, "identities.html", page{
+		Title:   "title.identities",
+		Message: message,
+		Data:    struct{ Providers []identityRow }{rows},
+	})
+}
+
+// unlinkIdentity 解除用户与上游 provider 的关联。没有密码和通行密钥的用户 (由上游创建的用户) 不能解除最后一个关联，
+// 否则将无法再登录
+func (rlm *realm) unlinkIdentity(r *http.Request, user *User, provider string) Message {
+	for i, fi := range user.Identities {
+		if fi.Provider != provider {
+			continue
+		}
+		if user.PasswordHash == "" && len(user.Passkeys) == 0 && len(user.Identities) == 1 {
+			return msg("identities.last_method")
+		}
+		user.Identities = append(user.Identities[:i:i], user.Identities[i+1:]...)
+		if err := rlm.store.SaveUser(*user); err != nil {
+			return msg("identities.save_failed")
+		}
+		audit(r, AuditEvent{Type: auditIdentityUnlinked, Username: user.Username, Detail: fmt.Sprintf("idp=%s sub=%s", fi.Provider, fi.Subject)})
+		slog.InfoContext(r.Context(), "用户解除了上游账号的关联", "username", user.Username, "idp", fi.Provider)
+		name := provider
+		if idp, ok := rlm.currentConfig().identityProvider(provider); ok {
+			name = idp.displayName()
+		}
+		return msg("identities.unlinked", name)
+	}
+	return msg("identities.not_linked")
+}
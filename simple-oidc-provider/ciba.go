@@ -0,0 +1,273 @@
+// ciba.go - Client-Initiated Backchannel Authentication (CIBA)
+// 有些场景下发起登录的设备 (例如呼叫中心的坐席工具) 并不是用户自己的浏览器，无法进行重定向。
+// CIBA 让客户端直接在后台向 /bc-authorize 发起认证请求 (用 login_hint 指明用户)，
+// 用户在自己的设备上打开 Provider 的 /ciba 页面确认请求，客户端随后在令牌端点取回令牌:
+//   - poll 模式: 客户端按 interval 轮询令牌端点，直到用户同意或拒绝
+//   - ping 模式: 用户处理后，我们回调客户端的通知地址，客户端收到通知后再去令牌端点取令牌
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	grantTypeCIBA = "urn:openid:params:grant-type:ciba"
+
+	cibaModePoll = "poll"
+	cibaModePing = "ping"
+
+	// cibaDefaultExpiry 是认证请求的默认有效期，客户端可以用 requested_expiry 缩短或延长 (不超过 cibaMaxExpiry)
+	cibaDefaultExpiry = 2 * time.Minute
+	cibaMaxExpiry     = 10 * time.Minute
+	// cibaPollInterval 是 poll 模式下两次轮询之间的最小间隔
+	cibaPollInterval = 5 * time.Second
+)
+
+// CIBARequest 是一个等待用户处理的后台认证请求
+type CIBARequest struct {
+	ID             string
+	ClientID       string
+	UserID         string // 用户名，即存储中用户的键
+	Scope          string
+	BindingMessage string
+	// NotificationToken 是 ping 模式下回调客户端时使用的 Bearer 令牌
+	NotificationToken string
+	Status            string // pending, approved 或 denied
+	Expiry            time.Time
+	Interval          time.Duration
+	LastPolled        time.Time
+	// AMR 是用户同意请求时所在会话完成的认证方式
+	AMR []string
+}
+
+// handleBackchannelAuthorize 是 backchannel_authentication_endpoint (CIBA 第 7 节)
+func handleBackchannelAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOAuthError(w, http.StatusMethodNotAllowed, "invalid_request", "只接受 POST 请求")
+		return
+	}
+	r.ParseForm()
+	rlm := requestRealm(r)
+
+	// 1. 验证客户端凭据，并确认该客户端注册了 CIBA
+	client, err := rlm.store.GetClient(r.PostForm.Get("client_id"))
+	if err != nil || !secretsEqual(client.Secret, r.PostForm.Get("client_secret")) {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "无效的客户端凭据")
+		return
+	}
+	if client.BackchannelTokenDeliveryMode == "" {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "该客户端没有注册 CIBA")
+		return
+	}
+
+	// 2. 检查请求参数
+	scope := r.PostForm.Get("scope")
+	if !containsString(strings.Fields(scope), "openid") {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "scope 必须包含 openid")
+		return
+	}
+	userID, ok := rlm.findUserByHint(r.PostForm.Get("login_hint"))
+	if !ok {
+		writeOAuthError(w, http.StatusBadRequest, "unknown_user_id", "login_hint 找不到对应的用户")
+		return
+	}
+	notificationToken := r.PostForm.Get("client_notification_token")
+	if client.BackchannelTokenDeliveryMode == cibaModePing && notificationToken == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "ping 模式必须提供 client_notification_token")
+		return
+	}
+	expiry := cibaDefaultExpiry
+	if v := r.PostForm.Get("requested_expiry"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "无效的 requested_expiry")
+			return
+		}
+		expiry = min(time.Duration(seconds)*time.Second, cibaMaxExpiry)
+	}
+
+	// 3. 保存请求，等待用户在 /ciba 页面处理
+	id, err := generateRandomString(24)
+	if err != nil {
+		http.Error(w, "生成 auth_req_id 失败", http.StatusInternalServerError)
+		return
+	}
+	req := &CIBARequest{
+		ID:                id,
+		ClientID:          client.ID,
+		UserID:            userID,
+		Scope:             scope,
+		BindingMessage:    r.PostForm.Get("binding_message"),
+		NotificationToken: notificationToken,
+		Status:            "pending",
+		Expiry:            time.Now().Add(expiry),
+		Interval:          cibaPollInterval,
+	}
+	mu.Lock()
+	rlm.cibaRequests[id] = req
+	mu.Unlock()
+	slog.InfoContext(r.Context(), "客户端发起了 CIBA 认证请求", "client_id", client.ID, "user_id", userID, "binding_message", req.BindingMessage)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"auth_req_id": id,
+		"expires_in":  int(expiry.Seconds()),
+		"interval":    int(cibaPollInterval.Seconds()),
+	})
+}
+
+// handleCIBAGrant 处理 grant_type=urn:openid:params:grant-type:ciba (CIBA 第 10 节)
+func handleCIBAGrant(w http.ResponseWriter, r *http.Request, client Client, proof *dpopProof) {
+	id := r.PostForm.Get("auth_req_id")
+	rlm := requestRealm(r)
+
+	mu.Lock()
+	req, ok := rlm.cibaRequests[id]
+	if !ok || req.ClientID != client.ID {
+		mu.Unlock()
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "无效的 auth_req_id")
+		return
+	}
+	now := time.Now()
+	if now.After(req.Expiry) {
+		delete(rlm.cibaRequests, id)
+		mu.Unlock()
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "认证请求已过期")
+		return
+	}
+	switch req.Status {
+	case "pending":
+		// poll 模式下轮询太快的客户端要放慢速度，每次违规都把间隔再加 5 秒
+		errCode := "authorization_pending"
+		if client.BackchannelTokenDeliveryMode == cibaModePoll && now.Sub(req.LastPolled) < req.Interval {
+			errCode = "slow_down"
+			req.Interval += cibaPollInterval
+		}
+		req.LastPolled = now
+		mu.Unlock()
+		writeOAuthError(w, http.StatusBadRequest, errCode, "用户尚未完成认证")
+		return
+	case "denied":
+		delete(rlm.cibaRequests, id)
+		mu.Unlock()
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "用户拒绝了认证请求")
+		return
+	}
+	// 已同意: auth_req_id 和授权码一样只能使用一次
+	delete(rlm.cibaRequests, id)
+	mu.Unlock()
+
+	user, err := rlm.store.GetUser(req.UserID)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+	writeTokenResponse(w, r, user, client, "", "", req.AMR, strings.Join(requestedScopes(req.Scope), " "), proof)
+}
+
+// handleCIBAPage 是用户确认 CIBA 请求的页面: GET 列出当前用户待处理的请求，POST 同意或拒绝其中一个
+func handleCIBAPage(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess == nil {
+		rlm.redirect(w, r, "/login?return_to=/ciba")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		resolveCIBARequest(r, sess, r.PostForm.Get("auth_req_id"), r.PostForm.Get("action") == "approve")
+		rlm.redirect(w, r, "/ciba")
+		return
+	}
+
+	// 列出属于当前用户、尚未处理的请求
+	mu.Lock()
+	var pending []CIBARequest
+	for _, req := range rlm.cibaRequests {
+		if req.UserID == sess.UserID && req.Status == "pending" && time.Now().Before(req.Expiry) {
+			pending = append(pending, *req)
+		}
+	}
+	mu.Unlock()
+
+	renderPage(w, r, "ciba.html", page{
+		Title: "title.ciba",
+		Data:  struct{ Requests []CIBARequest }{pending},
+	})
+}
+
+// resolveCIBARequest 记录用户对请求的决定；ping 模式下随后通知客户端
+func resolveCIBARequest(r *http.Request, sess *Session, id string, approved bool) {
+	userID := sess.UserID
+	rlm := requestRealm(r)
+	mu.Lock()
+	req, ok := rlm.cibaRequests[id]
+	if !ok || req.UserID != userID || req.Status != "pending" {
+		mu.Unlock()
+		return
+	}
+	req.Status = "denied"
+	if approved {
+		req.Status = "approved"
+		req.AMR = sess.AMR
+	}
+	notify := *req
+	mu.Unlock()
+	evType := auditConsentDenied
+	if approved {
+		evType = auditConsentGranted
+	}
+	audit(r, AuditEvent{Type: evType, Username: userID, ClientID: notify.ClientID, SessionID: sess.Sid, Detail: "ciba auth_req_id=" + id + " scope=" + notify.Scope})
+	slog.InfoContext(r.Context(), "用户处理了 CIBA 请求", "user_id", userID, "client_id", req.ClientID, "approved", approved)
+
+	client, err := rlm.store.GetClient(notify.ClientID)
+	if err == nil && client.BackchannelTokenDeliveryMode == cibaModePing && client.BackchannelClientNotificationEndpoint != "" {
+		go sendCIBAPing(context.WithoutCancel(r.Context()), client, notify)
+	}
+}
+
+// sendCIBAPing 回调客户端的通知地址 (CIBA 第 10.2 节)，客户端收到后应到令牌端点取回结果
+func sendCIBAPing(ctx context.Context, client Client, req CIBARequest) {
+	body, _ := json.Marshal(map[string]string{"auth_req_id": req.ID})
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, client.BackchannelClientNotificationEndpoint, bytes.NewReader(body))
+	if err != nil {
+		slog.WarnContext(ctx, "CIBA ping 通知失败", "client_id", client.ID, "error", err)
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+req.NotificationToken)
+
+	resp, err := backchannelHTTPClient.Do(httpReq)
+	if err != nil {
+		slog.WarnContext(ctx, "CIBA ping 通知失败", "client_id", client.ID, "error", err)
+		return
+	}
+	resp.Body.Close()
+	slog.InfoContext(ctx, "CIBA ping 已通知", "client_id", client.ID, "status", resp.Status)
+}
+
+// findUserByHint 在 realm 中根据 login_hint (用户名、用户 ID 或邮箱) 查找用户，返回其用户名
+func (rlm *realm) findUserByHint(hint string) (string, bool) {
+	if hint == "" {
+		return "", false
+	}
+	list, err := rlm.store.ListUsers()
+	if err != nil {
+		return "", false
+	}
+	for _, user := range list {
+		if user.Username == hint || user.ID == hint || strings.EqualFold(user.Email, hint) {
+			return user.Username, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,542 @@
+// config.go - Provider 配置
+// 颁发者地址、监听地址、TLS、存储、签名密钥、各种有效期以及客户端和用户都可以通过配置文件设置，
+// 这样每个团队都可以运行自己的 Provider 实例，而不需要修改代码。realms 中的每一项是一个单独的租户，见 realm.go。
+// 配置的优先级从低到高为: 内置默认值 < 配置文件 (YAML 或 JSON) < 环境变量 < 命令行参数。
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config 是 Provider 的完整配置
+type Config struct {
+	Issuer    string          `yaml:"issuer"`
+	Listen    string          `yaml:"listen"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Server    ServerConfig    `yaml:"server"`
+	Store     StoreConfig     `yaml:"store"`
+	Keys      KeysConfig      `yaml:"keys"`
+	Lifetimes LifetimesConfig `yaml:"lifetimes"`
+	// PasswordPolicy 是设置新密码时的要求，见 password.go
+	PasswordPolicy PasswordPolicy `yaml:"password_policy"`
+	// LoginThrottle 是登录失败后的退避和锁定设置，见 throttle.go
+	LoginThrottle LoginThrottle `yaml:"login_throttle"`
+	// Admin 是管理 API 的设置，见 admin.go
+	Admin AdminConfig `yaml:"admin"`
+	// Audit 是审计事件的设置，见 audit.go
+	Audit AuditConfig `yaml:"audit"`
+	// Tracing 是 OpenTelemetry 追踪的设置，见 tracing.go
+	Tracing TracingConfig `yaml:"tracing"`
+	// Log 是日志的格式和级别，见 logging.go
+	Log LogConfig `yaml:"log"`
+	// Theme 是页面模板的设置，见 templates.go
+	Theme ThemeConfig `yaml:"theme"`
+	// DefaultLocale 是请求没有指定 (或指定了不支持的) 语言时页面使用的语言，见 i18n.go
+	DefaultLocale string `yaml:"default_locale"`
+	// Clients 和 Users 在启动时写入存储 (同 ID 的记录会被覆盖)。配置文件中没有设置时使用内置的演示数据
+	Clients []Client `yaml:"clients"`
+	Users   []User   `yaml:"users"`
+	// IdentityProviders 是可以代理登录的上游 OIDC Provider，见 broker.go
+	IdentityProviders []IdentityProvider `yaml:"identity_providers"`
+	// Realms 是挂载在 /realms/{name} 的其他 realm，见 realm.go
+	Realms []RealmConfig `yaml:"realms"`
+
+	// source 是配置文件的路径，没有使用配置文件时为空
+	source string
+}
+
+// activeConfig 是当前生效的顶层配置。热加载时整体替换，请求处理中通过 currentConfig() 读取全局的设置，
+// 通过 realm 的 currentConfig() 读取客户端、有效期等各个 realm 自己的设置
+var activeConfig atomic.Pointer[Config]
+
+// currentConfig 返回当前生效的顶层配置，调用方不能修改它
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// TLSConfig 同时设置证书和私钥，或者 SelfSigned 为 true 时，Provider 以 HTTPS 方式监听
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// SelfSigned 使用自动生成的自签名证书 (只用于开发)，同时设置了 CertFile 和 KeyFile 时保存到这两个文件，见 server.go
+	SelfSigned bool `yaml:"self_signed"`
+}
+
+// enabled 返回是否以 HTTPS 方式监听
+func (t TLSConfig) enabled() bool {
+	return t.CertFile != "" || t.SelfSigned
+}
+
+// StoreConfig 选择存储的实现，见 store.go
+type StoreConfig struct {
+	Type string `yaml:"type"` // memory 或 bolt
+	Path string `yaml:"path"` // bolt 数据库文件路径
+}
+
+// KeysConfig 是 JWT 签名密钥的配置。SigningKeyFile 为空时每次启动生成新的密钥，
+// 这意味着重启后之前签发的令牌都无法再通过验证
+type KeysConfig struct {
+	SigningKeyFile string `yaml:"signing_key_file"` // PEM 格式的 RSA 私钥 (PKCS#1 或 PKCS#8)
+	KeyID          string `yaml:"key_id"`
+}
+
+// LifetimesConfig 是各类令牌和会话的有效期，配置文件中写作 "1h"、"5m" 这样的字符串
+type LifetimesConfig struct {
+	IDToken     time.Duration `yaml:"id_token"`
+	AccessToken time.Duration `yaml:"access_token"`
+	AuthCode    time.Duration `yaml:"auth_code"`
+	Session     time.Duration `yaml:"session"`
+}
+
+// defaultConfig 返回内置的默认配置，与之前写死在代码中的值相同
+func defaultConfig() Config {
+	return Config{
+		Issuer: "http://127.0.0.1:9090",
+		Listen: ":9090",
+		Store:  StoreConfig{Type: "memory", Path: "oidc-provider.db"},
+		Server: ServerConfig{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   15 * time.Second,
+		},
+		Keys: KeysConfig{KeyID: "my-signing-key-id"},
+		Lifetimes: LifetimesConfig{
+			IDToken:     time.Hour,
+			AccessToken: time.Hour,
+			AuthCode:    5 * time.Minute,
+			Session:     8 * time.Hour,
+		},
+		PasswordPolicy: PasswordPolicy{MinLength: 8},
+		Audit:          AuditConfig{Sink: "stdout", Retain: 1000},
+		Log:            LogConfig{Format: "pretty", Level: "info"},
+		DefaultLocale:  "zh",
+		LoginThrottle: LoginThrottle{
+			FreeAttempts:    3,
+			IPFreeAttempts:  20,
+			BaseDelay:       time.Second,
+			MaxDelay:        time.Minute,
+			UserLockout:     10,
+			IPLockout:       100,
+			LockoutDuration: 15 * time.Minute,
+		},
+	}
+}
+
+// loadConfig 按优先级合并默认值、配置文件、环境变量和命令行参数，并验证结果
+func loadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("simple-oidc-provider", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("OIDC_CONFIG"), "配置文件路径 (YAML 或 JSON)，环境变量 OIDC_CONFIG")
+	issuer := fs.String("issuer", "", "颁发者 URL，环境变量 OIDC_ISSUER")
+	listen := fs.String("listen", "", "监听地址，例如 :9090，环境变量 OIDC_LISTEN")
+	tlsCert := fs.String("tls-cert", "", "TLS 证书文件，环境变量 OIDC_TLS_CERT")
+	tlsKey := fs.String("tls-key", "", "TLS 私钥文件，环境变量 OIDC_TLS_KEY")
+	tlsSelfSigned := fs.Bool("tls-self-signed", false, "使用自动生成的自签名证书 (只用于开发)，环境变量 OIDC_TLS_SELF_SIGNED=true")
+	storeType := fs.String("store", "", "存储类型: memory (重启后丢失) 或 bolt (保存到文件)，环境变量 OIDC_STORE")
+	storePath := fs.String("store-path", "", "bolt 存储的数据库文件路径，环境变量 OIDC_STORE_PATH")
+	signingKey := fs.String("signing-key", "", "PEM 格式的 RSA 签名私钥文件，环境变量 OIDC_SIGNING_KEY")
+	adminToken := fs.String("admin-token", "", "管理 API 的 Bearer 令牌，环境变量 OIDC_ADMIN_TOKEN")
+	themeDir := fs.String("theme-dir", "", "自定义页面模板的目录，环境变量 OIDC_THEME_DIR")
+	defaultLocale := fs.String("default-locale", "", "页面的默认语言，例如 zh 或 en，环境变量 OIDC_DEFAULT_LOCALE")
+	logFormat := fs.String("log-format", "", "日志格式: pretty、text 或 json，环境变量 OIDC_LOG_FORMAT")
+	logLevel := fs.String("log-level", "", "日志级别: debug、info、warn 或 error，环境变量 OIDC_LOG_LEVEL")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// 1. 默认值，然后用配置文件覆盖
+	cfg := defaultConfig()
+	if *configPath != "" {
+		if err := readConfigFile(*configPath, &cfg); err != nil {
+			return nil, err
+		}
+		cfg.source = *configPath
+	}
+	// 复制内置的演示数据，之后对配置的修改不会影响到它们
+	if cfg.Clients == nil {
+		cfg.Clients = append([]Client(nil), defaultClients...)
+	}
+	if cfg.Users == nil {
+		cfg.Users = append([]User(nil), defaultUsers...)
+	}
+
+	// 2. 环境变量和命令行参数 (只覆盖显式设置了的项)
+	overrides := []struct {
+		env   string
+		flag  *string
+		field *string
+	}{
+		{"OIDC_ISSUER", issuer, &cfg.Issuer},
+		{"OIDC_LISTEN", listen, &cfg.Listen},
+		{"OIDC_TLS_CERT", tlsCert, &cfg.TLS.CertFile},
+		{"OIDC_TLS_KEY", tlsKey, &cfg.TLS.KeyFile},
+		{"OIDC_STORE", storeType, &cfg.Store.Type},
+		{"OIDC_STORE_PATH", storePath, &cfg.Store.Path},
+		{"OIDC_SIGNING_KEY", signingKey, &cfg.Keys.SigningKeyFile},
+		{"OIDC_ADMIN_TOKEN", adminToken, &cfg.Admin.Token},
+		{"OIDC_THEME_DIR", themeDir, &cfg.Theme.Dir},
+		{"OIDC_DEFAULT_LOCALE", defaultLocale, &cfg.DefaultLocale},
+		{"OIDC_LOG_FORMAT", logFormat, &cfg.Log.Format},
+		{"OIDC_LOG_LEVEL", logLevel, &cfg.Log.Level},
+	}
+	for _, o := range overrides {
+		if v := os.Getenv(o.env); v != "" {
+			*o.field = v
+		}
+		if *o.flag != "" {
+			*o.field = *o.flag
+		}
+	}
+	if v := os.Getenv("OIDC_TLS_SELF_SIGNED"); v != "" {
+		selfSigned, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("OIDC_TLS_SELF_SIGNED: %q 不是 true 或 false", v)
+		}
+		cfg.TLS.SelfSigned = selfSigned
+	}
+	if *tlsSelfSigned {
+		cfg.TLS.SelfSigned = true
+	}
+
+	// 3. 验证
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("配置无效:\n%w", err)
+	}
+	if err := cfg.PasswordPolicy.loadBreachedList(); err != nil {
+		return nil, err
+	}
+	for _, rc := range cfg.Realms {
+		if rc.PasswordPolicy != nil {
+			if err := rc.PasswordPolicy.loadBreachedList(); err != nil {
+				return nil, fmt.Errorf("realm %s: %w", rc.Name, err)
+			}
+		}
+	}
+	return &cfg, nil
+}
+
+// readConfigFile 读取配置文件。JSON 是 YAML 的子集，所以两种格式都用 YAML 解析器读取，
+// 未知的字段会报错，避免拼错的配置项被悄悄忽略
+func readConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("无法读取配置文件: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("无法解析配置文件 %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate 检查配置，一次返回所有问题，每条都指明出错的配置项
+func (c *Config) validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("  - "+format, args...))
+	}
+
+	if u, err := url.Parse(c.Issuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fail("issuer: %q 不是 http(s) 的绝对 URL", c.Issuer)
+	} else if u.RawQuery != "" || u.Fragment != "" || (u.Path != "" && u.Path[len(u.Path)-1] == '/') {
+		fail("issuer: %q 不能包含查询参数、片段或结尾的 /", c.Issuer)
+	}
+	if c.Listen == "" {
+		fail("listen: 不能为空")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("tls: cert_file 和 key_file 必须同时设置")
+	}
+	// 反过来，启用 TLS 的代理后面的 Provider 可以用 http 监听而使用 https 的颁发者
+	if c.TLS.enabled() && strings.HasPrefix(c.Issuer, "http://") {
+		fail("issuer: 启用 TLS 时必须是 https URL")
+	}
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"read_timeout", c.Server.ReadTimeout},
+		{"write_timeout", c.Server.WriteTimeout},
+		{"idle_timeout", c.Server.IdleTimeout},
+		{"shutdown_timeout", c.Server.ShutdownTimeout},
+	} {
+		if t.d <= 0 {
+			fail("server.%s: 必须大于 0", t.name)
+		}
+	}
+	switch c.Store.Type {
+	case "memory":
+	case "bolt":
+		if c.Store.Path == "" {
+			fail("store.path: bolt 存储必须设置数据库文件路径")
+		}
+	default:
+		fail("store.type: 未知的存储类型 %q (可选 memory 或 bolt)", c.Store.Type)
+	}
+	if t := c.LoginThrottle; t.FreeAttempts < 0 || t.IPFreeAttempts < 0 || t.UserLockout < 0 || t.IPLockout < 0 {
+		fail("login_throttle: 次数不能为负数")
+	}
+	if t := c.LoginThrottle; t.BaseDelay <= 0 || t.MaxDelay < t.BaseDelay || t.LockoutDuration <= 0 {
+		fail("login_throttle: base_delay 和 lockout_duration 必须大于 0，max_delay 不能小于 base_delay")
+	}
+	if c.Admin.Token != "" && len(c.Admin.Token) < 16 {
+		fail("admin.token: 至少需要 16 个字符")
+	}
+	switch c.Audit.Sink {
+	case "stdout", "none":
+	case "file":
+		if c.Audit.File == "" {
+			fail("audit.file: sink 为 file 时必须设置文件路径")
+		}
+	default:
+		fail("audit.sink: 未知的输出 %q (可选 stdout、file 或 none)", c.Audit.Sink)
+	}
+	if c.Audit.Retain < 0 {
+		fail("audit.retain: 不能为负数")
+	}
+	switch c.Tracing.Exporter {
+	case "", "none", "stdout":
+	case "otlp-file":
+		if c.Tracing.File == "" {
+			fail("tracing.file: exporter 为 otlp-file 时必须设置文件路径")
+		}
+	default:
+		fail("tracing.exporter: 未知的输出 %q (可选 none、stdout 或 otlp-file)", c.Tracing.Exporter)
+	}
+	switch c.Log.Format {
+	case "pretty", "text", "json":
+	default:
+		fail("log.format: 未知的格式 %q (可选 pretty、text 或 json)", c.Log.Format)
+	}
+	if _, ok := logLevels[c.Log.Level]; !ok {
+		fail("log.level: 未知的级别 %q (可选 debug、info、warn 或 error)", c.Log.Level)
+	}
+	c.validateRealm(fail)
+
+	seenRealms := make(map[string]bool)
+	// 各个 realm 的管理令牌必须互不相同，否则一个 realm 的管理员也能管理另一个
+	seenTokens := map[string]bool{c.Admin.Token: c.Admin.Token != ""}
+	for i, rc := range c.Realms {
+		if !realmNamePattern.MatchString(rc.Name) {
+			fail("realms[%d]: name %q 只能使用小写字母、数字和 -，并以字母或数字开头", i, rc.Name)
+			continue
+		}
+		where := fmt.Sprintf("realms[%d] (%s): ", i, rc.Name)
+		if seenRealms[rc.Name] {
+			fail("%sname 重复", where)
+		}
+		seenRealms[rc.Name] = true
+		if token := rc.Admin.Token; token != "" {
+			if len(token) < 16 {
+				fail("%sadmin.token: 至少需要 16 个字符", where)
+			} else if seenTokens[token] {
+				fail("%sadmin.token: 不能和顶层或其他 realm 的管理令牌相同", where)
+			}
+			seenTokens[token] = true
+		}
+		c.realmConfig(rc).validateRealm(func(format string, args ...interface{}) {
+			fail(where+format, args...)
+		})
+	}
+	return errors.Join(errs...)
+}
+
+// validateRealm 检查各个 realm 自己的设置: 签名密钥、有效期、密码策略、客户端、用户和上游 Provider
+func (c *Config) validateRealm(fail func(format string, args ...interface{})) {
+	if c.Keys.KeyID == "" {
+		fail("keys.key_id: 不能为空")
+	}
+	if c.PasswordPolicy.MinLength < 1 {
+		fail("password_policy.min_length: 必须大于 0")
+	}
+	lifetimes := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"id_token", c.Lifetimes.IDToken},
+		{"access_token", c.Lifetimes.AccessToken},
+		{"auth_code", c.Lifetimes.AuthCode},
+		{"session", c.Lifetimes.Session},
+	}
+	for _, l := range lifetimes {
+		if l.d <= 0 {
+			fail("lifetimes.%s: 必须大于 0", l.name)
+		}
+	}
+
+	seenClients := make(map[string]bool)
+	for i, client := range c.Clients {
+		where := fmt.Sprintf("clients[%d] (%s)", i, client.ID)
+		if client.ID == "" {
+			fail("clients[%d]: id 不能为空", i)
+		} else if seenClients[client.ID] {
+			fail("%s: id 重复", where)
+		}
+		seenClients[client.ID] = true
+		for _, problem := range clientProblems(client) {
+			fail("%s: %s", where, problem)
+		}
+	}
+
+	seenUsernames := make(map[string]bool)
+	seenUserIDs := make(map[string]bool)
+	for i, user := range c.Users {
+		where := fmt.Sprintf("users[%d] (%s)", i, user.Username)
+		if user.Username == "" {
+			fail("users[%d]: username 不能为空", i)
+		} else if seenUsernames[user.Username] {
+			fail("%s: username 重复", where)
+		}
+		seenUsernames[user.Username] = true
+		if user.ID == "" {
+			fail("%s: id 不能为空", where)
+		} else if seenUserIDs[user.ID] {
+			fail("%s: id %q 重复", where, user.ID)
+		}
+		seenUserIDs[user.ID] = true
+		for _, problem := range userProblems(user) {
+			fail("%s: %s", where, problem)
+		}
+	}
+
+	seenIdPs := make(map[string]bool)
+	for i, idp := range c.IdentityProviders {
+		if !identityProviderIDPattern.MatchString(idp.ID) {
+			fail("identity_providers[%d]: id %q 只能使用小写字母、数字和 -，并以字母或数字开头", i, idp.ID)
+			continue
+		}
+		where := fmt.Sprintf("identity_providers[%d] (%s)", i, idp.ID)
+		if seenIdPs[idp.ID] {
+			fail("%s: id 重复", where)
+		}
+		seenIdPs[idp.ID] = true
+		for _, problem := range identityProviderProblems(idp) {
+			fail("%s: %s", where, problem)
+		}
+	}
+}
+
+// clientProblems 检查单个客户端的设置 (不包括 id)，配置文件和管理 API 共用
+func clientProblems(client Client) []string {
+	var problems []string
+	if client.Secret == "" {
+		problems = append(problems, "secret 不能为空")
+	}
+	for j, uri := range client.RedirectURIs {
+		if !isAbsoluteURL(uri) {
+			problems = append(problems, fmt.Sprintf("redirect_uris[%d] %q 不是绝对 URL", j, uri))
+		}
+	}
+	for j, uri := range client.PostLogoutRedirectURIs {
+		if !isAbsoluteURL(uri) {
+			problems = append(problems, fmt.Sprintf("post_logout_redirect_uris[%d] %q 不是绝对 URL", j, uri))
+		}
+	}
+	endpoints := []struct{ field, uri string }{
+		{"backchannel_logout_uri", client.BackchannelLogoutURI},
+		{"frontchannel_logout_uri", client.FrontchannelLogoutURI},
+		{"backchannel_client_notification_endpoint", client.BackchannelClientNotificationEndpoint},
+	}
+	for _, e := range endpoints {
+		if e.uri != "" && !isAbsoluteURL(e.uri) {
+			problems = append(problems, fmt.Sprintf("%s %q 不是绝对 URL", e.field, e.uri))
+		}
+	}
+	switch client.BackchannelTokenDeliveryMode {
+	case "", cibaModePoll:
+	case cibaModePing:
+		if client.BackchannelClientNotificationEndpoint == "" {
+			problems = append(problems, "ping 模式必须设置 backchannel_client_notification_endpoint")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("backchannel_token_delivery_mode %q 无效 (可选 poll 或 ping)", client.BackchannelTokenDeliveryMode))
+	}
+	return problems
+}
+
+// userProblems 检查单个用户的设置 (不包括 username 和 id)，配置文件和管理 API 共用
+func userProblems(user User) []string {
+	var problems []string
+	switch {
+	case user.Password == "" && user.PasswordHash == "" && len(user.Identities) == 0:
+		// 由上游创建的用户可以没有密码
+		problems = append(problems, "必须设置 password_hash (或 password)")
+	case user.Password != "" && user.PasswordHash != "":
+		problems = append(problems, "password 和 password_hash 只能设置一个")
+	case user.PasswordHash != "" && !isSupportedPasswordHash(user.PasswordHash):
+		problems = append(problems, "password_hash 不是 argon2id 或 bcrypt 哈希")
+	}
+	if user.TOTPSecret != "" {
+		if key, err := decodeTOTPSecret(user.TOTPSecret); err != nil || len(key) < 10 {
+			problems = append(problems, "totp_secret 必须是至少 16 个字符的 Base32 字符串")
+		}
+	}
+	for _, name := range reservedClaims {
+		if _, ok := user.Claims[name]; ok {
+			problems = append(problems, fmt.Sprintf("claims 不能覆盖标准声明 %s", name))
+		}
+	}
+	return problems
+}
+
+// reservedClaims 是 Provider 自己写入令牌或 /userinfo 的声明，用户的自定义声明不能使用这些名称
+var reservedClaims = []string{
+	"iss", "sub", "aud", "exp", "iat", "nbf", "jti", "nonce", "auth_time", "sid", "amr", "acr", "azp",
+	"at_hash", "c_hash", "name", "email", "picture", "client_id", "scope", "cnf", "act", "events",
+}
+
+// loadSigningKey 读取 PEM 格式的 RSA 私钥；path 为空时生成一个新的密钥
+func loadSigningKey(path string) (*rsa.PrivateKey, error) {
+	if path == "" {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取签名密钥: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("签名密钥 %s 不是 PEM 格式", path)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("签名密钥 %s 不是 RSA 私钥", path)
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("签名密钥 %s 的 PEM 类型 %q 不受支持", path, block.Type)
+	}
+}
+
+// isAbsoluteURL 判断是否为带 scheme 和 host 的绝对 URL
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
@@ -0,0 +1,182 @@
+// consent.go - 细粒度的同意授权
+// 同意授权页面列出客户端请求的每个 scope，用户可以只勾选其中一部分。用户的选择按 (用户, 客户端) 保存为一条授权记录，
+// 同一个客户端之后再次请求时，只有还没有授权过的 scope 才需要用户确认。
+// 用户可以在 /account/consents 查看和撤销授权，撤销时该客户端代表用户持有的访问令牌也一并失效。
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Grant 是用户授予某个客户端的权限，以 (UserID, ClientID) 为键
+type Grant struct {
+	// UserID 是用户的登录名，和 Session.UserID 相同
+	UserID   string
+	ClientID string
+	Scopes   []string
+	// CreatedAt 是第一次授权的时间，UpdatedAt 是最近一次修改授权范围的时间
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// supportedScopes 是 Provider 支持的 scope，按同意授权页面上显示的顺序排列。
+// 每个 scope 在消息目录中有一条说明 scope.<名称>
+var supportedScopes = []string{"openid", "profile", "email"}
+
+// scopeClaims 是每个 scope 允许返回的用户声明，ID Token 和 /userinfo 只返回已授权 scope 的声明
+var scopeClaims = map[string][]string{
+	"profile": {"name", "picture"},
+	"email":   {"email"},
+}
+
+// requestedScopes 取出 scope 参数中 Provider 支持的 scope，去掉重复的和不认识的
+func requestedScopes(scope string) []string {
+	var list []string
+	for _, s := range strings.Fields(scope) {
+		if containsString(supportedScopes, s) && !containsString(list, s) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// missingScopes 返回 requested 中还没有授予的 scope
+func (g Grant) missingScopes(requested []string) []string {
+	var list []string
+	for _, s := range requested {
+		if !containsString(g.Scopes, s) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// userClaims 返回 scope 允许客户端看到的用户声明，sub 和用户的自定义声明总是包含在内
+func userClaims(user User, scope string) map[string]interface{} {
+	values := map[string]string{"name": user.Name, "email": user.Email, "picture": user.Picture}
+	claims := map[string]interface{}{"sub": user.ID}
+	for name, value := range user.Claims {
+		claims[name] = value
+	}
+	for _, s := range strings.Fields(scope) {
+		for _, name := range scopeClaims[s] {
+			claims[name] = values[name]
+		}
+	}
+	return claims
+}
+
+// findGrant 返回用户对客户端的授权，没有授权过时返回空的记录
+func (rlm *realm) findGrant(userID, clientID string) (Grant, error) {
+	grant, err := rlm.store.GetGrant(userID, clientID)
+	if errors.Is(err, errNotFound) {
+		return Grant{UserID: userID, ClientID: clientID}, nil
+	}
+	return grant, err
+}
+
+// saveGrant 记录用户在同意授权页面上的选择: 本次请求的 scope 以勾选的为准，之前授权的其他 scope 保持不变
+func (rlm *realm) saveGrant(grant Grant, requested, approved []string) error {
+	scopes := make([]string, 0, len(grant.Scopes)+len(approved))
+	for _, s := range grant.Scopes {
+		if !containsString(requested, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	scopes = append(scopes, approved...)
+
+	now := time.Now()
+	if grant.CreatedAt.IsZero() {
+		grant.CreatedAt = now
+	}
+	grant.Scopes, grant.UpdatedAt = scopes, now
+	return rlm.store.SaveGrant(grant)
+}
+
+// consentScope 是同意授权页面上的一个 scope
+type consentScope struct {
+	Name string
+	// Required 的 scope 不能取消勾选 (openid 用于签发 ID Token)
+	Required bool
+	// Granted 表示用户之前已经授权过这个 scope
+	Granted bool
+}
+
+// consentScopes 列出页面上的 scope，之前没有授权过的排在前面
+func consentScopes(grant Grant, requested []string) []consentScope {
+	var fresh, granted []consentScope
+	for _, s := range requested {
+		row := consentScope{Name: s, Required: s == "openid", Granted: containsString(grant.Scopes, s)}
+		if row.Granted {
+			granted = append(granted, row)
+		} else {
+			fresh = append(fresh, row)
+		}
+	}
+	return append(fresh, granted...)
+}
+
+// approvedScopes 返回表单中勾选的 scope，只接受本次请求的 scope，必需的 scope 总是包含在内
+func approvedScopes(r *http.Request, requested []string) []string {
+	var list []string
+	for _, s := range requested {
+		if s == "openid" || containsString(r.PostForm["scope"], s) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// handleConsentSettings 是用户管理授权的页面: GET 列出授权过的客户端，POST 撤销其中一个
+func handleConsentSettings(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess == nil {
+		rlm.redirect(w, r, "/login?return_to=/account/consents")
+		return
+	}
+	user, err := rlm.store.GetUser(sess.UserID)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+
+	var message Message
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		clientID := r.PostForm.Get("client_id")
+		if _, err := rlm.store.GetGrant(user.Username, clientID); err != nil {
+			message = msg("consents.not_found")
+		} else {
+			if err := rlm.store.DeleteGrant(user.Username, clientID); err != nil {
+				http.Error(w, "撤销授权失败", http.StatusInternalServerError)
+				return
+			}
+			// 客户端代表用户持有的访问令牌随授权一起失效
+			n, err := revokeTokens(r, user.ID, clientID, "consent revoked")
+			if err != nil {
+				http.Error(w, "撤销令牌失败", http.StatusInternalServerError)
+				return
+			}
+			audit(r, AuditEvent{Type: auditConsentRevoked, Username: user.Username, ClientID: clientID, Detail: fmt.Sprintf("tokens=%d", n)})
+			slog.InfoContext(r.Context(), "用户撤销了对客户端的授权", "username", user.Username, "client_id", clientID, "revoked_tokens", n)
+			message = msg("consents.revoked", clientID, n)
+		}
+	}
+
+	grants, err := rlm.store.ListGrants(user.Username)
+	if err != nil {
+		http.Error(w, "读取授权失败", http.StatusInternalServerError)
+		return
+	}
+	renderPage(w, r, "consents.html", page{
+		Title:   "title.consents",
+		Message: message,
+		Data:    struct{ Grants []Grant }{grants},
+	})
+}
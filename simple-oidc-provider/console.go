@@ -0,0 +1,400 @@
+// console.go - 管理控制台
+// /admin 下的网页让测试人员在浏览器中管理 Provider: 创建测试用户和客户端、给用户设置自定义声明、
+// 查看活动会话和最近签发的访问令牌，以及一键把 Provider 重置为配置文件中的状态。
+// 控制台使用 Provider 自己的登录，只有设置了 admin: true 的用户可以访问，不需要管理 API 的令牌。
+// 修改和管理 API 一样通过 saveClient、deleteUser、resetState 等函数完成 (见 admin.go)，并记录审计事件。
+// 每个 realm 有自己的控制台 (/realms/{name}/admin)，由这个 realm 中的管理员用户登录，只能管理这个 realm。
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// consoleRecentTokens 是控制台首页最多显示的访问令牌数量
+const consoleRecentTokens = 50
+
+// registerConsoleRoutes 注册管理控制台的页面
+func registerConsoleRoutes() {
+	http.HandleFunc("/admin", csrfProtect(requireConsoleAdmin(handleConsoleHome)))
+	http.HandleFunc("/admin/users", csrfProtect(requireConsoleAdmin(handleConsoleUsers)))
+	http.HandleFunc("/admin/users/{username}", csrfProtect(requireConsoleAdmin(handleConsoleUser)))
+	http.HandleFunc("/admin/clients", csrfProtect(requireConsoleAdmin(handleConsoleClients)))
+	http.HandleFunc("/admin/clients/{id}", csrfProtect(requireConsoleAdmin(handleConsoleClient)))
+}
+
+// requireConsoleAdmin 要求已登录的管理员用户: 没有登录时先去登录页面，登录的不是管理员时返回 403
+func requireConsoleAdmin(next func(w http.ResponseWriter, r *http.Request, admin User)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sess := currentSession(r)
+		if sess == nil {
+			requestRealm(r).redirect(w, r, "/login?return_to="+r.URL.EscapedPath())
+			return
+		}
+		user, err := requestRealm(r).store.GetUser(sess.UserID)
+		if err != nil || !user.Admin {
+			http.Error(w, translate(r, "console.forbidden"), http.StatusForbidden)
+			return
+		}
+		next(w, r, user)
+	}
+}
+
+// --- 首页: 会话、访问令牌和重置 ---
+
+// consoleToken 是首页上的一个访问令牌，Username 是 sub 对应的用户名 (用户已删除时为空)
+type consoleToken struct {
+	TokenRecord
+	Username string
+}
+
+// handleConsoleHome 显示活动会话和最近签发的访问令牌。POST 结束会话 (action=end_session)、
+// 撤销令牌 (action=revoke_token) 或重置 Provider (action=reset)
+func handleConsoleHome(w http.ResponseWriter, r *http.Request, admin User) {
+	rlm := requestRealm(r)
+	var message Message
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		switch r.PostForm.Get("action") {
+		case "end_session":
+			sess, err := rlm.findSessionBySid(r.PostForm.Get("sid"))
+			if err != nil {
+				message = msg("console.session_not_found")
+				break
+			}
+			own := sess.Sid == currentSession(r).Sid
+			if _, err := terminateSession(r, &sess); err != nil {
+				message = messageOf(err)
+				break
+			}
+			auditAdmin(r, admin.Username, "session of "+sess.UserID)
+			if own {
+				rlm.redirect(w, r, "/login?return_to=/admin")
+				return
+			}
+			message = msg("console.session_ended", sess.UserID)
+		case "revoke_token":
+			id := r.PostForm.Get("jti")
+			if err := revokeToken(r, id, "admin"); errors.Is(err, errNotFound) {
+				message = msg("console.token_not_found")
+				break
+			} else if err != nil {
+				message = messageOf(err)
+				break
+			}
+			auditAdmin(r, admin.Username, "revoked "+id)
+			message = msg("console.token_revoked", id)
+		case "reset":
+			if err := resetState(r); err != nil {
+				message = messageOf(err)
+				break
+			}
+			auditAdmin(r, admin.Username, "reset")
+			// 管理员自己的会话也被删除了，需要重新登录 (如果管理员是配置中的用户)
+			rlm.redirect(w, r, "/login?return_to=/admin")
+			return
+		}
+	}
+
+	now := time.Now()
+	sessions, err := rlm.store.ListSessions()
+	if err != nil {
+		http.Error(w, "读取会话失败", http.StatusInternalServerError)
+		return
+	}
+	active := sessions[:0]
+	for _, sess := range sessions {
+		if now.Before(sess.Expiry) {
+			active = append(active, sess)
+		}
+	}
+
+	records, err := rlm.store.ListTokens()
+	if err != nil {
+		http.Error(w, "读取访问令牌失败", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].IssuedAt.After(records[j].IssuedAt) })
+	var tokens []consoleToken
+	for _, token := range records {
+		if now.After(token.Expiry) {
+			continue
+		}
+		if len(tokens) == consoleRecentTokens {
+			break
+		}
+		user, _ := rlm.findUserByID(token.Subject)
+		tokens = append(tokens, consoleToken{token, user.Username})
+	}
+
+	renderPage(w, r, "admin.html", page{
+		Title:   "title.console",
+		Message: message,
+		Data: struct {
+			Admin    User
+			Sessions []Session
+			Tokens   []consoleToken
+		}{admin, active, tokens},
+	})
+}
+
+// --- 用户 ---
+
+// consoleUserForm 是创建和编辑用户的表单，Claims 是 JSON 格式的自定义声明
+type consoleUserForm struct {
+	Username string
+	ID       string
+	Name     string
+	Email    string
+	Picture  string
+	Claims   string
+	Admin    bool
+}
+
+func newConsoleUserForm(user User) consoleUserForm {
+	form := consoleUserForm{Username: user.Username, ID: user.ID, Name: user.Name, Email: user.Email, Picture: user.Picture, Admin: user.Admin}
+	if len(user.Claims) > 0 {
+		data, _ := json.MarshalIndent(user.Claims, "", "  ")
+		form.Claims = string(data)
+	}
+	return form
+}
+
+// readConsoleUser 把表单中的字段写入 user。密码为空时沿用原来的哈希；自定义声明必须是 JSON 对象
+func readConsoleUser(r *http.Request, user *User) (consoleUserForm, error) {
+	f := r.PostForm
+	form := consoleUserForm{
+		Username: strings.TrimSpace(f.Get("username")),
+		ID:       strings.TrimSpace(f.Get("id")),
+		Name:     f.Get("name"),
+		Email:    f.Get("email"),
+		Picture:  f.Get("picture"),
+		Claims:   f.Get("claims"),
+		Admin:    f.Get("admin") != "",
+	}
+	user.ID, user.Name, user.Email, user.Picture, user.Admin = form.ID, form.Name, form.Email, form.Picture, form.Admin
+	if user.Username == "" {
+		user.Username = form.Username
+	}
+	if password := f.Get("password"); password != "" {
+		user.Password, user.PasswordHash = password, ""
+	}
+	user.Claims = nil
+	if strings.TrimSpace(form.Claims) != "" {
+		if err := json.Unmarshal([]byte(form.Claims), &user.Claims); err != nil {
+			return form, &localizedError{msg("console.claims_invalid", err.Error())}
+		}
+	}
+	return form, nil
+}
+
+// handleConsoleUsers 列出用户并创建新用户 (action=create) 或删除用户 (action=delete)
+func handleConsoleUsers(w http.ResponseWriter, r *http.Request, admin User) {
+	rlm := requestRealm(r)
+	var message Message
+	var form consoleUserForm
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		switch r.PostForm.Get("action") {
+		case "create":
+			var user User
+			var err error
+			if form, err = readConsoleUser(r, &user); err == nil {
+				_, _, err = rlm.saveUser(user, true)
+			}
+			if err != nil {
+				message = messageOf(err)
+				break
+			}
+			auditAdmin(r, admin.Username, "created "+user.Username)
+			message, form = msg("console.user_created", user.Username), consoleUserForm{}
+		case "delete":
+			username := r.PostForm.Get("username")
+			if username == admin.Username {
+				message = msg("console.delete_self")
+				break
+			}
+			ended, revoked, err := deleteUser(r, username)
+			if err != nil {
+				message = messageOf(err)
+				break
+			}
+			auditAdmin(r, admin.Username, fmt.Sprintf("deleted %s, sessions=%d tokens=%d", username, ended, revoked))
+			message = msg("console.user_deleted", username)
+		}
+	}
+
+	users, err := rlm.store.ListUsers()
+	if err != nil {
+		http.Error(w, "读取用户失败", http.StatusInternalServerError)
+		return
+	}
+	views := make([]userView, len(users))
+	for i, user := range users {
+		views[i] = rlm.newUserView(user)
+	}
+	renderPage(w, r, "admin_users.html", page{
+		Title:   "title.console_users",
+		Message: message,
+		Data: struct {
+			Users []userView
+			Form  consoleUserForm
+		}{views, form},
+	})
+}
+
+// handleConsoleUser 编辑一个用户，用户名不能修改
+func handleConsoleUser(w http.ResponseWriter, r *http.Request, admin User) {
+	rlm := requestRealm(r)
+	user, err := rlm.store.GetUser(r.PathValue("username"))
+	if err != nil {
+		http.Error(w, translate(r, "console.user_not_found"), http.StatusNotFound)
+		return
+	}
+	var message Message
+	form := newConsoleUserForm(user)
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		if form, err = readConsoleUser(r, &user); err == nil {
+			user, _, err = rlm.saveUser(user, false)
+		}
+		if err != nil {
+			message = messageOf(err)
+		} else {
+			auditAdmin(r, admin.Username, "replaced "+user.Username)
+			message, form = msg("console.user_saved", user.Username), newConsoleUserForm(user)
+		}
+		form.Username = user.Username
+	}
+	renderPage(w, r, "admin_user.html", page{
+		Title:   "title.console_users",
+		Message: message,
+		Data:    struct{ Form consoleUserForm }{form},
+	})
+}
+
+// --- 客户端 ---
+
+// consoleClientForm 是创建和编辑客户端的表单，多个地址每行一个
+type consoleClientForm struct {
+	ID                     string
+	RedirectURIs           string
+	PostLogoutRedirectURIs string
+	BackchannelLogoutURI   string
+	FrontchannelLogoutURI  string
+	RequireDPoP            bool
+}
+
+func newConsoleClientForm(client Client) consoleClientForm {
+	return consoleClientForm{
+		ID:                     client.ID,
+		RedirectURIs:           strings.Join(client.RedirectURIs, "\n"),
+		PostLogoutRedirectURIs: strings.Join(client.PostLogoutRedirectURIs, "\n"),
+		BackchannelLogoutURI:   client.BackchannelLogoutURI,
+		FrontchannelLogoutURI:  client.FrontchannelLogoutURI,
+		RequireDPoP:            client.RequireDPoP,
+	}
+}
+
+// readConsoleClient 把表单中的字段写入 client。表单中没有的设置 (CIBA、令牌交换) 保持不变，secret 为空时沿用原来的值
+func readConsoleClient(r *http.Request, client *Client) consoleClientForm {
+	f := r.PostForm
+	form := consoleClientForm{
+		ID:                     strings.TrimSpace(f.Get("id")),
+		RedirectURIs:           f.Get("redirect_uris"),
+		PostLogoutRedirectURIs: f.Get("post_logout_redirect_uris"),
+		BackchannelLogoutURI:   strings.TrimSpace(f.Get("backchannel_logout_uri")),
+		FrontchannelLogoutURI:  strings.TrimSpace(f.Get("frontchannel_logout_uri")),
+		RequireDPoP:            f.Get("require_dpop") != "",
+	}
+	if client.ID == "" {
+		client.ID = form.ID
+	}
+	client.Secret = f.Get("secret")
+	client.RedirectURIs = strings.Fields(form.RedirectURIs)
+	client.PostLogoutRedirectURIs = strings.Fields(form.PostLogoutRedirectURIs)
+	client.BackchannelLogoutURI, client.FrontchannelLogoutURI = form.BackchannelLogoutURI, form.FrontchannelLogoutURI
+	client.RequireDPoP = form.RequireDPoP
+	return form
+}
+
+// handleConsoleClients 列出客户端并创建新客户端 (action=create) 或删除客户端 (action=delete)
+func handleConsoleClients(w http.ResponseWriter, r *http.Request, admin User) {
+	rlm := requestRealm(r)
+	var message Message
+	var form consoleClientForm
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		switch r.PostForm.Get("action") {
+		case "create":
+			var client Client
+			form = readConsoleClient(r, &client)
+			if _, err := rlm.saveClient(client, true); err != nil {
+				message = messageOf(err)
+				break
+			}
+			auditAdmin(r, admin.Username, "created "+client.ID)
+			message, form = msg("console.client_created", client.ID), consoleClientForm{}
+		case "delete":
+			id := r.PostForm.Get("id")
+			revoked, err := deleteClient(r, id)
+			if err != nil {
+				message = messageOf(err)
+				break
+			}
+			auditAdmin(r, admin.Username, fmt.Sprintf("deleted %s, tokens=%d", id, revoked))
+			message = msg("console.client_deleted", id)
+		}
+	}
+
+	clients, err := rlm.store.ListClients()
+	if err != nil {
+		http.Error(w, "读取客户端失败", http.StatusInternalServerError)
+		return
+	}
+	views := make([]clientView, len(clients))
+	for i, client := range clients {
+		views[i] = rlm.newClientView(client)
+	}
+	renderPage(w, r, "admin_clients.html", page{
+		Title:   "title.console_clients",
+		Message: message,
+		Data: struct {
+			Clients []clientView
+			Form    consoleClientForm
+		}{views, form},
+	})
+}
+
+// handleConsoleClient 编辑一个客户端，ID 不能修改
+func handleConsoleClient(w http.ResponseWriter, r *http.Request, admin User) {
+	rlm := requestRealm(r)
+	client, err := rlm.store.GetClient(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, translate(r, "console.client_not_found"), http.StatusNotFound)
+		return
+	}
+	var message Message
+	form := newConsoleClientForm(client)
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		form = readConsoleClient(r, &client)
+		form.ID = client.ID
+		if _, err := rlm.saveClient(client, false); err != nil {
+			message = messageOf(err)
+		} else {
+			auditAdmin(r, admin.Username, "replaced "+client.ID)
+			message = msg("console.client_saved", client.ID)
+		}
+	}
+	renderPage(w, r, "admin_client.html", page{
+		Title:   "title.console_clients",
+		Message: message,
+		Data:    struct{ Form consoleClientForm }{form},
+	})
+}
@@ -0,0 +1,101 @@
+// csrf.go - 表单的 CSRF 防护
+// 每个浏览器有一个随机的 op-csrf Cookie。渲染表单时生成的令牌是 "签发时间.HMAC(Cookie 值, 提交地址, 签发时间)"，
+// 提交地址包含授权请求的全部参数，所以令牌只对这个浏览器的这一次交易有效 (例如某个客户端的某次同意授权)，
+// 并在 csrfTokenLifetime 后过期。令牌不需要保存在服务器端，表单提交时由 csrfProtect 验证。
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	csrfCookieName    = "op-csrf"
+	csrfFieldName     = "csrf_token"
+	csrfTokenLifetime = time.Hour
+)
+
+// csrfKey 是计算令牌的 HMAC 密钥，每次启动随机生成，重启前渲染的表单需要刷新后再提交
+var csrfKey []byte
+
+// csrfToken 返回提交到 action 的表单使用的令牌。浏览器还没有 op-csrf Cookie 时先设置一个
+func csrfToken(w http.ResponseWriter, r *http.Request, action string) string {
+	browserID := ""
+	if cookie, err := r.Cookie(csrfCookieName); err == nil {
+		browserID = cookie.Value
+	}
+	if browserID == "" {
+		id, err := generateRandomString(32)
+		if err != nil {
+			return ""
+		}
+		browserID = id
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookieName,
+			Value:    browserID,
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	return issued + "." + csrfMAC(browserID, csrfScope(action), issued)
+}
+
+// csrfScope 把提交地址转换为规范的形式 (路径加上排序后重新编码的参数)。
+// 模板输出 URL 时会重新转义部分字符，浏览器提交时也可能不同，直接比较原始字符串会误判
+func csrfScope(action string) string {
+	u, err := url.Parse(action)
+	if err != nil {
+		return action
+	}
+	return u.Path + "?" + u.Query().Encode()
+}
+
+func csrfMAC(browserID, scope, issued string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s", browserID, scope, issued)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken 检查表单中的令牌是否由这个浏览器、为这个提交地址签发，并且没有过期
+func validCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	issued, mac, ok := strings.Cut(r.PostFormValue(csrfFieldName), ".")
+	if !ok {
+		return false
+	}
+	seconds, err := strconv.ParseInt(issued, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age < -time.Minute || age > csrfTokenLifetime {
+		return false
+	}
+	// 令牌是为带 realm 前缀的地址签发的，一个 realm 的令牌不能提交到另一个 realm
+	action := requestRealm(r).path(r.URL.RequestURI())
+	return hmac.Equal([]byte(mac), []byte(csrfMAC(cookie.Value, csrfScope(action), issued)))
+}
+
+// csrfProtect 要求 POST 请求带有有效的 CSRF 令牌，用于所有通过 HTML 表单提交的页面
+func csrfProtect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && !validCSRFToken(r) {
+			slog.WarnContext(r.Context(), "拒绝了提交的表单: CSRF 令牌无效或已过期", "form", r.URL.Path)
+			http.Error(w, translate(r, "csrf.invalid"), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
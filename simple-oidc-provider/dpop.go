@@ -0,0 +1,165 @@
+// dpop.go - DPoP 发送方约束令牌 (RFC 9449)
+// 普通的 Bearer 令牌谁拿到谁就能用，一旦被截获就可以被重放。
+// DPoP 要求客户端为每个请求用自己的私钥签一个 "证明" (proof JWT)，
+// Provider 把签发的令牌通过 cnf.jkt 绑定到这把公钥上，之后只有持有私钥的客户端才能使用该令牌。
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+// dpopProofMaxAge 是 DPoP 证明中 iat 允许的最大偏差，超出即视为过期或时钟错误
+const dpopProofMaxAge = 60 * time.Second
+
+// dpopSigningAlgs 是我们接受的 DPoP 证明签名算法 (只允许非对称算法)
+var dpopSigningAlgs = []string{
+	string(jose.ES256), string(jose.ES384), string(jose.ES512),
+	string(jose.RS256), string(jose.PS256), string(jose.EdDSA),
+}
+
+// dpopProofClaims 是 DPoP 证明 JWT 的载荷
+type dpopProofClaims struct {
+	JTI   string `json:"jti"`
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	IAT   int64  `json:"iat"`
+	ATH   string `json:"ath,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// dpopProof 是一个验证通过的 DPoP 证明
+type dpopProof struct {
+	Claims dpopProofClaims
+	// JKT 是证明中公钥的 JWK SHA-256 指纹 (base64url)，用于 cnf.jkt 绑定
+	JKT string
+}
+
+// validateDPoPProof 验证请求中的 DPoP 头。
+// accessToken 不为空时 (即访问受保护资源时)，还会校验 ath 是否为该令牌的哈希。
+// 请求中没有 DPoP 头时返回 (nil, nil)，由调用者决定是否必须使用 DPoP。
+func validateDPoPProof(r *http.Request, htu string, accessToken string) (*dpopProof, error) {
+	values := r.Header.Values("DPoP")
+	if len(values) == 0 {
+		return nil, nil
+	}
+	if len(values) > 1 {
+		return nil, errors.New("请求中只能包含一个 DPoP 头")
+	}
+
+	jws, err := jose.ParseSigned(values[0])
+	if err != nil {
+		return nil, fmt.Errorf("DPoP 证明格式错误: %v", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, errors.New("DPoP 证明必须只有一个签名")
+	}
+	header := jws.Signatures[0].Protected
+
+	// 1. 检查头部: typ、alg 和内嵌的公钥
+	if typ, _ := header.ExtraHeaders[jose.HeaderType].(string); typ != "dpop+jwt" {
+		return nil, errors.New("DPoP 证明的 typ 必须为 dpop+jwt")
+	}
+	if !containsString(dpopSigningAlgs, header.Algorithm) {
+		return nil, fmt.Errorf("不支持的 DPoP 签名算法: %s", header.Algorithm)
+	}
+	jwk := header.JSONWebKey
+	if jwk == nil || !jwk.Valid() || !jwk.IsPublic() {
+		return nil, errors.New("DPoP 证明的 jwk 头必须是一个有效的公钥")
+	}
+
+	// 2. 用内嵌的公钥验证签名
+	payload, err := jws.Verify(jwk.Key)
+	if err != nil {
+		return nil, fmt.Errorf("DPoP 证明签名无效: %v", err)
+	}
+	var claims dpopProofClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("DPoP 证明载荷无效: %v", err)
+	}
+
+	// 3. 检查载荷: 证明必须和当前这次 HTTP 请求对应
+	if claims.JTI == "" {
+		return nil, errors.New("DPoP 证明缺少 jti")
+	}
+	if claims.HTM != r.Method {
+		return nil, fmt.Errorf("DPoP 证明的 htm (%s) 与请求方法不符", claims.HTM)
+	}
+	if !sameHTU(claims.HTU, htu) {
+		return nil, fmt.Errorf("DPoP 证明的 htu (%s) 与请求地址不符", claims.HTU)
+	}
+	issuedAt := time.Unix(claims.IAT, 0)
+	if time.Since(issuedAt) > dpopProofMaxAge || time.Until(issuedAt) > dpopProofMaxAge {
+		return nil, errors.New("DPoP 证明已过期或 iat 不合理")
+	}
+	if accessToken != "" && claims.ATH != accessTokenHash(accessToken) {
+		return nil, errors.New("DPoP 证明的 ath 与访问令牌不符")
+	}
+
+	// 4. 防重放: 同一个 jti 在有效期内只能使用一次
+	if !requestRealm(r).rememberDPoPJTI(claims.JTI, issuedAt.Add(dpopProofMaxAge)) {
+		return nil, errors.New("DPoP 证明已被使用过")
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("无法计算 JWK 指纹: %v", err)
+	}
+	return &dpopProof{
+		Claims: claims,
+		JKT:    base64.RawURLEncoding.EncodeToString(thumbprint),
+	}, nil
+}
+
+// rememberDPoPJTI 在 realm 中记录一个已使用的 jti。如果它已经存在则返回 false。
+// 过了有效期的记录由 deleteExpired 定期清理
+func (rlm *realm) rememberDPoPJTI(jti string, expiry time.Time) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if exp, seen := rlm.usedDPoPJTIs[jti]; seen && time.Now().Before(exp) {
+		return false
+	}
+	rlm.usedDPoPJTIs[jti] = expiry
+	return true
+}
+
+// sameHTU 比较两个 URI 是否相同，忽略查询参数和片段 (RFC 9449 第 4.3 节)
+func sameHTU(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) &&
+		strings.EqualFold(ua.Host, ub.Host) &&
+		ua.EscapedPath() == ub.EscapedPath()
+}
+
+// accessTokenHash 计算 DPoP 证明中 ath 的期望值: base64url(SHA-256(access_token))
+func accessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// writeDPoPChallenge 在访问受保护资源失败时返回 WWW-Authenticate 头，告诉客户端应该使用的认证方式
+func writeDPoPChallenge(w http.ResponseWriter, scheme, errCode, description string) {
+	challenge := fmt.Sprintf(`%s error="%s"`, scheme, errCode)
+	if scheme == "DPoP" {
+		challenge += fmt.Sprintf(`, algs="%s"`, strings.Join(dpopSigningAlgs, " "))
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeOAuthError(w, http.StatusUnauthorized, errCode, description)
+}
@@ -0,0 +1,85 @@
+// frontchannel.go - OIDC Front-Channel Logout 与 Session Management
+// 有些浏览器应用无法接收服务器之间的 back-channel 调用，所以我们提供两种基于浏览器的机制:
+//   - Front-Channel Logout: 退出页面为每个参与的客户端渲染一个隐藏的 iframe，
+//     指向其 frontchannel_logout_uri (带上 iss 和 sid)，由客户端在浏览器里清除自己的登录状态。
+//   - Session Management: 授权响应中返回 session_state，SPA 可以通过 check_session_iframe
+//     定期用 postMessage 询问 Provider 端的会话是否发生了变化。
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// browserStateCookieName 是 OP 浏览器状态 (opbs) Cookie 的名称。
+	// 它必须能被 check_session_iframe 中的 JavaScript 读取，所以不能设置 HttpOnly。
+	browserStateCookieName = "op-browser-state"
+	// frontchannelLogoutTimeout 是退出页面等待 iframe 加载的最长时间，超时后仍然继续重定向
+	frontchannelLogoutTimeout = 3 * time.Second
+)
+
+// setBrowserStateCookie 在登录时下发新的浏览器状态，登录或退出都会使之前的 session_state 失效
+func (rlm *realm) setBrowserStateCookie(w http.ResponseWriter, state string) {
+	rlm.setCookie(w, &http.Cookie{
+		Name:     browserStateCookieName,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(rlm.currentConfig().Lifetimes.Session.Seconds()),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearBrowserStateCookie 在退出登录时清除浏览器状态
+func (rlm *realm) clearBrowserStateCookie(w http.ResponseWriter) {
+	rlm.setCookie(w, &http.Cookie{
+		Name:   browserStateCookieName,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// computeSessionState 按照 OIDC Session Management 第 3 节计算 session_state:
+// hex(SHA-256(client_id + " " + origin + " " + opbs + " " + salt)) + "." + salt
+func computeSessionState(clientID, redirectURI, browserState string) (string, error) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", err
+	}
+	origin := u.Scheme + "://" + u.Host
+	salt, err := generateRandomString(8)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(clientID + " " + origin + " " + browserState + " " + salt))
+	return hex.EncodeToString(sum[:]) + "." + salt, nil
+}
+
+// frontchannelLogoutURLs 返回会话中需要通过 iframe 通知的客户端地址，每个地址都带上 iss 和 sid
+func (rlm *realm) frontchannelLogoutURLs(sess *Session) []string {
+	var urls []string
+	for _, clientID := range sess.Clients {
+		client, err := rlm.store.GetClient(clientID)
+		if err != nil || client.FrontchannelLogoutURI == "" {
+			continue
+		}
+		urls = append(urls, appendQuery(client.FrontchannelLogoutURI, url.Values{
+			"iss": {rlm.issuer},
+			"sid": {sess.Sid},
+		}))
+	}
+	return urls
+}
+
+// handleCheckSession 是 check_session_iframe。
+// RP 的 iframe 通过 postMessage 发送 "client_id session_state"，
+// 这里用当前的 opbs Cookie 重新计算，回复 "unchanged"、"changed" 或 "error"。
+func handleCheckSession(w http.ResponseWriter, r *http.Request) {
+	// 这个页面本来就是要被 RP 嵌入 iframe 的，所以不设置 X-Frame-Options
+	w.Header().Set("Cache-Control", "no-store")
+	renderPage(w, r, "check_session.html", page{Data: struct{ CookieName string }{requestRealm(r).cookieName(browserStateCookieName)}})
+}
@@ -0,0 +1,243 @@
+// i18n.go - 页面的多语言支持
+// 页面上的文字都来自消息目录 locales/<语言>.json (键 -> 文字)，内置 zh 和 en，编译时嵌入程序。
+// 主题目录的 locales/ 中可以放同名的文件来修改部分文字，或者放新的文件来增加语言。
+// 每个请求的语言按以下顺序选择: 授权请求的 ui_locales 参数、Accept-Language 请求头、配置中的 default_locale。
+// 每个 realm 的消息目录随 realm 的配置一起热加载。
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed locales/*.json
+var defaultLocales embed.FS
+
+// catalog 是消息目录: 语言 -> 键 -> 文字。文字可以包含 fmt 格式的占位符
+type catalog struct {
+	messages      map[string]map[string]string
+	defaultLocale string
+}
+
+// Message 是一条需要翻译的消息: 目录中的键和格式化参数。
+// 处理函数只决定显示哪条消息，由页面按请求的语言翻译
+type Message struct {
+	Key  string
+	Args []any
+	// Text 是不能翻译的纯文字 (例如普通错误的内容，其中可能有用户输入)，Key 为空时显示它。
+	// 它不是 HTML，页面会转义
+	Text string
+}
+
+func msg(key string, args ...any) Message {
+	return Message{Key: key, Args: args}
+}
+
+// plainMessage 返回显示纯文字 s 的消息
+func plainMessage(s string) Message {
+	return Message{Text: s}
+}
+
+// localizedError 是可以翻译的错误，例如密码不符合策略。Error() 返回默认语言的文字，用于日志
+type localizedError struct {
+	Message
+}
+
+func (e *localizedError) Error() string {
+	return currentCatalog().text(currentCatalog().defaultLocale, e.Key, e.Args...)
+}
+
+// messageOf 把错误转换为显示给用户的消息，不能翻译的错误作为纯文字显示
+func messageOf(err error) Message {
+	if le, ok := err.(*localizedError); ok {
+		return le.Message
+	}
+	return plainMessage(err.Error())
+}
+
+// currentCatalog 返回默认 realm 的消息目录，用于与请求无关的文字 (例如日志)。
+// 第一次加载配置之前 (例如验证配置中的密码时) 使用内置目录
+func currentCatalog() *catalog {
+	if rootRealm != nil {
+		if c := rootRealm.activeCatalog.Load(); c != nil {
+			return c
+		}
+	}
+	c, err := loadCatalog("", "zh")
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// currentCatalog 返回 realm 的消息目录
+func (rlm *realm) currentCatalog() *catalog {
+	if c := rlm.activeCatalog.Load(); c != nil {
+		return c
+	}
+	return currentCatalog()
+}
+
+// loadCatalog 读取内置的消息目录，再合并 dir/locales 中的文件
+func loadCatalog(dir, defaultLocale string) (*catalog, error) {
+	c := &catalog{messages: make(map[string]map[string]string), defaultLocale: defaultLocale}
+	if err := c.merge(defaultLocales, "locales"); err != nil {
+		return nil, fmt.Errorf("读取内置消息目录失败: %w", err)
+	}
+	if dir != "" {
+		if _, err := os.Stat(filepath.Join(dir, "locales")); err == nil {
+			if err := c.merge(os.DirFS(dir), "locales"); err != nil {
+				return nil, fmt.Errorf("读取主题消息目录失败: %w", err)
+			}
+		}
+	}
+	if _, ok := c.messages[defaultLocale]; !ok {
+		return nil, fmt.Errorf("default_locale: 没有语言 %q 的消息目录 (可选 %s)", defaultLocale, strings.Join(c.locales(), ", "))
+	}
+	return c, nil
+}
+
+// merge 读取 fsys 中 dir 目录下的 *.json，文件名 (不含扩展名) 就是语言
+func (c *catalog) merge(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, dir+"/*.json")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		locale := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if c.messages[locale] == nil {
+			c.messages[locale] = make(map[string]string)
+		}
+		for key, text := range messages {
+			c.messages[locale][key] = text
+		}
+	}
+	return nil
+}
+
+// locales 返回目录中的所有语言，用于 Discovery 的 ui_locales_supported
+func (c *catalog) locales() []string {
+	list := make([]string, 0, len(c.messages))
+	for locale := range c.messages {
+		list = append(list, locale)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// lookup 返回 key 在 locale 中的文字，缺少翻译时使用默认语言的文字。两者都没有时返回 false
+func (c *catalog) lookup(locale, key string) (string, bool) {
+	if s, ok := c.messages[locale][key]; ok {
+		return s, true
+	}
+	s, ok := c.messages[c.defaultLocale][key]
+	return s, ok
+}
+
+// text 返回 key 在 locale 中的文字。缺少翻译时依次使用默认语言的文字和 key 本身
+func (c *catalog) text(locale, key string, args ...any) string {
+	s, ok := c.lookup(locale, key)
+	if !ok {
+		s = key
+	}
+	if len(args) > 0 {
+		s = fmt.Sprintf(s, args...)
+	}
+	return s
+}
+
+// html 和 text 相同，但结果用于 HTML: 目录中的文字可以包含标记 (例如 <strong>%s</strong>)，字符串参数会被转义。
+// 不在目录中的 key 不是可信的标记，整个转义后返回
+func (c *catalog) html(locale, key string, args ...any) template.HTML {
+	if _, ok := c.lookup(locale, key); !ok {
+		return template.HTML(html.EscapeString(c.text(locale, key, args...)))
+	}
+	escaped := make([]any, len(args))
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			arg = html.EscapeString(s)
+		}
+		escaped[i] = arg
+	}
+	return template.HTML(c.text(locale, key, escaped...))
+}
+
+// match 返回目录中与语言标签 (例如 en-US) 对应的语言，先完全匹配，再只匹配主语言
+func (c *catalog) match(tag string) (string, bool) {
+	tag = strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+	if _, ok := c.messages[tag]; ok {
+		return tag, true
+	}
+	base, _, _ := strings.Cut(tag, "-")
+	if _, ok := c.messages[base]; ok {
+		return base, true
+	}
+	return "", false
+}
+
+// requestLocale 选择请求使用的语言
+func requestLocale(r *http.Request) string {
+	c := requestRealm(r).currentCatalog()
+	// ui_locales 是授权请求的参数 (空格分隔，按优先级排列)，登录和同意授权页面的地址中都带着它
+	for _, tag := range strings.Fields(r.URL.Query().Get("ui_locales")) {
+		if locale, ok := c.match(tag); ok {
+			return locale
+		}
+	}
+	for _, tag := range acceptLanguages(r.Header.Get("Accept-Language")) {
+		if locale, ok := c.match(tag); ok {
+			return locale
+		}
+	}
+	return c.defaultLocale
+}
+
+// acceptLanguages 解析 Accept-Language 请求头，按 q 值从高到低返回语言标签
+func acceptLanguages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var list []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if tag = strings.TrimSpace(tag); tag != "" && tag != "*" && q > 0 {
+			list = append(list, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].q > list[j].q })
+	tags := make([]string, len(list))
+	for i, w := range list {
+		tags[i] = w.tag
+	}
+	return tags
+}
+
+// translate 按请求的语言翻译消息，用于页面以外的纯文本响应 (例如 http.Error)
+func translate(r *http.Request, key string, args ...any) string {
+	return requestRealm(r).currentCatalog().text(requestLocale(r), key, args...)
+}
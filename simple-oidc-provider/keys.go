@@ -0,0 +1,121 @@
+// keys.go - JWT 签名密钥
+// 当前的签名密钥和轮换下来的旧公钥作为一个整体保存，热加载时整体替换。
+// 旧公钥会继续在 JWKS 中发布并用于验证，这样换了密钥之后，之前签发且尚未过期的令牌仍然有效。
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// maxRetiredKeys 是保留的旧公钥数量
+const maxRetiredKeys = 3
+
+// signingKeys 是某一时刻的密钥集合，创建后不再修改
+type signingKeys struct {
+	current *rsa.PrivateKey
+	keyID   string
+	// retired 是之前使用过的公钥，最新的在前
+	retired []jose.JSONWebKey
+	// rotated 表示当前密钥是通过管理 API 轮换生成的，配置中的 key_id 已经不再对应它
+	rotated bool
+}
+
+// currentKeys 返回 realm 当前生效的密钥集合
+func (rlm *realm) currentKeys() *signingKeys {
+	return rlm.activeKeys.Load()
+}
+
+// nextSigningKeys 计算以 key 为当前签名密钥的新密钥集合，之前的密钥 (如果有变化) 转为旧公钥。
+// prev 为 nil 表示第一次加载。同一个 key_id 不能对应两个不同的密钥，否则客户端缓存的 JWKS 会验证失败
+func nextSigningKeys(prev *signingKeys, key *rsa.PrivateKey, keyID string) (*signingKeys, error) {
+	if prev == nil {
+		return &signingKeys{current: key, keyID: keyID}, nil
+	}
+	if prev.current.Equal(key) {
+		if prev.keyID != keyID {
+			return nil, errors.New("签名密钥没有变化，不能修改 key_id")
+		}
+		return prev, nil
+	}
+	if prev.keyID == keyID {
+		return nil, fmt.Errorf("签名密钥已更换，必须同时使用新的 key_id (当前为 %s)", keyID)
+	}
+
+	retired := []jose.JSONWebKey{publicJWK(&prev.current.PublicKey, prev.keyID)}
+	for _, k := range prev.retired {
+		if k.KeyID != keyID && len(retired) < maxRetiredKeys {
+			retired = append(retired, k)
+		}
+	}
+	return &signingKeys{current: key, keyID: keyID, retired: retired}, nil
+}
+
+// rotateSigningKey 为 realm 生成新的签名密钥并立即使用，当前密钥转为旧公钥继续发布。
+// 只用于没有配置 signing_key_file 的情况: 密钥来自文件时，应该替换文件并修改 key_id 来轮换
+func (rlm *realm) rotateSigningKey() (*signingKeys, error) {
+	prev := rlm.currentKeys()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	suffix, err := generateRandomString(6)
+	if err != nil {
+		return nil, err
+	}
+	keyID := "key-" + time.Now().UTC().Format("20060102-150405") + "-" + suffix
+	next, err := nextSigningKeys(prev, key, keyID)
+	if err != nil {
+		return nil, err
+	}
+	next.rotated = true
+	// 同时有配置热加载替换了密钥时放弃本次轮换，避免覆盖对方的结果
+	if !rlm.activeKeys.CompareAndSwap(prev, next) {
+		return nil, errors.New("签名密钥刚刚被修改，请重试")
+	}
+	return next, nil
+}
+
+// jwks 返回需要发布的所有公钥: 当前密钥在前，然后是旧公钥
+func (k *signingKeys) jwks() jose.JSONWebKeySet {
+	keys := []jose.JSONWebKey{publicJWK(&k.current.PublicKey, k.keyID)}
+	return jose.JSONWebKeySet{Keys: append(keys, k.retired...)}
+}
+
+// publicKey 根据 kid 找到对应的公钥，找不到时返回 nil
+func (k *signingKeys) publicKey(kid string) *rsa.PublicKey {
+	if kid == k.keyID {
+		return &k.current.PublicKey
+	}
+	for _, jwk := range k.retired {
+		if jwk.KeyID == kid {
+			return jwk.Key.(*rsa.PublicKey)
+		}
+	}
+	return nil
+}
+
+// verifyJWT 用 realm 中 JWT 头的 kid 对应的公钥验证签名，并解析声明。其他 realm 的密钥不会被接受
+func (rlm *realm) verifyJWT(tok *jwt.JSONWebToken, claims interface{}) error {
+	key := rlm.currentKeys().publicKey(tok.Headers[0].KeyID)
+	if key == nil {
+		return errors.New("未知的签名密钥")
+	}
+	return tok.Claims(key, claims)
+}
+
+// publicJWK 把 RSA 公钥包装成 JWKS 中的一项
+func publicJWK(key *rsa.PublicKey, keyID string) jose.JSONWebKey {
+	return jose.JSONWebKey{
+		Key:       key,
+		KeyID:     keyID, // 密钥 ID
+		Algorithm: string(jose.RS256),
+		Use:       "sig", // 用于签名
+	}
+}
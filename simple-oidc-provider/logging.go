@@ -0,0 +1,247 @@
+// logging.go - 分级的结构化日志
+// 所有日志都通过 log/slog 输出到标准输出。log.format 选择输出格式:
+// pretty (默认) 适合在终端中阅读，一行一条消息，多行的字段 (例如 JSON) 缩进显示在消息下面；
+// text 是 key=value 格式，json 是每行一个 JSON 对象，方便交给日志系统收集。
+// log.level 是输出的最低级别: debug、info (默认)、warn 或 error。两项设置都可以热加载。
+//
+// 处理请求时使用带 context 的函数 (slog.InfoContext 等) 记录的日志会自动带上请求的 correlation_id、request.method、request.path，
+// 以及当前 span 的 trace_id 和 span_id，可以据此与审计事件和 trace 关联。pretty 格式只显示其中的 correlation_id。
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LogConfig 是日志的设置
+type LogConfig struct {
+	// Format 是输出格式: pretty、text 或 json
+	Format string `yaml:"format"`
+	// Level 是输出的最低级别: debug、info、warn 或 error
+	Level string `yaml:"level"`
+}
+
+// logLevels 是 log.level 可以使用的级别
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogging 按配置替换默认的 slog.Logger。标准库 log 包的输出 (例如 log.Fatal) 也会经过它。
+// cfg 已经验证过，未知的格式按 pretty 处理
+func setupLogging(cfg LogConfig) {
+	opts := &slog.HandlerOptions{Level: logLevels[cfg.Level]}
+	var h slog.Handler
+	switch cfg.Format {
+	case "json":
+		h = slog.NewJSONHandler(os.Stdout, opts)
+	case "text":
+		h = slog.NewTextHandler(os.Stdout, opts)
+	default:
+		h = newPrettyHandler(os.Stdout, opts.Level)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+}
+
+// fatal 以 error 级别记录启动失败的原因，然后退出
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// --- 请求相关的字段 ---
+
+type logAttrsKey struct{}
+
+// withLogAttrs 返回一个新的 context，之后用它记录的日志都带有 attrs
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	return context.WithValue(ctx, logAttrsKey{}, append(slices.Clip(prev), attrs...))
+}
+
+// contextHandler 把 context 中的请求字段和 trace 信息添加到每条日志中
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		rec.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// --- pretty 格式 ---
+
+// prettyHiddenKeys 是 pretty 格式中不显示的请求字段，它们会让每一行都变得很长
+var prettyHiddenKeys = map[string]bool{"request": true, "trace_id": true, "span_id": true}
+
+// prettyHandler 以适合人阅读的格式输出日志: "15:04:05 INFO  消息 key=value"。
+// 多行的值 (包括 json.RawMessage，会被缩进排版) 和字段组显示在消息下面的缩进块中
+type prettyHandler struct {
+	level  slog.Leveler
+	mu     *sync.Mutex
+	w      io.Writer
+	attrs  []slog.Attr // WithAttrs 添加的字段，键已经加上了分组前缀
+	prefix string      // WithGroup 设置的分组前缀，例如 "a.b."
+}
+
+func newPrettyHandler(w io.Writer, level slog.Leveler) *prettyHandler {
+	return &prettyHandler{level: level, mu: &sync.Mutex{}, w: w}
+}
+
+func (h *prettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *prettyHandler) Handle(_ context.Context, rec slog.Record) error {
+	var line, blocks strings.Builder
+	if !rec.Time.IsZero() {
+		line.WriteString(rec.Time.Format("15:04:05 "))
+	}
+	line.WriteString(prettyLevel(rec.Level))
+	line.WriteString(rec.Message)
+	for _, a := range h.attrs {
+		writePrettyAttr(&line, &blocks, "", a)
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		writePrettyAttr(&line, &blocks, h.prefix, a)
+		return true
+	})
+	line.WriteString("\n")
+	line.WriteString(blocks.String())
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line.String())
+	return err
+}
+
+func (h *prettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.attrs = slices.Clip(h.attrs)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		next.attrs = append(next.attrs, a)
+	}
+	return &next
+}
+
+func (h *prettyHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	next := *h
+	next.prefix = h.prefix + name + "."
+	return &next
+}
+
+// prettyLevel 返回固定宽度的级别名称
+func prettyLevel(level slog.Level) string {
+	s := level.String()
+	return s + strings.Repeat(" ", max(6-len(s), 1))
+}
+
+// writePrettyAttr 把单行的字段追加到 line，多行的值和字段组写入 blocks
+func writePrettyAttr(line, blocks *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) || prettyHiddenKeys[a.Key] {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key == "" {
+			// 没有名字的组直接展开
+			for _, ga := range a.Value.Group() {
+				writePrettyAttr(line, blocks, prefix, ga)
+			}
+			return
+		}
+		blocks.WriteString("  " + prefix + a.Key + ":\n")
+		writePrettyGroup(blocks, a.Value.Group(), "    ")
+		return
+	}
+	value := prettyValue(a.Value)
+	if strings.Contains(value, "\n") {
+		blocks.WriteString("  " + prefix + a.Key + ":\n")
+		writeIndented(blocks, value, "    ")
+		return
+	}
+	line.WriteString(" " + prefix + a.Key + "=" + quoteIfNeeded(value))
+}
+
+// writePrettyGroup 把字段组写成 "键: 值" 形式的缩进块
+func writePrettyGroup(b *strings.Builder, attrs []slog.Attr, indent string) {
+	for _, a := range attrs {
+		a.Value = a.Value.Resolve()
+		if a.Value.Kind() == slog.KindGroup {
+			b.WriteString(indent + a.Key + ":\n")
+			writePrettyGroup(b, a.Value.Group(), indent+"  ")
+			continue
+		}
+		value := prettyValue(a.Value)
+		if strings.Contains(value, "\n") {
+			b.WriteString(indent + a.Key + ":\n")
+			writeIndented(b, value, indent+"  ")
+			continue
+		}
+		b.WriteString(indent + a.Key + ": " + value + "\n")
+	}
+}
+
+func writeIndented(b *strings.Builder, value, indent string) {
+	for _, l := range strings.Split(strings.TrimRight(value, "\n"), "\n") {
+		b.WriteString(indent + l + "\n")
+	}
+}
+
+// prettyValue 把值转换为字符串，JSON 会被缩进排版
+func prettyValue(v slog.Value) string {
+	switch v.Kind() {
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339)
+	case slog.KindAny:
+		switch a := v.Any().(type) {
+		case json.RawMessage:
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, a, "", "  "); err == nil {
+				return buf.String()
+			}
+			return string(a)
+		case error:
+			return a.Error()
+		}
+	}
+	return v.String()
+}
+
+// quoteIfNeeded 给包含空格、引号或 = 的值加上引号，让 key=value 的边界清楚
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,346 @@
+// logout.go - 退出登录与 OIDC Back-Channel Logout
+// 用户在 Provider 退出登录时，会话中参与过的每个客户端都应该随之退出。
+// 对于注册了 backchannel_logout_uri 的客户端，我们在服务器之间直接 POST 一个签名的 logout_token，
+// 客户端验证后销毁对应的本地会话。投递失败时会在后台按指数退避重试，投递状态可以通过 /logout/deliveries 查询 (需要管理令牌)。
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// backchannelLogoutEvent 是 logout_token 中 events 声明使用的事件类型
+	backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+	// backchannelMaxAttempts 是每个客户端最多尝试投递的次数
+	backchannelMaxAttempts = 5
+	// backchannelRetryDelay 是第一次重试前的等待时间，之后每次翻倍
+	backchannelRetryDelay = 1 * time.Second
+	// maxLogoutDeliveries 是保留的投递记录数量，超出后丢弃最旧的记录
+	maxLogoutDeliveries = 100
+)
+
+// backchannelHTTPClient 用于向客户端投递 logout_token，超时要短，避免拖慢退出流程
+// 请求会带上 traceparent，使投递出现在发起退出的请求的 trace 中
+var backchannelHTTPClient = &http.Client{Timeout: 5 * time.Second, Transport: otelhttp.NewTransport(http.DefaultTransport)}
+
+// LogoutDelivery 记录向某个客户端投递 logout_token 的状态
+type LogoutDelivery struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"sid"`
+	ClientID  string    `json:"client_id"`
+	URI       string    `json:"uri"`
+	Status    string    `json:"status"` // pending, retrying, delivered 或 failed
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// handleLogout 是 end_session_endpoint (OIDC RP-Initiated Logout): 结束 Provider 会话并通知所有参与的客户端。
+// 支持 id_token_hint、client_id、post_logout_redirect_uri (必须是客户端注册过的地址) 和 state 参数。
+// 只有 id_token_hint 中的 sid 与当前会话相同时才直接退出；否则先请用户确认，
+// 这样其他网站不能通过一个链接让用户退出登录 (logout CSRF)
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	clientID := r.Form.Get("client_id")
+	redirectURI := r.Form.Get("post_logout_redirect_uri")
+	rlm := requestRealm(r)
+
+	// 1. id_token_hint 说明是哪个客户端、哪个会话发起的退出
+	var hint *idTokenHint
+	if raw := r.Form.Get("id_token_hint"); raw != "" {
+		var err error
+		if hint, err = rlm.parseIDTokenHint(raw); err != nil {
+			http.Error(w, "无效的 id_token_hint: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if clientID != "" && clientID != hint.ClientID {
+			http.Error(w, "client_id 与 id_token_hint 不一致", http.StatusBadRequest)
+			return
+		}
+		clientID = hint.ClientID
+	}
+	if redirectURI != "" {
+		client, err := rlm.store.GetClient(clientID)
+		if err != nil || !containsString(client.PostLogoutRedirectURIs, redirectURI) {
+			http.Error(w, "无效的 client_id 或 post_logout_redirect_uri", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// 2. 请求不能证明来自这个会话的客户端时，请用户确认。确认表单提交回同一地址，参数放在查询字符串中
+	if sess := currentSession(r); sess != nil && (hint == nil || hint.Sid == "" || hint.Sid != sess.Sid) {
+		confirmed := r.Method == http.MethodPost && r.PostForm.Get("confirm") != "" && validCSRFToken(r)
+		if !confirmed {
+			params := url.Values{}
+			for _, name := range []string{"client_id", "post_logout_redirect_uri", "state"} {
+				if v := r.Form.Get(name); v != "" {
+					params.Set(name, v)
+				}
+			}
+			if clientID != "" {
+				params.Set("client_id", clientID)
+			}
+			renderPage(w, r, "logout_confirm.html", page{
+				Title:  "title.logout_confirm",
+				Action: appendQuery("/logout", params),
+			})
+			return
+		}
+	}
+
+	// 3. 结束 Provider 会话
+	sess := endSession(w, r)
+	var deliveries []*LogoutDelivery
+	var frontchannelURLs []string
+	if sess != nil {
+		audit(r, AuditEvent{Type: auditLogout, Username: sess.UserID, ClientID: clientID, SessionID: sess.Sid, Detail: "clients=" + strings.Join(sess.Clients, ",")})
+		slog.InfoContext(r.Context(), "用户退出登录", "user_id", sess.UserID, "sid", sess.Sid, "clients", sess.Clients)
+		// 4. 向每个参与的客户端发送 back-channel logout 通知，并准备 front-channel logout 的 iframe
+		frontchannelURLs = rlm.frontchannelLogoutURLs(sess)
+		deliveries = rlm.sendBackchannelLogouts(r.Context(), sess)
+	}
+
+	// 5. 没有需要在浏览器中通知的客户端时，直接重定向回客户端
+	if redirectURI != "" {
+		if state := r.Form.Get("state"); state != "" {
+			redirectURI = appendQuery(redirectURI, url.Values{"state": {state}})
+		}
+		if len(frontchannelURLs) == 0 {
+			http.Redirect(w, r, redirectURI, http.StatusFound)
+			return
+		}
+	}
+
+	// 6. 显示退出结果。front-channel logout 的 iframe 全部加载后 (或超时后) 再重定向
+	// 投递在后台进行，这里复制一份当前的状态用于显示
+	mu.Lock()
+	delivered := make([]LogoutDelivery, len(deliveries))
+	for i, d := range deliveries {
+		delivered[i] = *d
+	}
+	mu.Unlock()
+	renderPage(w, r, "logout.html", page{
+		Title: "title.logout",
+		Data: struct {
+			FrontchannelURLs []string
+			RedirectURI      string
+			TimeoutMillis    int64
+			Deliveries       []LogoutDelivery
+		}{frontchannelURLs, redirectURI, frontchannelLogoutTimeout.Milliseconds(), delivered},
+	})
+}
+
+// idTokenHint 是 id_token_hint 中退出登录用到的声明
+type idTokenHint struct {
+	ClientID string
+	Sid      string
+}
+
+// parseIDTokenHint 验证 id_token_hint 是本 realm 签发的 ID Token。
+// 按照 RP-Initiated Logout 第 2 节，已经过期的 ID Token 也可以作为提示，所以不检查 exp
+func (rlm *realm) parseIDTokenHint(raw string) (*idTokenHint, error) {
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil || len(tok.Headers) != 1 {
+		return nil, errors.New("格式错误")
+	}
+	if typ, _ := tok.Headers[0].ExtraHeaders[jose.HeaderType].(string); typ != "JWT" {
+		return nil, errors.New("不是 ID Token")
+	}
+	var claims struct {
+		Issuer   string       `json:"iss"`
+		Audience jwt.Audience `json:"aud"`
+		Sid      string       `json:"sid"`
+	}
+	if err := rlm.verifyJWT(tok, &claims); err != nil {
+		return nil, errors.New("签名无效")
+	}
+	if claims.Issuer != rlm.issuer || len(claims.Audience) != 1 {
+		return nil, errors.New("不是本 Provider 签发的 ID Token")
+	}
+	return &idTokenHint{ClientID: claims.Audience[0], Sid: claims.Sid}, nil
+}
+
+// handleLogoutDeliveries 以 JSON 形式返回 realm 最近的 back-channel logout 投递状态，可用 ?sid= 过滤。
+// 需要管理令牌 (见 admin.go)
+func handleLogoutDeliveries(w http.ResponseWriter, r *http.Request) {
+	sid := r.URL.Query().Get("sid")
+	rlm := requestRealm(r)
+
+	mu.Lock()
+	result := make([]LogoutDelivery, 0, len(rlm.logoutDeliveries))
+	for _, d := range rlm.logoutDeliveries {
+		if sid == "" || d.SessionID == sid {
+			result = append(result, *d)
+		}
+	}
+	mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// terminateSession 在服务器端结束会话 (例如管理员强制下线)，并向参与的客户端发送 back-channel logout。
+// 浏览器中的 Cookie 下次使用时会因为找不到会话而失效
+func terminateSession(r *http.Request, sess *Session) ([]*LogoutDelivery, error) {
+	rlm := requestRealm(r)
+	if err := rlm.store.DeleteSession(sess.ID); err != nil {
+		return nil, err
+	}
+	audit(r, AuditEvent{Type: auditLogout, Username: sess.UserID, SessionID: sess.Sid, Detail: "terminated by administrator, clients=" + strings.Join(sess.Clients, ",")})
+	slog.InfoContext(r.Context(), "会话已被终止", "sid", sess.Sid, "user_id", sess.UserID, "clients", sess.Clients)
+	return rlm.sendBackchannelLogouts(r.Context(), sess), nil
+}
+
+// sendBackchannelLogouts 并行地向会话中所有注册了 backchannel_logout_uri 的客户端投递 logout_token。
+// 第一次尝试会等待完成，这样退出页面可以直接显示结果；失败的投递在后台继续重试。
+// ctx 是发起退出的请求的 context，投递请求会成为它的 span 的子 span
+func (rlm *realm) sendBackchannelLogouts(ctx context.Context, sess *Session) []*LogoutDelivery {
+	user, err := rlm.store.GetUser(sess.UserID)
+	if err != nil {
+		slog.ErrorContext(ctx, "找不到会话的用户", "sid", sess.Sid, "user_id", sess.UserID, "error", err)
+		return nil
+	}
+
+	var deliveries []*LogoutDelivery
+	var wg sync.WaitGroup
+	for _, clientID := range sess.Clients {
+		client, err := rlm.store.GetClient(clientID)
+		if err != nil || client.BackchannelLogoutURI == "" {
+			continue
+		}
+
+		token, err := rlm.newLogoutToken(client, user.ID, sess.Sid)
+		if err != nil {
+			slog.ErrorContext(ctx, "创建 logout_token 失败", "client_id", clientID, "error", err)
+			continue
+		}
+		d := rlm.recordLogoutDelivery(sess.Sid, client)
+		deliveries = append(deliveries, d)
+
+		wg.Add(1)
+		go func() {
+			delivered := attemptLogoutDelivery(ctx, d, token)
+			wg.Done()
+			if !delivered {
+				// 请求结束后 ctx 会被取消，重试只沿用其中的 trace
+				retryLogoutDelivery(context.WithoutCancel(ctx), d, token)
+			}
+		}()
+	}
+	wg.Wait()
+	return deliveries
+}
+
+// newLogoutToken 创建发给某个客户端的 logout_token (OIDC Back-Channel Logout 第 2.4 节)。
+// 它和 ID Token 很像，但必须包含 events 声明，并且绝不能包含 nonce。
+func (rlm *realm) newLogoutToken(client Client, sub, sid string) (string, error) {
+	jti, err := generateRandomString(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":    rlm.issuer,
+		"aud":    client.ID,
+		"iat":    now.Unix(),
+		"exp":    now.Add(2 * time.Minute).Unix(),
+		"jti":    jti,
+		"sub":    sub,
+		"sid":    sid,
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	}
+	return rlm.signJWT(claims, "logout+jwt")
+}
+
+// recordLogoutDelivery 创建一条投递记录，并在记录过多时丢弃最旧的
+func (rlm *realm) recordLogoutDelivery(sid string, client Client) *LogoutDelivery {
+	id, _ := generateRandomString(8)
+	d := &LogoutDelivery{
+		ID:        id,
+		SessionID: sid,
+		ClientID:  client.ID,
+		URI:       client.BackchannelLogoutURI,
+		Status:    "pending",
+		UpdatedAt: time.Now(),
+	}
+
+	mu.Lock()
+	rlm.logoutDeliveries = append(rlm.logoutDeliveries, d)
+	if len(rlm.logoutDeliveries) > maxLogoutDeliveries {
+		rlm.logoutDeliveries = rlm.logoutDeliveries[len(rlm.logoutDeliveries)-maxLogoutDeliveries:]
+	}
+	mu.Unlock()
+	return d
+}
+
+// attemptLogoutDelivery 进行一次投递并更新记录，客户端返回 200/204 即视为成功
+func attemptLogoutDelivery(ctx context.Context, d *LogoutDelivery, token string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URI, strings.NewReader(url.Values{"logout_token": {token}}.Encode()))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := backchannelHTTPClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+			err = fmt.Errorf("客户端返回 %s", resp.Status)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	d.Attempts++
+	d.UpdatedAt = time.Now()
+	if err != nil {
+		d.LastError = err.Error()
+		d.Status = "retrying"
+		if d.Attempts >= backchannelMaxAttempts {
+			d.Status = "failed"
+		}
+		return false
+	}
+	d.Status = "delivered"
+	d.LastError = ""
+	return true
+}
+
+// retryLogoutDelivery 按指数退避重试投递，直到成功或达到最大次数
+func retryLogoutDelivery(ctx context.Context, d *LogoutDelivery, token string) {
+	delay := backchannelRetryDelay
+	for attempt := 2; attempt <= backchannelMaxAttempts; attempt++ {
+		time.Sleep(delay)
+		delay *= 2
+		if attemptLogoutDelivery(ctx, d, token) {
+			slog.InfoContext(ctx, "back-channel logout 已投递", "client_id", d.ClientID, "attempt", attempt)
+			return
+		}
+	}
+	mu.Lock()
+	lastErr := d.LastError
+	mu.Unlock()
+	slog.WarnContext(ctx, "back-channel logout 投递失败", "client_id", d.ClientID, "error", lastErr)
+}
+
+// appendQuery 向 URI 追加查询参数，保留其中已有的参数
+func appendQuery(uri string, params url.Values) string {
+	sep := "?"
+	if strings.Contains(uri, "?") {
+		sep = "&"
+	}
+	return uri + sep + params.Encode()
+}
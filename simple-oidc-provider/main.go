@@ -4,13 +4,21 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/square/go-jose.v2"
@@ -20,97 +28,255 @@ import (
 // --- 全局变量和配置 ---
 
 var (
-	// 用于签署 JWT 的 RSA 密钥对。在真实应用中，应从安全位置加载。
-	privateKey *rsa.PrivateKey
-
-	// 我们的 OP 的地址 (颁发者 URL)
-	issuerURL = "http://127.0.0.1:9090"
-
-	// 存储已注册的客户端信息 (代替数据库)
-	clients = map[string]Client{
-		"my-client-app": {
-			ID:           "my-client-app",
-			Secret:       "my-client-secret",
-			RedirectURIs: []string{"http://127.0.0.1:8080/auth/callback"},
+	// 颁发者 URL 和存储属于各个 realm，见 realm.go。
+	// 配置 (客户端、用户、签名密钥、有效期) 可以热加载，见 config.go、keys.go 和 reload.go
+
+	// 内置的演示客户端，配置文件中没有 clients 时使用
+	defaultClients = []Client{
+		{
+			ID:     "my-client-app",
+			Secret: "my-client-secret",
+			// https 的地址供以 -tls-self-signed 等方式启用 TLS 的客户端使用
+			RedirectURIs: []string{"http://127.0.0.1:8080/auth/callback", "https://127.0.0.1:8080/auth/callback"},
+			// 退出登录相关的地址
+			PostLogoutRedirectURIs: []string{"http://127.0.0.1:8080/", "https://127.0.0.1:8080/"},
+			BackchannelLogoutURI:   "http://127.0.0.1:8080/backchannel-logout",
+		},
+		// 呼叫中心工具: 通过 CIBA 让用户在自己的设备上确认登录，不需要浏览器重定向
+		{
+			ID:                           "call-center-app",
+			Secret:                       "call-center-secret",
+			BackchannelTokenDeliveryMode: cibaModePoll,
+		},
+		// 一个后端服务: 它收到用户的访问令牌后，可以换取一个只面向 orders-api 的降权令牌
+		{
+			ID:     "my-api-service",
+			Secret: "my-api-secret",
+			TokenExchange: &TokenExchangePolicy{
+				SubjectClients:     []string{"my-client-app"},
+				Audiences:          []string{"orders-api"},
+				AllowImpersonation: true,
+				AllowDelegation:    true,
+			},
 		},
 	}
 
-	// 存储用户信息 (代替数据库)
-	users = map[string]User{
-		"demo": {
+	// 内置的演示用户，配置文件中没有 users 时使用
+	defaultUsers = []User{
+		{
 			ID:       "user-123",
 			Username: "demo",
-			Password: "password", // 在真实应用中，请务必使用哈希存储！
+			Password: "password", // 写入存储前会被转换为 argon2id 哈希
 			Name:     "本地认证的用户",
 			Email:    "demo.user@example.com",
 			Picture:  "https://www.gravatar.com/avatar/?d=mp", // 一个默认头像
 		},
 	}
 
-	// 存储授权码 (代替数据库或 Redis)
-	authCodes = make(map[string]AuthCodeData)
-	mu        sync.Mutex
+	// mu 保护各个 realm 在进程内存中的短期状态 (兑换过的授权码、DPoP jti、CIBA 请求等)
+	mu sync.Mutex
 )
 
 // --- 数据结构定义 ---
 
 type Client struct {
-	ID           string
-	Secret       string
-	RedirectURIs []string
+	ID           string   `yaml:"id"`
+	Secret       string   `yaml:"secret"`
+	RedirectURIs []string `yaml:"redirect_uris"`
+	// RequireDPoP 为 true 时，该客户端必须使用 DPoP 证明换取令牌，不再签发 Bearer 令牌
+	RequireDPoP bool `yaml:"require_dpop"`
+	// TokenExchange 控制该客户端可以进行哪些令牌交换，为 nil 时不允许令牌交换
+	TokenExchange *TokenExchangePolicy `yaml:"token_exchange"`
+	// PostLogoutRedirectURIs 是退出登录后允许重定向回去的地址
+	PostLogoutRedirectURIs []string `yaml:"post_logout_redirect_uris"`
+	// BackchannelLogoutURI 是接收 logout_token 的地址，为空时不发送 back-channel logout 通知
+	BackchannelLogoutURI string `yaml:"backchannel_logout_uri"`
+	// FrontchannelLogoutURI 是退出页面通过 iframe 加载的地址 (带 iss 和 sid)，为空时不进行 front-channel logout
+	FrontchannelLogoutURI string `yaml:"frontchannel_logout_uri"`
+	// BackchannelTokenDeliveryMode 是 CIBA 的令牌投递模式 ("poll" 或 "ping")，为空时不允许使用 CIBA
+	BackchannelTokenDeliveryMode string `yaml:"backchannel_token_delivery_mode"`
+	// BackchannelClientNotificationEndpoint 是 ping 模式下用户完成认证后我们回调通知的地址
+	BackchannelClientNotificationEndpoint string `yaml:"backchannel_client_notification_endpoint"`
 }
 
 type User struct {
-	ID       string
-	Username string
-	Password string
-	Name     string
-	Email    string
-	Picture  string
+	ID       string `yaml:"id"`
+	Username string `yaml:"username"`
+	// PasswordHash 是 argon2id 或 bcrypt 格式的密码哈希
+	PasswordHash string `yaml:"password_hash"`
+	// Password 只用于在配置中直接写明文密码 (方便演示)，写入存储前会被转换为哈希，不会被保存
+	Password string `yaml:"password" json:"-"`
+	Name     string `yaml:"name"`
+	Email    string `yaml:"email"`
+	Picture  string `yaml:"picture"`
+	// Claims 是写入 ID Token 和 /userinfo 的自定义声明 (不受 scope 限制)，不能使用标准声明的名称
+	Claims map[string]interface{} `yaml:"claims"`
+	// Admin 表示用户可以登录管理控制台 /admin
+	Admin bool `yaml:"admin"`
+	// TOTPSecret 是 Base32 编码的 TOTP 密钥，为空表示未启用两步验证。通常由用户在 /account/mfa 自行启用
+	TOTPSecret string `yaml:"totp_secret"`
+	// TOTPLastStep 是最近一次使用的验证码的时间步，同一个验证码不能使用两次
+	TOTPLastStep int64 `yaml:"-"`
+	// RecoveryCodes 是尚未使用的恢复码的哈希
+	RecoveryCodes []string `yaml:"-"`
+	// Passkeys 是用户注册的 WebAuthn 通行密钥
+	Passkeys []Passkey `yaml:"-"`
+	// Identities 是用户关联的上游账号，见 broker.go
+	Identities []FederatedIdentity `yaml:"-"`
 }
 
 type AuthCodeData struct {
 	ClientID string
-	UserID   string
-	Expiry   time.Time
+	// RedirectURI 是授权请求中的 redirect_uri，兑换授权码时必须提供同一个值
+	RedirectURI string
+	UserID      string
+	// SessionID 是会话对外的 sid (Session.Sid)，写入 ID Token
+	SessionID string
+	// Nonce 是授权请求中的 nonce，写入 ID Token
+	Nonce string
+	// AMR 是用户登录时完成的认证方式，写入 ID Token 的 amr 和 acr 声明
+	AMR []string
+	// Scope 是用户同意授予的 scope (空格分隔)，决定访问令牌的 scope 和 ID Token 中的声明
+	Scope  string
+	Expiry time.Time
+}
+
+// AccessTokenClaims 是我们签发的 JWT 格式访问令牌中的声明
+type AccessTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	ClientID string `json:"client_id"`
+	Expiry   int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	ID       string `json:"jti"`
+	Scope    string `json:"scope,omitempty"`
+	// Confirmation 只在令牌绑定了 DPoP 密钥时出现
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	// Actor 只在通过令牌交换 (委托) 签发的令牌中出现，表示代表用户行事的一方
+	Actor *ActorClaim `json:"act,omitempty"`
+}
+
+// Confirmation 是 cnf 声明，jkt 为绑定的 DPoP 公钥指纹
+type Confirmation struct {
+	JKT string `json:"jkt"`
 }
 
 // --- 主函数和服务器设置 ---
 
 func main() {
-	var err error
-	// 1. 生成 RSA 密钥对用于 JWT 签名
-	privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	// 1. 加载并验证配置，然后按配置设置日志 (在此之前使用默认的日志设置)
+	setupLogging(defaultConfig().Log)
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("无法加载配置", err)
+	}
+	setupLogging(cfg.Log)
+
+	// 2. 打开每个 realm 的存储，然后让配置生效: 加载 (或生成) 签名密钥，把配置中的客户端和用户写入存储
+	if err := openRealms(cfg); err != nil {
+		fatal("无法打开存储", err)
+	}
+	defer closeRealms()
+	if err := applyConfig(cfg, nil); err != nil {
+		fatal("无法应用配置", err)
+	}
+	if csrfKey, err = generateRandomBytes(32); err != nil {
+		fatal("无法生成 CSRF 密钥", err)
+	}
+	shutdownTracing, err := setupTracing(cfg.Tracing)
 	if err != nil {
-		log.Fatalf("无法生成 RSA 密钥: %v", err)
+		fatal("无法设置追踪", err)
 	}
+	defer shutdownTracing(context.Background())
 
-	// 2. 设置 HTTP 路由
+	// 3. 后台任务: 定期清理过期记录，收到 SIGHUP 或配置文件变化时重新加载配置
+	go runExpiryCleanup(time.Minute)
+	go watchConfig()
+
+	// 4. 设置 HTTP 路由
 	http.HandleFunc("/.well-known/openid-configuration", handleDiscovery)
 	http.HandleFunc("/jwks.json", handleJWKS)
 	http.HandleFunc("/authorize", handleAuthorize)
 	http.HandleFunc("/token", handleToken)
-	http.HandleFunc("/login", handleLoginPage)
-	http.HandleFunc("/consent", handleConsentPage)
-
-	fmt.Println("OIDC Provider (认证服务) 正在监听 " + issuerURL)
-	log.Fatal(http.ListenAndServe(":9090", nil))
+	http.HandleFunc("/userinfo", handleUserInfo)
+	http.HandleFunc("/login", csrfProtect(handleLoginPage))
+	http.HandleFunc("/login/mfa", csrfProtect(handleMFALogin))
+	http.HandleFunc("/consent", csrfProtect(handleConsentPage))
+	http.HandleFunc("/logout", handleLogout)
+	http.HandleFunc("/logout/deliveries", requireAdmin(handleLogoutDeliveries))
+	http.HandleFunc("/check-session", handleCheckSession)
+	http.HandleFunc("/bc-authorize", handleBackchannelAuthorize)
+	http.HandleFunc("/ciba", csrfProtect(handleCIBAPage))
+	http.HandleFunc("/account/password", csrfProtect(handleChangePassword))
+	http.HandleFunc("/account/mfa", csrfProtect(handleMFASettings))
+	http.HandleFunc("/account/passkeys", csrfProtect(handlePasskeySettings))
+	http.HandleFunc("/account/consents", csrfProtect(handleConsentSettings))
+	http.HandleFunc("/account/identities", csrfProtect(handleIdentitySettings))
+	http.HandleFunc("GET /broker/{id}/login", handleBrokerLogin)
+	http.HandleFunc("GET /broker/{id}/callback", handleBrokerCallback)
+	registerConsoleRoutes()
+	http.HandleFunc("/webauthn/register/begin", handlePasskeyRegisterBegin)
+	http.HandleFunc("/webauthn/register/finish", handlePasskeyRegisterFinish)
+	http.HandleFunc("/webauthn/login/begin", handlePasskeyLoginBegin)
+	http.HandleFunc("/webauthn/login/finish", handlePasskeyLoginFinish)
+	http.HandleFunc("/login/mfa/passkey/begin", handlePasskeySecondFactorBegin)
+	http.HandleFunc("/login/mfa/passkey/finish", handlePasskeySecondFactorFinish)
+	http.HandleFunc("/theme/", handleThemeStatic)
+	http.HandleFunc("GET /metrics", handleMetrics)
+	http.HandleFunc("GET /healthz", handleHealthz)
+	http.HandleFunc("GET /readyz", handleReadyz)
+	registerAdminRoutes()
+	// 中间件由外到内: 追踪 span、关联 ID、找到 realm 并去掉路径前缀、指标，最里层在路由匹配后给 span 命名
+	handler := withTracing(withCorrelationID(withRealm(withMetrics(withRouteSpan(http.DefaultServeMux)))))
+
+	// 5. 启动 HTTP 服务器，收到 SIGTERM 或 SIGINT 后等待进行中的请求完成再退出，
+	// 然后由上面的 defer 输出缓冲中的 span 并关闭各个 realm 的存储
+	srv, err := newServer(cfg, handler)
+	if err != nil {
+		fatal("无法创建 HTTP 服务器", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	slog.Info("OIDC Provider (认证服务) 正在监听", "listen", cfg.Listen, "issuer", cfg.Issuer, "realms", len(cfg.Realms), "store", cfg.Store.Type, "tls", cfg.TLS.enabled())
+	if err := runServer(ctx, srv, cfg.TLS, cfg.Server.ShutdownTimeout); err != nil {
+		fatal("HTTP 服务器已停止", err)
+	}
 }
 
 // --- OIDC 核心端点实现 ---
 
-// Endpoint 1: Discovery - 告诉客户端其他端点的位置
+// Endpoint 1: Discovery - 告诉客户端其他端点的位置。每个 realm 有自己的颁发者和端点
 func handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	issuer := rlm.issuer
 	discovery := map[string]interface{}{
-		"issuer":                 issuerURL,
-		"authorization_endpoint": issuerURL + "/authorize",
-		"token_endpoint":         issuerURL + "/token",
-		"jwks_uri":               issuerURL + "/jwks.json",
-		"userinfo_endpoint":      issuerURL + "/userinfo", // (本 Demo 未实现)
-		"response_types_supported": []string{"code"},
-		"subject_types_supported":  []string{"public"},
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks.json",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
 		"id_token_signing_alg_values_supported": []string{"RS256"},
 		// RS256 是我们使用的签名算法: RSA SHA-256
+		"dpop_signing_alg_values_supported":          dpopSigningAlgs,
+		"grant_types_supported":                      []string{"authorization_code", grantTypeTokenExchange, grantTypeCIBA},
+		"end_session_endpoint":                       issuer + "/logout",
+		"backchannel_logout_supported":               true,
+		"backchannel_logout_session_supported":       true,
+		"frontchannel_logout_supported":              true,
+		"frontchannel_logout_session_supported":      true,
+		"check_session_iframe":                       issuer + "/check-session",
+		"backchannel_authentication_endpoint":        issuer + "/bc-authorize",
+		"backchannel_token_delivery_modes_supported": []string{cibaModePoll, cibaModePing},
+		"backchannel_user_code_parameter_supported":  false,
+		"acr_values_supported":                       []string{acrPassword, acrMFA, acrFederated},
+		"ui_locales_supported":                       rlm.currentCatalog().locales(),
+		"scopes_supported":                           supportedScopes,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(discovery)
@@ -118,16 +284,8 @@ func handleDiscovery(w http.ResponseWriter, r *http.Request) {
 
 // Endpoint 2: JWKS - 提供用于验证 JWT 签名的公钥
 func handleJWKS(w http.ResponseWriter, r *http.Request) {
-	publicKey := &privateKey.PublicKey
-	jwk := jose.JSONWebKey{
-		Key:       publicKey,
-		KeyID:     "my-signing-key-id", // 密钥 ID
-		Algorithm: string(jose.RS256),
-		Use:       "sig", // 用于签名
-	}
-	jwks := jose.JSONWebKeySet{
-		Keys: []jose.JSONWebKey{jwk},
-	}
+	// 除了当前的签名密钥，还包括轮换下来的旧公钥，之前签发的令牌仍然可以被验证
+	jwks := requestRealm(r).currentKeys().jwks()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(jwks)
 }
@@ -136,169 +294,503 @@ func handleJWKS(w http.ResponseWriter, r *http.Request) {
 // 第一次重定向目的地, 验证客户端 ID 和重定向 URI
 // 触发第二次重定向, 重定向到登录页面
 func handleAuthorize(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()  // 1. 解析查询参数
-	clientID := q.Get("client_id")
-	redirectURI := q.Get("redirect_uri")
-	
-	// 验证客户端 ID 和重定向 URI 是否已注册
-	if client, ok := clients[clientID]; !ok || !isValidRedirectURI(client, redirectURI) {
-		http.Error(w, "无效的 client_id 或 redirect_uri", http.StatusBadRequest)
+	rlm := requestRealm(r)
+
+	// 验证客户端 ID、重定向 URI 和 scope
+	if !checkAuthorizationRequest(w, r) {
+		return
+	}
+
+	// 用户已经在 Provider 登录过 (SSO)，直接进入同意授权页面
+	if currentSession(r) != nil {
+		rlm.redirect(w, r, "/consent?"+r.URL.RawQuery)
 		return
 	}
 
 	// 重定向到登录页面，并将所有原始查询参数（如 state, scope 等）都传递过去
-	loginURL := fmt.Sprintf("/login?%s", r.URL.RawQuery)
-	fmt.Printf("重定向用户到登录页面 %s\n", loginURL)
+	loginURL := rlm.path(fmt.Sprintf("/login?%s", r.URL.RawQuery))
+	slog.DebugContext(r.Context(), "重定向用户到登录页面", "url", loginURL)
 	http.Redirect(w, r, loginURL, http.StatusFound)
 }
 
-// Endpoint 4: Token - 客户端用授权码换取 ID Token
+// Endpoint 4: Token - 客户端用授权码换取 ID Token，或用已有令牌换取新令牌 (Token Exchange)
 func handleToken(w http.ResponseWriter, r *http.Request) {
 	// 1. 解析表单参数
 	err := r.ParseForm()
 	if err != nil {
-		http.Error(w, "无法解析表单", http.StatusBadRequest)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "无法解析表单")
 		return
 	}
-	code := r.PostForm.Get("code")
 	clientID := r.PostForm.Get("client_id")
 	clientSecret := r.PostForm.Get("client_secret")
+	rlm := requestRealm(r)
 
 	// 2. 验证客户端凭据
-	client, ok := clients[clientID]
-	if !ok || client.Secret != clientSecret {
-		http.Error(w, "无效的客户端凭据", http.StatusUnauthorized)
+	client, err := rlm.store.GetClient(clientID)
+	if err != nil || !secretsEqual(client.Secret, clientSecret) {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "无效的客户端凭据")
 		return
 	}
 
-	// 3. 验证授权码 (Authorization Code)
-	mu.Lock()
-	authData, ok := authCodes[code]
-	delete(authCodes, code) // 授权码是一次性的，用完即删
-	mu.Unlock()
-
-	if !ok || authData.ClientID != clientID || time.Now().After(authData.Expiry) {
-		http.Error(w, "无效或已过期的授权码", http.StatusBadRequest)
+	// 2.1 如果带有 DPoP 证明，先验证它；签发的令牌将绑定到证明中的公钥
+	proof, err := validateDPoPProof(r, rlm.issuer+"/token", "")
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_dpop_proof", err.Error())
+		return
+	}
+	if proof == nil && client.RequireDPoP {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_dpop_proof", "该客户端必须使用 DPoP")
 		return
 	}
 
-	// 4. 获取授权的用户信息
-	user, ok := users[authData.UserID]
-	if !ok {
-		http.Error(w, "找不到用户", http.StatusInternalServerError)
+	// 3. 根据 grant_type 分发到不同的授权类型
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case "authorization_code", "":
+		handleAuthorizationCodeGrant(w, r, client, proof)
+	case grantTypeTokenExchange:
+		handleTokenExchange(w, r, client, proof)
+	case grantTypeCIBA:
+		handleCIBAGrant(w, r, client, proof)
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "不支持的 grant_type: "+grantType)
+	}
+}
+
+// handleAuthorizationCodeGrant 处理授权码模式: 用一次性的授权码换取 ID Token 和访问令牌
+func handleAuthorizationCodeGrant(w http.ResponseWriter, r *http.Request, client Client, proof *dpopProof) {
+	code := r.PostForm.Get("code")
+	rlm := requestRealm(r)
+
+	// 1. 验证授权码 (Authorization Code)
+	authData, err := rlm.store.TakeAuthCode(code) // 授权码是一次性的，用完即删
+	if err != nil {
+		// 已经兑换过的授权码再次出现，说明它可能被窃取: 撤销用它签发的访问令牌 (RFC 6749 第 4.1.2 节)
+		if redeemed, ok := rlm.takeRedeemedCode(code); ok {
+			audit(r, AuditEvent{Type: auditCodeReplayed, Username: redeemed.UserID, ClientID: client.ID, SessionID: redeemed.SessionID, Detail: "revoking jti=" + redeemed.TokenID})
+			revokeToken(r, redeemed.TokenID, "code replayed")
+		} else {
+			audit(r, AuditEvent{Type: auditCodeRejected, ClientID: client.ID, Detail: "unknown code"})
+		}
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "无效或已过期的授权码")
+		return
+	}
+	redirectURI := r.PostForm.Get("redirect_uri")
+	if authData.ClientID != client.ID || redirectURI != authData.RedirectURI || time.Now().After(authData.Expiry) {
+		reason := "expired"
+		if authData.ClientID != client.ID {
+			reason = "issued to client " + authData.ClientID
+		} else if redirectURI != authData.RedirectURI {
+			reason = "redirect_uri mismatch"
+		}
+		audit(r, AuditEvent{Type: auditCodeRejected, Username: authData.UserID, ClientID: client.ID, SessionID: authData.SessionID, Detail: reason})
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "无效或已过期的授权码")
 		return
 	}
 
-	// 5. 创建并签名 ID Token (JWT)
-	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: privateKey}, (&jose.SignerOptions{}).WithType("JWT"))
+	// 2. 获取授权的用户信息
+	user, err := rlm.store.GetUser(authData.UserID)
 	if err != nil {
-		http.Error(w, "创建签名器失败: "+err.Error(), http.StatusInternalServerError)
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "找不到用户")
 		return
 	}
 
-	claims := map[string]interface{}{
-		"iss":     issuerURL,
-		"sub":     user.ID,
-		"aud":     clientID,
-		"exp":     time.Now().Add(1 * time.Hour).Unix(),
-		"iat":     time.Now().Unix(),
-		"name":    user.Name,
-		"email":   user.Email,
-		"picture": user.Picture,
+	// 3. 签发 ID Token 和访问令牌，并记住授权码已经兑换过，以便发现重放
+	audit(r, AuditEvent{Type: auditCodeRedeemed, Username: user.Username, ClientID: client.ID, SessionID: authData.SessionID})
+	if jti := writeTokenResponse(w, r, user, client, authData.SessionID, authData.Nonce, authData.AMR, authData.Scope, proof); jti != "" {
+		rlm.rememberRedeemedCode(code, authData, jti)
 	}
+}
+
+// RedeemedCode 是已经兑换过的授权码，用于发现授权码重放
+type RedeemedCode struct {
+	UserID    string
+	SessionID string
+	// TokenID 是兑换时签发的访问令牌的 jti，授权码被重放时撤销它
+	TokenID string
+	Expiry  time.Time
+}
+
+// rememberRedeemedCode 记录兑换过的授权码，保留到签发的访问令牌过期
+func (rlm *realm) rememberRedeemedCode(code string, data AuthCodeData, tokenID string) {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	for k, c := range rlm.redeemedCodes {
+		if now.After(c.Expiry) {
+			delete(rlm.redeemedCodes, k)
+		}
+	}
+	rlm.redeemedCodes[code] = RedeemedCode{
+		UserID:    data.UserID,
+		SessionID: data.SessionID,
+		TokenID:   tokenID,
+		Expiry:    now.Add(rlm.currentConfig().Lifetimes.AccessToken),
+	}
+}
 
-	rawJWT, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+// takeRedeemedCode 返回并删除兑换过的授权码的记录，同一次窃取只需要处理一次
+func (rlm *realm) takeRedeemedCode(code string) (RedeemedCode, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	c, ok := rlm.redeemedCodes[code]
+	delete(rlm.redeemedCodes, code)
+	return c, ok && time.Now().Before(c.Expiry)
+}
+
+// writeTokenResponse 为用户签发 ID Token 和访问令牌并写入响应，授权码模式和 CIBA 共用。
+// sessionID 和 nonce 不为空时，ID Token 中会包含 sid 和 nonce 声明；amr 是用户完成的认证方式；
+// scope 是用户授予的 scope，ID Token 只包含这些 scope 对应的用户声明。
+// 返回访问令牌的 jti，签发失败 (已经写入了错误响应) 时返回空字符串
+func writeTokenResponse(w http.ResponseWriter, r *http.Request, user User, client Client, sessionID, nonce string, amr []string, scope string, proof *dpopProof) string {
+	// 1. 创建并签名 ID Token (JWT)
+	rlm := requestRealm(r)
+	claims := userClaims(user, scope)
+	claims["iss"] = rlm.issuer
+	claims["aud"] = client.ID
+	claims["exp"] = time.Now().Add(rlm.currentConfig().Lifetimes.IDToken).Unix()
+	claims["iat"] = time.Now().Unix()
+	if sessionID != "" {
+		claims["sid"] = sessionID
+	}
+	// 授权请求带有 nonce 时原样放入 ID Token，客户端 (例如作为上游时的 broker.go) 用它防止重放
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	// 之前的版本创建的会话没有记录认证方式，它们只验证了密码
+	if len(amr) == 0 {
+		amr = []string{amrPassword}
+	}
+	claims["amr"] = amr
+	claims["acr"] = acrForAMR(amr)
+
+	rawJWT, err := rlm.signJWT(claims, "JWT")
 	if err != nil {
 		http.Error(w, "创建 JWT 失败: "+err.Error(), http.StatusInternalServerError)
-		return
+		return ""
+	}
+
+	// 2. 创建访问令牌 (同样是 JWT)
+	accessToken, tokenType, jti, err := issueAccessToken(r, AccessTokenClaims{
+		Subject:  user.ID,
+		Audience: rlm.issuer + "/userinfo",
+		ClientID: client.ID,
+		Scope:    scope,
+	}, proof)
+	if err != nil {
+		http.Error(w, "创建访问令牌失败: "+err.Error(), http.StatusInternalServerError)
+		return ""
 	}
-	
-	// 6. 返回令牌
+
+	// 3. 返回令牌
 	tokenResponse := map[string]interface{}{
-		"access_token": "dummy-access-token-" + fmt.Sprintf("%d", time.Now().UnixNano()),
-		"token_type":   "Bearer",
+		"access_token": accessToken,
+		"token_type":   tokenType,
 		"id_token":     rawJWT,
-		"expires_in":   3600,
+		"expires_in":   int(rlm.currentConfig().Lifetimes.AccessToken.Seconds()),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(tokenResponse)
+	return jti
 }
 
+// Endpoint 5: UserInfo - 客户端用访问令牌获取用户信息
+// 支持 Bearer 和 DPoP 两种方式；绑定了 DPoP 密钥的令牌必须附带对应的 DPoP 证明
+func handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	// 1. 从 Authorization 头中取出令牌和认证方式
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || token == "" || (!strings.EqualFold(scheme, "Bearer") && !strings.EqualFold(scheme, "DPoP")) {
+		writeDPoPChallenge(w, "Bearer", "invalid_token", "缺少访问令牌")
+		return
+	}
+
+	// 2. 验证访问令牌的签名和有效期 (其他 realm 签发的令牌不能通过验证)
+	rlm := requestRealm(r)
+	claims, err := rlm.parseAccessToken(token)
+	if err != nil {
+		writeDPoPChallenge(w, "Bearer", "invalid_token", err.Error())
+		return
+	}
+	// 通过令牌交换换成其他受众 (如 orders-api，缺省为客户端自己) 的令牌不能用来读取用户信息
+	if claims.Audience != rlm.issuer+"/userinfo" {
+		writeDPoPChallenge(w, "Bearer", "invalid_token", "访问令牌的受众不是 userinfo")
+		return
+	}
+
+	// 3. 检查 DPoP 绑定: 绑定的令牌不能降级为 Bearer 使用
+	if claims.Confirmation != nil {
+		if !strings.EqualFold(scheme, "DPoP") {
+			writeDPoPChallenge(w, "DPoP", "invalid_token", "该令牌绑定了 DPoP 密钥，必须使用 DPoP 方式访问")
+			return
+		}
+		proof, err := validateDPoPProof(r, rlm.issuer+"/userinfo", token)
+		if err == nil && proof == nil {
+			err = errors.New("缺少 DPoP 证明")
+		}
+		if err != nil {
+			writeDPoPChallenge(w, "DPoP", "invalid_dpop_proof", err.Error())
+			return
+		}
+		if proof.JKT != claims.Confirmation.JKT {
+			writeDPoPChallenge(w, "DPoP", "invalid_dpop_proof", "DPoP 证明的公钥与令牌绑定的公钥不一致")
+			return
+		}
+	} else if strings.EqualFold(scheme, "DPoP") {
+		writeDPoPChallenge(w, "Bearer", "invalid_token", "该令牌没有绑定 DPoP 密钥")
+		return
+	}
+
+	// 4. 返回令牌的 scope 允许的用户信息
+	user, ok := rlm.findUserByID(claims.Subject)
+	if !ok {
+		writeDPoPChallenge(w, "Bearer", "invalid_token", "找不到用户")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userClaims(user, claims.Scope))
+}
 
 // --- 辅助页面和函数 ---
 
 // Page 1: 登录页面
 func handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
 	if r.Method == http.MethodGet {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		// GET 请求的参数保持在表单的 action 中
-		fmt.Fprintf(w, `
-			<h2>认证服务登录</h2>
-			<form method="post" action="/login?%s">
-				Username: <input type="text" name="username" value="demo"><br>
-				Password: <input type="password" name="password" value="password"><br>
-				<input type="submit" value="登录">
-			</form>
-		`, r.URL.RawQuery)
+		// GET 请求的参数保持在表单的 action 中 (默认就是当前地址)
+		renderPage(w, r, "login.html", page{
+			Title: "title.login",
+			Data: struct {
+				PasskeyFinishURL  string
+				IdentityProviders []brokerButton
+			}{rlm.path("/webauthn/login/finish?" + r.URL.RawQuery), rlm.brokerButtons(r)},
+		})
 		return
 	}
 
 	// 处理登录逻辑
-	r.ParseForm()  // 解析表单数据
+	r.ParseForm() // 解析表单数据
 	username := r.PostForm.Get("username")
 	password := r.PostForm.Get("password")
-	
-	user, ok := users[username]
-	if !ok || user.Password != password {
-		http.Error(w, "无效的用户名或密码", http.StatusUnauthorized)
+	ip := clientIP(r)
+
+	// 该用户名或 IP 最近失败太多次: 在验证密码之前就拒绝，见 throttle.go
+	if loginThrottled(w, r, username) {
+		return
+	}
+
+	user, err := rlm.store.GetUser(username)
+	if err != nil {
+		// 用户不存在时也计算一次哈希，让响应时间和密码错误时一样
+		verifyPassword(dummyPasswordHash, password)
+		failLogin(w, r, username, ip, "unknown_user")
+		return
+	}
+	ok, needsRehash := verifyPassword(user.PasswordHash, password)
+	if !ok {
+		failLogin(w, r, username, ip, "bad_password")
+		return
+	}
+	// 哈希使用的是旧算法或旧参数 (例如 bcrypt)，趁现在知道明文密码，用当前参数重新计算
+	if needsRehash {
+		if user.PasswordHash, err = hashPassword(password); err == nil {
+			err = rlm.store.SaveUser(user)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "升级用户的密码哈希失败", "username", username, "error", err)
+		} else {
+			slog.InfoContext(r.Context(), "已将用户的密码哈希升级为当前参数", "username", username)
+		}
+	}
+
+	// 用户启用了两步验证: 先不创建会话，转到第二步输入验证码或使用通行密钥。
+	// 失败记录要等第二步也通过后才清除，否则每次重新输入密码都能再猜几次验证码
+	if user.hasSecondFactor() {
+		audit(r, AuditEvent{Type: auditLoginSuccess, Username: username, IP: ip, Detail: "password verified, second factor required"})
+		if err := rlm.startMFAChallenge(w, username, "", amrPassword); err != nil {
+			http.Error(w, "创建验证失败", http.StatusInternalServerError)
+			return
+		}
+		rlm.redirect(w, r, "/login/mfa?"+r.URL.RawQuery)
+		return
+	}
+
+	// 登录成功，创建 Provider 会话，然后重定向到同意页面
+	// (从其他 Provider 页面如 /ciba 跳转来登录的，登录后返回原页面)
+	rlm.recordLoginSuccess(username)
+	sess, err := rlm.createSession(w, username, []string{amrPassword})
+	if err != nil {
+		http.Error(w, "创建会话失败", http.StatusInternalServerError)
 		return
 	}
+	audit(r, AuditEvent{Type: auditLoginSuccess, Username: username, SessionID: sess.Sid, IP: ip, Detail: "amr=" + amrPassword})
+	nextURL := loginNextURL(r)
+	slog.InfoContext(r.Context(), "用户登录成功", "username", username, "redirect", nextURL)
+	rlm.redirect(w, r, nextURL)
+}
+
+// failLogin 记录一次失败的登录并返回 401。用户名不存在和密码错误的响应完全相同，原因只写入审计事件
+func failLogin(w http.ResponseWriter, r *http.Request, username, ip, reason string) {
+	recordFailedLogin(r, AuditEvent{Username: username, IP: ip, Detail: reason})
+	http.Error(w, translate(r, "login.invalid"), http.StatusUnauthorized)
+}
 
-	// 登录成功，重定向到同意页面
-	consentURL := fmt.Sprintf("/consent?%s", r.URL.RawQuery)
-	fmt.Printf("用户 %s 登录成功，重定向到同意授权页面 %s\n", username, consentURL)
-	http.Redirect(w, r, consentURL, http.StatusFound)
+// loginThrottled 检查用户名和请求的 IP 是否因为最近失败太多次而被限制，被限制时写入审计事件、返回 429 和 true。
+// 密码、第二步验证码和停用两步验证时输入的验证码共用同一份失败记录
+func loginThrottled(w http.ResponseWriter, r *http.Request, username string) bool {
+	ip := clientIP(r)
+	wait, locked := requestRealm(r).checkLoginThrottle(username, ip, time.Now())
+	if wait <= 0 {
+		return false
+	}
+	audit(r, AuditEvent{Type: auditLoginThrottled, Username: username, IP: ip, Detail: fmt.Sprintf("locked=%t retry_after=%s", locked, wait.Round(time.Second))})
+	writeLoginThrottled(w, r, wait, locked)
+	return true
+}
+
+// recordFailedLogin 写入 login.failure 审计事件 (ev 中的 Type 会被覆盖) 并计入登录限制，因这次失败而锁定时另外记录
+func recordFailedLogin(r *http.Request, ev AuditEvent) {
+	ev.Type = auditLoginFailure
+	if ev.IP == "" {
+		ev.IP = clientIP(r)
+	}
+	audit(r, ev)
+	for _, key := range requestRealm(r).recordLoginFailure(ev.Username, ev.IP, time.Now()) {
+		audit(r, AuditEvent{Type: auditLoginLocked, Username: ev.Username, IP: ev.IP, Detail: key})
+		slog.WarnContext(r.Context(), "登录失败次数过多，已锁定", "key", key)
+	}
 }
 
 // Page 2: 同意授权页面
 func handleConsentPage(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
+	rlm := requestRealm(r)
+
+	// 授权请求的参数直接来自浏览器，这里会签发授权码，必须和 /authorize 一样重新验证
+	if !checkAuthorizationRequest(w, r) {
+		return
+	}
+
+	// 必须先登录
+	sess := currentSession(r)
+	if sess == nil {
+		rlm.redirect(w, r, "/login?"+r.URL.RawQuery)
+		return
+	}
+	// 客户端通过 acr_values 要求多因素认证，而本会话只验证了密码: 先补充验证码
+	if requiresMFA(q.Get("acr_values")) && !isMultiFactor(sess.AMR) {
+		rlm.redirect(w, r, "/login/mfa?"+r.URL.RawQuery)
+		return
+	}
+
+	clientID := q.Get("client_id")
+	requested := requestedScopes(q.Get("scope"))
+	grant, err := rlm.findGrant(sess.UserID, clientID)
+	if err != nil {
+		http.Error(w, "读取授权失败", http.StatusInternalServerError)
+		return
+	}
 
 	if r.Method == http.MethodGet {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprintf(w, `
-			<h2>授权请求</h2>
-			<p>应用 <strong>%s</strong> 希望访问您的基本信息 (姓名, 邮箱, 头像)。</p>
-			<form method="post" action="/consent?%s">
-				<input type="submit" name="action" value="同意授权" style="background-color: #4CAF50; color: white; padding: 10px 20px; border: none; cursor: pointer;">
-				<input type="submit" name="action" value="拒绝" style="padding: 10px 20px; cursor: pointer;">
-			</form>
-		`, q.Get("client_id"), r.URL.RawQuery)
+		// 请求的 scope 都已经授权过: 不再询问用户 (除非客户端用 prompt=consent 要求重新确认)
+		if len(grant.missingScopes(requested)) == 0 && !containsString(strings.Fields(q.Get("prompt")), "consent") {
+			slog.InfoContext(r.Context(), "用户之前已授权客户端，跳过同意授权页面", "user_id", sess.UserID, "client_id", clientID, "scopes", requested)
+			issueAuthCode(w, r, sess, requested)
+			return
+		}
+		renderPage(w, r, "consent.html", page{
+			Title: "title.consent",
+			Data: struct {
+				ClientID string
+				Scopes   []consentScope
+			}{clientID, consentScopes(grant, requested)},
+		})
 		return
 	}
 
-	// 用户点击"同意授权"
+	// 用户点击"同意授权"。按钮的 value 是固定的 approve / deny，与页面语言无关
 	r.ParseForm()
-	if r.FormValue("action") == "同意授权" {
-		code := "code-" + fmt.Sprintf("%d", time.Now().UnixNano()) // 简单生成 code
-		// go 中的 map 并非线程安全的，使用互斥锁来保护
-		// 可用 sync.Map 替代
-		mu.Lock()
-		authCodes[code] = AuthCodeData{
-			ClientID: q.Get("client_id"),
-			UserID:   "demo", // 简化：总是 demo 用户
-			// Expiry: 有效期设置为 5 分钟
-			Expiry:   time.Now().Add(5 * time.Minute),
-		}
-		mu.Unlock()
+	if r.PostForm.Get("action") != "approve" {
+		audit(r, AuditEvent{Type: auditConsentDenied, Username: sess.UserID, ClientID: clientID, SessionID: sess.Sid, Detail: "scope=" + strings.Join(requested, " ")})
+		http.Error(w, translate(r, "consent.denied"), http.StatusForbidden)
+		return
+	}
+	approved := approvedScopes(r, requested)
+	if err := rlm.saveGrant(grant, requested, approved); err != nil {
+		http.Error(w, "保存授权失败", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Type: auditConsentGranted, Username: sess.UserID, ClientID: clientID, SessionID: sess.Sid, Detail: "scope=" + strings.Join(approved, " ")})
+	issueAuthCode(w, r, sess, approved)
+}
+
+// issueAuthCode 为用户授权的 scope 签发授权码，并重定向回客户端。
+// 调用前必须已经用 checkAuthorizationRequest 验证过请求
+func issueAuthCode(w http.ResponseWriter, r *http.Request, sess *Session, scopes []string) {
+	q := r.URL.Query()
+	rlm := requestRealm(r)
+	if !containsString(scopes, "openid") {
+		http.Error(w, "scope 中必须包含 openid", http.StatusBadRequest)
+		return
+	}
+	// 授权码必须无法猜测，并且同时签发的授权码不能重复
+	code, err := generateRandomString(24)
+	if err != nil {
+		http.Error(w, "生成授权码失败", http.StatusInternalServerError)
+		return
+	}
+	code = "code-" + code
+	err = rlm.store.SaveAuthCode(code, AuthCodeData{
+		ClientID:    q.Get("client_id"),
+		RedirectURI: q.Get("redirect_uri"),
+		Nonce:       q.Get("nonce"),
+		UserID:      sess.UserID,
+		SessionID:   sess.Sid,
+		AMR:         sess.AMR,
+		Scope:       strings.Join(scopes, " "),
+		// Expiry: 有效期由配置决定，默认 5 分钟
+		Expiry: time.Now().Add(rlm.currentConfig().Lifetimes.AuthCode),
+	})
+	if err != nil {
+		http.Error(w, "保存授权码失败", http.StatusInternalServerError)
+		return
+	}
+	// 记录该客户端参与了本会话，退出登录时需要通知它
+	if err := rlm.addSessionClient(sess, q.Get("client_id")); err != nil {
+		http.Error(w, "保存会话失败", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Type: auditCodeIssued, Username: sess.UserID, ClientID: q.Get("client_id"), SessionID: sess.Sid, Detail: "scope=" + strings.Join(scopes, " ")})
 
-		// 重定向回客户端应用的回调地址，并带上 code 和 state
-		redirectURI := fmt.Sprintf("%s?code=%s&state=%s", q.Get("redirect_uri"), code, q.Get("state"))
-		fmt.Printf("用户同意授权，重定向到客户端应用: %s\n", redirectURI)
-		http.Redirect(w, r, redirectURI, http.StatusFound)
-	} else {
-		http.Error(w, "用户拒绝授权", http.StatusForbidden)
+	// session_state 让 SPA 可以通过 check_session_iframe 检测 Provider 会话的变化
+	sessionState, err := computeSessionState(q.Get("client_id"), q.Get("redirect_uri"), sess.BrowserState)
+	if err != nil {
+		http.Error(w, "无效的 redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	// 重定向回客户端应用的回调地址，并带上 code、state 和 session_state
+	params := url.Values{"code": {code}, "session_state": {sessionState}}
+	if state := q.Get("state"); state != "" {
+		params.Set("state", state)
 	}
+	redirectURI := appendQuery(q.Get("redirect_uri"), params)
+	slog.InfoContext(r.Context(), "用户同意授权，重定向到客户端应用", "client_id", q.Get("client_id"), "redirect_uri", q.Get("redirect_uri"))
+	http.Redirect(w, r, redirectURI, http.StatusFound)
+}
+
+// checkAuthorizationRequest 验证授权请求: client_id 必须已注册，redirect_uri 必须是它注册过的地址，
+// scope 必须包含 openid。验证失败时返回错误页面 (不重定向到未经验证的地址) 并返回 false
+func checkAuthorizationRequest(w http.ResponseWriter, r *http.Request) bool {
+	q := r.URL.Query()
+	client, err := requestRealm(r).store.GetClient(q.Get("client_id"))
+	if err != nil || !isValidRedirectURI(client, q.Get("redirect_uri")) {
+		http.Error(w, "无效的 client_id 或 redirect_uri", http.StatusBadRequest)
+		return false
+	}
+	if !containsString(strings.Fields(q.Get("scope")), "openid") {
+		http.Error(w, "scope 中必须包含 openid", http.StatusBadRequest)
+		return false
+	}
+	return true
 }
 
 // Helper: 验证重定向 URI 是否合法
@@ -309,4 +801,175 @@ func isValidRedirectURI(client Client, uri string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+// Helper: 在 realm 中按用户 ID (即 sub) 查找用户
+func (rlm *realm) findUserByID(id string) (User, bool) {
+	list, err := rlm.store.ListUsers()
+	if err != nil {
+		return User{}, false
+	}
+	for _, user := range list {
+		if user.ID == id {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// Helper: 用 realm 的私钥签名一个 JWT，typ 为 JWT 头中的类型 (如 "JWT" 或 "at+jwt")
+func (rlm *realm) signJWT(claims interface{}, typ string) (string, error) {
+	keys := rlm.currentKeys()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: keys.current},
+		(&jose.SignerOptions{}).WithType(jose.ContentType(typ)).WithHeader("kid", keys.keyID),
+	)
+	if err != nil {
+		return "", fmt.Errorf("创建签名器失败: %v", err)
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// Helper: 补全访问令牌的通用声明 (iss/iat/exp/jti) 并签名。
+// 使用 DPoP 时通过 cnf.jkt 绑定客户端的公钥，返回的令牌类型为 "DPoP"，否则为 "Bearer"
+// 返回令牌、令牌类型和 jti，并记录审计事件 token.issued
+func issueAccessToken(r *http.Request, claims AccessTokenClaims, proof *dpopProof) (string, string, string, error) {
+	rlm := requestRealm(r)
+	now := time.Now()
+	claims.Issuer = rlm.issuer
+	claims.IssuedAt = now.Unix()
+	claims.Expiry = now.Add(rlm.currentConfig().Lifetimes.AccessToken).Unix()
+	// jti 用于令牌记录、撤销和 DPoP 绑定，使用随机值，避免被猜到或在同一时刻重复
+	jti, err := generateRandomString(16)
+	if err != nil {
+		return "", "", "", err
+	}
+	claims.ID = "at-" + jti
+
+	tokenType := "Bearer"
+	if proof != nil {
+		tokenType = "DPoP"
+		claims.Confirmation = &Confirmation{JKT: proof.JKT}
+	}
+	token, err := rlm.signJWT(claims, "at+jwt")
+	if err != nil {
+		return "", "", "", err
+	}
+	// 记录签发的令牌，/userinfo 只接受存储中还有记录的令牌
+	err = rlm.store.SaveToken(TokenRecord{
+		ID:       claims.ID,
+		ClientID: claims.ClientID,
+		Subject:  claims.Subject,
+		Scope:    claims.Scope,
+		IssuedAt: now,
+		Expiry:   time.Unix(claims.Expiry, 0),
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+	// 省略 grant_type 的请求按授权码模式处理
+	grantType := r.PostForm.Get("grant_type")
+	if grantType == "" {
+		grantType = "authorization_code"
+	}
+	grantsIssued.inc(grantType)
+	audit(r, AuditEvent{
+		Type:     auditTokenIssued,
+		Subject:  claims.Subject,
+		ClientID: claims.ClientID,
+		Detail:   fmt.Sprintf("jti=%s grant_type=%s token_type=%s scope=%s", claims.ID, grantType, tokenType, claims.Scope),
+	})
+	return token, tokenType, claims.ID, nil
+}
+
+// revokeToken 撤销一个访问令牌并记录审计事件 token.revoked，reason 说明撤销的原因。令牌不存在时返回 errNotFound
+func revokeToken(r *http.Request, jti, reason string) error {
+	rlm := requestRealm(r)
+	token, err := rlm.store.GetToken(jti)
+	if err != nil {
+		return err
+	}
+	if err := rlm.store.DeleteToken(jti); err != nil {
+		return err
+	}
+	audit(r, AuditEvent{Type: auditTokenRevoked, Subject: token.Subject, ClientID: token.ClientID, Detail: fmt.Sprintf("jti=%s reason=%s", jti, reason)})
+	return nil
+}
+
+// revokeTokens 撤销客户端代表用户 (subject 即 sub) 持有的全部访问令牌，参数为空时匹配任意值。
+// 有令牌被撤销时记录一条审计事件 token.revoked，返回撤销的数量
+func revokeTokens(r *http.Request, subject, clientID, reason string) (int, error) {
+	n, err := requestRealm(r).store.DeleteTokens(subject, clientID)
+	if n > 0 {
+		audit(r, AuditEvent{Type: auditTokenRevoked, Subject: subject, ClientID: clientID, Detail: fmt.Sprintf("count=%d reason=%s", n, reason)})
+	}
+	return n, err
+}
+
+// Helper: 验证 realm 签发的访问令牌，返回其中的声明
+func (rlm *realm) parseAccessToken(raw string) (*AccessTokenClaims, error) {
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil || len(tok.Headers) != 1 {
+		return nil, errors.New("访问令牌格式错误")
+	}
+	// 通过 typ 区分访问令牌和 ID Token，防止把 ID Token 当作访问令牌使用
+	if typ, _ := tok.Headers[0].ExtraHeaders[jose.HeaderType].(string); typ != "at+jwt" {
+		return nil, errors.New("不是访问令牌")
+	}
+	var claims AccessTokenClaims
+	if err := rlm.verifyJWT(tok, &claims); err != nil {
+		return nil, errors.New("访问令牌签名无效")
+	}
+	if claims.Issuer != rlm.issuer || time.Now().Unix() > claims.Expiry {
+		return nil, errors.New("访问令牌无效或已过期")
+	}
+	if _, err := rlm.store.GetToken(claims.ID); err != nil {
+		return nil, errors.New("访问令牌已失效")
+	}
+	return &claims, nil
+}
+
+// Helper: 以 JSON 格式返回 OAuth2 错误响应 (RFC 6749 第 5.2 节)
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	oauthErrors.inc(code)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// Helper: 判断字符串切片中是否包含某个值
+func containsString(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper: 生成一个 URL 安全的随机字符串
+func generateRandomString(length int) (string, error) {
+	b, err := generateRandomBytes(length)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Helper: 生成指定长度的随机字节
+func generateRandomBytes(length int) ([]byte, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Helper: 判断是否为本站的相对路径，防止 return_to 被用作开放重定向
+func isLocalPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
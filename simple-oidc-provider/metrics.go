@@ -0,0 +1,236 @@
+// metrics.go - Prometheus 格式的运行指标
+// GET /metrics 以 Prometheus 文本格式 (text/plain; version=0.0.4) 输出请求速率、延迟、授权类型、错误码等指标，
+// 可以直接被 Prometheus 抓取。为了不引入依赖，这里实现了所需的最小子集: 带标签的计数器和直方图，
+// 以及在抓取时从存储中读取的瞬时值 (活跃会话、待兑换的授权码、有效的访问令牌)。
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets 是请求延迟直方图的桶上限 (秒)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// counterVec 是一组按标签值区分的计数器
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // 键是以 \xff 连接的标签值
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// inc 将标签值对应的计数器加 1，标签值的顺序与创建时的 labels 相同
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\xff")]++
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec 是一组按标签值区分的直方图
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // 每个桶 (不累计) 的观测数，最后一个是 +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+// observe 记录一次观测值 v (秒)
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	hist.counts[sort.SearchFloat64s(h.buckets, v)]++
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(hist.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+// writeGauge 输出一个没有标签的瞬时值
+func writeGauge(b *strings.Builder, name, help string, v float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// formatLabels 把标签名和以 \xff 连接的标签值组合成 {a="x",b="y"}，extraName 不为空时追加一个标签 (直方图的 le)
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], strconv.Quote(v)))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Provider 的指标
+var (
+	httpRequests = newCounterVec("oidc_http_requests_total",
+		"HTTP requests by route and status code.", "handler", "code")
+	httpDuration = newHistogramVec("oidc_http_request_duration_seconds",
+		"HTTP request latency by route.", latencyBuckets, "handler")
+	grantsIssued = newCounterVec("oidc_token_grants_total",
+		"Access tokens issued by grant type.", "grant_type")
+	oauthErrors = newCounterVec("oidc_oauth_errors_total",
+		"OAuth error responses by error code.", "error")
+	auditEvents = newCounterVec("oidc_audit_events_total",
+		"Audit events by type, e.g. login.failure.", "type")
+)
+
+// statusRecorder 记录处理器写出的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap 让 http.ResponseController 可以访问原始的 ResponseWriter
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// withMetrics 统计每个请求的状态码和延迟。路由标签使用 ServeMux 匹配到的模式 (例如 "GET /admin/api/users/{username}")，
+// 而不是原始路径，这样标签的取值是有限的；没有匹配到任何路由的请求记为 "unmatched"。
+// next 必须把同一个 *http.Request 交给 ServeMux，否则看不到匹配到的模式
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// ServeMux 会在请求上记录匹配到的模式
+		handler := r.Pattern
+		if handler == "" {
+			handler = "unmatched"
+		}
+		httpRequests.inc(handler, strconv.Itoa(rec.status))
+		httpDuration.observe(time.Since(start).Seconds(), handler)
+	})
+}
+
+// handleMetrics 输出所有指标
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	httpRequests.write(&b)
+	httpDuration.write(&b)
+	grantsIssued.write(&b)
+	oauthErrors.write(&b)
+	auditEvents.write(&b)
+
+	// 存储中的数量是所有 realm 的合计
+	now := time.Now()
+	var active, pending, valid int
+	for _, rlm := range allRealms() {
+		if sessions, err := rlm.store.ListSessions(); err == nil {
+			for _, sess := range sessions {
+				if now.Before(sess.Expiry) {
+					active++
+				}
+			}
+		}
+		if n, err := rlm.store.CountAuthCodes(now); err == nil {
+			pending += n
+		}
+		if tokens, err := rlm.store.ListTokens(); err == nil {
+			for _, t := range tokens {
+				if now.Before(t.Expiry) {
+					valid++
+				}
+			}
+		}
+	}
+	writeGauge(&b, "oidc_active_sessions", "Provider sessions that have not expired.", float64(active))
+	writeGauge(&b, "oidc_pending_auth_codes", "Authorization codes issued but not yet redeemed or expired.", float64(pending))
+	writeGauge(&b, "oidc_active_access_tokens", "Access tokens that have not expired or been revoked.", float64(valid))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, b.String())
+}
@@ -0,0 +1,575 @@
+// mfa.go - 基于 TOTP 的多因素认证 (RFC 6238)
+// 用户可以在 /account/mfa 用验证器应用扫描二维码启用 TOTP，同时获得一组一次性的恢复码。
+// 启用后 (或注册了通行密钥后)，密码验证通过还不会创建会话，需要在 /login/mfa 输入验证码 (或恢复码)
+// 或使用通行密钥完成第二步。
+// 会话记录了完成的认证方式，ID Token 中通过 amr 和 acr 声明告诉客户端:
+//   - 只验证了密码: amr ["pwd"], acr acrPassword
+//   - 验证了密码和 TOTP: amr ["pwd", "otp"], acr acrMFA
+//   - 验证了密码和通行密钥: amr ["pwd", "hwk"], acr acrMFA
+//   - 只用通行密钥登录 (验证了设备上的 PIN 或生物特征): amr ["hwk", "mfa"], acr acrMFA
+//   - 通过上游 Provider 登录 (见 broker.go): amr ["fed"], acr acrFederated，完成第二步后为 ["fed", "otp"] 等和 acrMFA
+//
+// 客户端在授权请求中带上 acr_values=acrMFA 即可要求多因素认证，只验证了密码的会话会被要求补充验证码。
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// amr 声明的取值 (RFC 8176)
+	amrPassword    = "pwd"
+	amrOTP         = "otp"
+	amrHardwareKey = "hwk"
+	amrMFA         = "mfa"
+
+	// acr 声明的取值，客户端也用它们作为 acr_values
+	acrPassword = "urn:simple-oidc-provider:acr:pwd"
+	acrMFA      = "urn:simple-oidc-provider:acr:mfa"
+	// acrFederated 表示只通过上游 Provider 登录，本地没有验证任何凭据，上游用了什么方式也不知道
+	acrFederated = "urn:simple-oidc-provider:acr:fed"
+
+	// TOTP 参数使用验证器应用普遍支持的默认值: SHA-1, 6 位数字, 30 秒一个时间步
+	totpDigits    = 6
+	totpPeriod    = 30
+	totpSecretLen = 20
+	// totpSkew 是允许的时钟偏差 (前后各一个时间步)
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	// mfaCookieName 是密码验证通过、等待第二步验证的 Cookie 名称
+	mfaCookieName = "op-mfa"
+	// mfaChallengeTTL 是第二步验证的有效期，mfaMaxAttempts 是允许输错验证码的次数
+	mfaChallengeTTL = 5 * time.Minute
+	mfaMaxAttempts  = 5
+)
+
+// MFAChallenge 是一次等待输入验证码的登录，保存在进程内存中
+type MFAChallenge struct {
+	ID       string
+	Username string
+	// SessionID 不为空时表示提升已有会话的认证级别 (客户端要求 MFA，而会话只验证了密码)
+	SessionID string
+	// FirstFactor 是已经完成的第一步认证方式: amrPassword，或者通过上游登录时的 amrFederated
+	FirstFactor string
+	Expiry      time.Time
+	Attempts    int
+}
+
+// acrForAMR 根据完成的认证方式得出 acr 声明
+func acrForAMR(amr []string) string {
+	if isMultiFactor(amr) {
+		return acrMFA
+	}
+	if len(amr) > 0 && amr[0] == amrFederated {
+		return acrFederated
+	}
+	return acrPassword
+}
+
+// isMultiFactor 判断是否完成了多因素认证: amr 中有两种及以上的认证方式
+func isMultiFactor(amr []string) bool {
+	return len(amr) > 1
+}
+
+// hasSecondFactor 判断用户是否启用了两步验证 (TOTP 或通行密钥)
+func (u User) hasSecondFactor() bool {
+	return u.TOTPSecret != "" || len(u.Passkeys) > 0
+}
+
+// requiresMFA 判断授权请求的 acr_values 是否要求多因素认证
+func requiresMFA(acrValues string) bool {
+	return containsString(strings.Fields(acrValues), acrMFA)
+}
+
+// generateTOTPSecret 生成一个新的 TOTP 密钥 (Base32 编码，不带填充)
+func generateTOTPSecret() (string, error) {
+	b, err := generateRandomBytes(totpSecretLen)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// decodeTOTPSecret 解码 Base32 格式的 TOTP 密钥，忽略大小写、空格和填充
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+// totpCode 计算某个时间步的验证码 (RFC 4226 第 5.3 节的动态截断)
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP 检查验证码是否属于当前时间前后的时间步，返回匹配的时间步。
+// 不大于 lastStep 的时间步已经用过，不再接受，防止验证码被重放
+func matchTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(key) == 0 || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && secretsEqual(totpCode(key, step), code) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI 返回验证器应用扫描的 otpauth:// 地址。验证器中显示的颁发者是主机名加上 realm 的路径，
+// 不同 realm 中的同名用户不会混淆
+func (rlm *realm) totpProvisioningURI(username, secret string) string {
+	issuer := "simple-oidc-provider"
+	if u, err := url.Parse(rlm.issuer); err == nil && u.Hostname() != "" {
+		issuer = u.Hostname() + u.Path
+	}
+	v := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// generateRecoveryCodes 生成一组恢复码，返回明文 (只显示给用户一次) 和保存用的哈希
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b, err := generateRandomBytes(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode 计算恢复码的哈希。恢复码本身是随机生成的，SHA-256 就足够了
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// errBadSecondFactor 表示验证码或恢复码不正确
+var errBadSecondFactor = errors.New("验证码无效")
+
+// useSecondFactor 验证用户输入的验证码或恢复码，并在同一个存储事务中保存防重放状态 (以及 update 做的修改)，
+// 两个并发的请求不能用同一个验证码或恢复码通过验证。返回保存后的用户，验证失败时返回 errBadSecondFactor
+func (rlm *realm) useSecondFactor(username, code string, update func(user *User)) (User, error) {
+	var saved User
+	err := rlm.store.UpdateUser(username, func(user *User) error {
+		if (user.TOTPSecret == "" && len(user.RecoveryCodes) == 0) || !verifySecondFactor(user, code) {
+			return errBadSecondFactor
+		}
+		if update != nil {
+			update(user)
+		}
+		saved = *user
+		return nil
+	})
+	return saved, err
+}
+
+// verifySecondFactor 用 TOTP 验证码或恢复码验证用户，成功时更新 user 中的防重放状态或删除用掉的恢复码。
+// 调用方需要在读取 user 的同一个事务中保存它 (见 useSecondFactor)
+func verifySecondFactor(user *User, code string) bool {
+	code = strings.TrimSpace(code)
+	if step, ok := matchTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now()); ok {
+		user.TOTPLastStep = step
+		return true
+	}
+	hash := hashRecoveryCode(code)
+	for i, h := range user.RecoveryCodes {
+		if secretsEqual(h, hash) {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			slog.Info("用户使用了一个恢复码", "username", user.Username, "remaining", len(user.RecoveryCodes))
+			return true
+		}
+	}
+	return false
+}
+
+// startMFAChallenge 创建一次第二步验证，并通过 Cookie 下发其 ID。firstFactor 是已经完成的认证方式
+func (rlm *realm) startMFAChallenge(w http.ResponseWriter, username, sessionID, firstFactor string) error {
+	id, err := generateRandomString(24)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	rlm.mfaChallenges[id] = &MFAChallenge{
+		ID:          id,
+		Username:    username,
+		SessionID:   sessionID,
+		FirstFactor: firstFactor,
+		Expiry:      time.Now().Add(mfaChallengeTTL),
+	}
+	mu.Unlock()
+
+	rlm.setCookie(w, &http.Cookie{
+		Name:     mfaCookieName,
+		Value:    id,
+		Path:     "/login/mfa",
+		MaxAge:   int(mfaChallengeTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// currentMFAChallenge 根据 Cookie 找到当前有效的第二步验证，没有则返回 nil
+func currentMFAChallenge(r *http.Request) *MFAChallenge {
+	rlm := requestRealm(r)
+	cookie, err := rlm.cookie(r, mfaCookieName)
+	if err != nil {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	ch, ok := rlm.mfaChallenges[cookie.Value]
+	if !ok || time.Now().After(ch.Expiry) {
+		return nil
+	}
+	c := *ch
+	return &c
+}
+
+// endMFAChallenge 删除第二步验证并清除 Cookie
+func (rlm *realm) endMFAChallenge(w http.ResponseWriter, id string) {
+	mu.Lock()
+	delete(rlm.mfaChallenges, id)
+	mu.Unlock()
+	rlm.setCookie(w, &http.Cookie{Name: mfaCookieName, Value: "", Path: "/login/mfa", MaxAge: -1, HttpOnly: true})
+}
+
+// loginNextURL 是登录完成后的去处 (realm 内的路径): return_to 指定的本站页面，或者继续授权流程的同意页面
+func loginNextURL(r *http.Request) string {
+	return loginNextURLFor(r.URL.RawQuery)
+}
+
+// loginNextURLFor 同 loginNextURL，rawQuery 是登录页面的查询参数
+func loginNextURLFor(rawQuery string) string {
+	q, _ := url.ParseQuery(rawQuery)
+	if returnTo := q.Get("return_to"); isLocalPath(returnTo) {
+		return returnTo
+	}
+	return "/consent?" + rawQuery
+}
+
+// handleMFALogin 是登录的第二步: 输入验证器应用中的验证码或一个恢复码，或者使用通行密钥 (见 passkey.go)。
+// 密码验证通过的用户 (已启用两步验证) 会被带到这里；客户端要求 MFA 而会话只验证了密码时也会来到这里
+func handleMFALogin(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	ch, sess := activeMFAChallenge(r)
+
+	if ch == nil {
+		if sess == nil {
+			rlm.redirect(w, r, "/login?"+r.URL.RawQuery)
+			return
+		}
+		if isMultiFactor(sess.AMR) {
+			rlm.redirect(w, r, loginNextURL(r))
+			return
+		}
+		user, err := rlm.store.GetUser(sess.UserID)
+		if err != nil {
+			http.Error(w, "找不到用户", http.StatusInternalServerError)
+			return
+		}
+		// 客户端要求 MFA，但用户还没有启用两步验证: 先去启用，启用后回到授权流程
+		if !user.hasSecondFactor() {
+			rlm.redirect(w, r, "/account/mfa?return_to="+url.QueryEscape(loginNextURL(r)))
+			return
+		}
+		if r.Method == http.MethodPost {
+			http.Error(w, "验证已过期，请重试", http.StatusBadRequest)
+			return
+		}
+		// 提升认证级别时保留会话原来的第一步认证方式
+		firstFactor := amrPassword
+		if len(sess.AMR) > 0 {
+			firstFactor = sess.AMR[0]
+		}
+		if err := rlm.startMFAChallenge(w, user.Username, sess.ID, firstFactor); err != nil {
+			http.Error(w, "创建验证失败", http.StatusInternalServerError)
+			return
+		}
+		writeMFAForm(w, r, user, Message{})
+		return
+	}
+
+	user, err := rlm.store.GetUser(ch.Username)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeMFAForm(w, r, user, Message{})
+		return
+	}
+
+	// 每个验证只能输错 mfaMaxAttempts 次，但重新登录或提升认证级别会开始新的验证，
+	// 所以输错的验证码还要计入用户名的失败记录，见 throttle.go
+	if loginThrottled(w, r, user.Username) {
+		return
+	}
+	r.ParseForm()
+	if _, err := rlm.useSecondFactor(user.Username, r.PostForm.Get("code"), nil); errors.Is(err, errBadSecondFactor) {
+		recordFailedLogin(r, AuditEvent{Username: user.Username, SessionID: challengeSid(ch, sess), Detail: "bad_second_factor"})
+		mu.Lock()
+		attempts := 0
+		if c, ok := rlm.mfaChallenges[ch.ID]; ok {
+			c.Attempts++
+			attempts = c.Attempts
+		}
+		mu.Unlock()
+		if attempts >= mfaMaxAttempts {
+			rlm.endMFAChallenge(w, ch.ID)
+			slog.WarnContext(r.Context(), "用户输错验证码次数过多，需要重新登录", "username", user.Username)
+			http.Error(w, translate(r, "mfa.too_many_attempts"), http.StatusUnauthorized)
+			return
+		}
+		writeMFAForm(w, r, user, msg("mfa.invalid_code"))
+		return
+	} else if err != nil {
+		http.Error(w, "保存用户失败", http.StatusInternalServerError)
+		return
+	}
+	if err := completeMFAChallenge(w, r, ch, sess, amrOTP); err != nil {
+		http.Error(w, "保存会话失败", http.StatusInternalServerError)
+		return
+	}
+	rlm.redirect(w, r, loginNextURL(r))
+}
+
+// activeMFAChallenge 返回当前的第二步验证 (可能为 nil) 和会话 (可能为 nil)。
+// 提升认证级别的验证只属于发起它的会话，会话不一致时忽略
+func activeMFAChallenge(r *http.Request) (*MFAChallenge, *Session) {
+	ch := currentMFAChallenge(r)
+	sess := currentSession(r)
+	if ch != nil && ch.SessionID != "" && (sess == nil || sess.ID != ch.SessionID) {
+		ch = nil
+	}
+	return ch, sess
+}
+
+// challengeSid 返回提升认证级别的验证所属会话的 sid，用于审计事件。登录时的验证还没有会话，返回空
+func challengeSid(ch *MFAChallenge, sess *Session) string {
+	if ch.SessionID == "" || sess == nil {
+		return ""
+	}
+	return sess.Sid
+}
+
+// completeMFAChallenge 在第二因素 (method 为 amrOTP 或 amrHardwareKey) 验证通过后结束第二步验证:
+// 登录时创建会话，提升认证级别时更新已有会话
+func completeMFAChallenge(w http.ResponseWriter, r *http.Request, ch *MFAChallenge, sess *Session, method string) error {
+	rlm := requestRealm(r)
+	rlm.endMFAChallenge(w, ch.ID)
+	rlm.recordLoginSuccess(ch.Username)
+	amr := []string{ch.FirstFactor, method}
+	var err error
+	if ch.SessionID != "" {
+		sess.AMR = amr
+		err = rlm.store.SaveSession(*sess)
+	} else {
+		sess, err = rlm.createSession(w, ch.Username, amr)
+	}
+	if err == nil {
+		audit(r, AuditEvent{Type: auditLoginSuccess, Username: ch.Username, SessionID: sess.Sid, Detail: "amr=" + strings.Join(amr, ",")})
+		slog.InfoContext(r.Context(), "用户完成了多因素认证", "username", ch.Username, "method", method)
+	}
+	return err
+}
+
+func writeMFAForm(w http.ResponseWriter, r *http.Request, user User, message Message) {
+	renderPage(w, r, "mfa_login.html", page{
+		Title:   "title.mfa",
+		Message: message,
+		Data: struct {
+			HasCode, HasPasskey bool
+			PasskeyFinishURL    string
+		}{user.TOTPSecret != "" || len(user.RecoveryCodes) > 0, len(user.Passkeys) > 0, requestRealm(r).path("/login/mfa/passkey/finish?" + r.URL.RawQuery)},
+	})
+}
+
+// handleMFASettings 是启用和停用 TOTP 的页面，需要先登录。
+// 启用时先显示二维码，用户输入一次验证码确认验证器应用已配置好，然后显示恢复码
+func handleMFASettings(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess == nil {
+		rlm.redirect(w, r, "/login?return_to=/account/mfa")
+		return
+	}
+	user, err := rlm.store.GetUser(sess.UserID)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+
+	var message Message
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		code := strings.TrimSpace(r.PostForm.Get("code"))
+		switch r.PostForm.Get("action") {
+		case "enable":
+			step, ok := matchTOTP(sess.PendingTOTPSecret, code, 0, time.Now())
+			if user.TOTPSecret != "" || !ok {
+				message = msg("mfa.invalid_code")
+				break
+			}
+			codes, hashes, err := generateRecoveryCodes()
+			if err != nil {
+				http.Error(w, "生成恢复码失败", http.StatusInternalServerError)
+				return
+			}
+			// 在事务中再检查一次，两个并发的请求只有一个能启用
+			err = rlm.store.UpdateUser(user.Username, func(u *User) error {
+				if u.TOTPSecret != "" {
+					return errBadSecondFactor
+				}
+				u.TOTPSecret, u.TOTPLastStep, u.RecoveryCodes = sess.PendingTOTPSecret, step, hashes
+				return nil
+			})
+			if errors.Is(err, errBadSecondFactor) {
+				message = msg("mfa.invalid_code")
+				break
+			} else if err != nil {
+				http.Error(w, "保存用户失败", http.StatusInternalServerError)
+				return
+			}
+			// 刚刚输入了正确的验证码，本会话视为完成了多因素认证，第一步认证方式保持不变。
+			// 授权流程要求 MFA 时 (带有 return_to) 不在这里提升级别: 回到授权流程后还要完成一次新的第二步验证
+			sess.PendingTOTPSecret = ""
+			if r.URL.Query().Get("return_to") == "" && len(sess.AMR) > 0 && !isMultiFactor(sess.AMR) {
+				sess.AMR = []string{sess.AMR[0], amrOTP}
+			}
+			if err := rlm.store.SaveSession(*sess); err != nil {
+				http.Error(w, "保存会话失败", http.StatusInternalServerError)
+				return
+			}
+			slog.InfoContext(r.Context(), "用户启用了 TOTP", "username", user.Username)
+			writeRecoveryCodes(w, r, codes)
+			return
+		case "disable", "regenerate":
+			if user.TOTPSecret == "" {
+				message = msg("mfa.invalid_code")
+				break
+			}
+			// 持有会话的人可以在这里猜验证码，和登录的第二步一样受登录限制
+			if loginThrottled(w, r, user.Username) {
+				return
+			}
+			var codes, hashes []string
+			update := func(u *User) { u.TOTPSecret, u.TOTPLastStep, u.RecoveryCodes = "", 0, nil }
+			if r.PostForm.Get("action") == "regenerate" {
+				if codes, hashes, err = generateRecoveryCodes(); err != nil {
+					http.Error(w, "生成恢复码失败", http.StatusInternalServerError)
+					return
+				}
+				update = func(u *User) { u.RecoveryCodes = hashes }
+			}
+			saved, err := rlm.useSecondFactor(user.Username, code, update)
+			if errors.Is(err, errBadSecondFactor) {
+				recordFailedLogin(r, AuditEvent{Username: user.Username, SessionID: sess.Sid, Detail: "bad_second_factor action=" + r.PostForm.Get("action")})
+				message = msg("mfa.invalid_code")
+				break
+			} else if err != nil {
+				http.Error(w, "保存用户失败", http.StatusInternalServerError)
+				return
+			}
+			if codes != nil {
+				writeRecoveryCodes(w, r, codes)
+				return
+			}
+			user, message = saved, msg("mfa.disabled")
+			slog.InfoContext(r.Context(), "用户停用了 TOTP", "username", user.Username)
+		}
+	}
+
+	settings := mfaSettingsPage{
+		Enabled:           user.TOTPSecret != "",
+		RecoveryCodesLeft: len(user.RecoveryCodes),
+		PasskeysURL:       rlm.path("/account/passkeys?" + r.URL.RawQuery),
+	}
+	if settings.Enabled {
+		renderPage(w, r, "mfa_settings.html", page{Title: "title.mfa", Message: message, Data: settings})
+		return
+	}
+
+	// 尚未启用: 生成一个待确认的密钥保存在会话中，确认之前不会影响登录
+	if sess.PendingTOTPSecret == "" {
+		if sess.PendingTOTPSecret, err = generateTOTPSecret(); err == nil {
+			err = rlm.store.SaveSession(*sess)
+		}
+		if err != nil {
+			http.Error(w, "生成 TOTP 密钥失败", http.StatusInternalServerError)
+			return
+		}
+	}
+	uri := rlm.totpProvisioningURI(user.Username, sess.PendingTOTPSecret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 200)
+	if err != nil {
+		http.Error(w, "生成二维码失败", http.StatusInternalServerError)
+		return
+	}
+	// 二维码是程序生成的 PNG，可以放心地作为 data: URL 使用
+	settings.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	settings.Secret, settings.ProvisioningURI = sess.PendingTOTPSecret, uri
+	renderPage(w, r, "mfa_settings.html", page{Title: "title.mfa_enroll", Message: message, Data: settings})
+}
+
+// mfaSettingsPage 是 mfa_settings.html 的数据。Enabled 为 false 时显示启用 TOTP 的二维码
+type mfaSettingsPage struct {
+	Enabled           bool
+	RecoveryCodesLeft int
+	PasskeysURL       string
+	QRCode            template.URL
+	Secret            string
+	ProvisioningURI   string
+}
+
+// writeRecoveryCodes 显示新生成的恢复码。恢复码只保存哈希，这是用户唯一一次看到它们
+func writeRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	next := "/account/mfa"
+	if returnTo := r.URL.Query().Get("return_to"); isLocalPath(returnTo) {
+		next = returnTo
+	}
+	renderPage(w, r, "recovery_codes.html", page{
+		Title: "title.recovery_codes",
+		Data: struct {
+			Codes []string
+			Next  string
+		}{codes, next},
+	})
+}
@@ -0,0 +1,500 @@
+// passkey.go - WebAuthn 通行密钥 (passkey)
+// 登录后可以在 /account/passkeys 注册通行密钥，凭据保存在用户记录中。无密码登录视为多因素认证，
+// 所以注册需要完成过多因素认证的会话；用户还没有第二因素时，可以重新输入密码代替。通行密钥有两种用法:
+//   - 无密码登录: 登录页面上直接使用通行密钥，认证器必须验证用户 (PIN 或生物特征)，视为多因素认证
+//   - 第二因素: 密码验证通过后，在 /login/mfa 使用通行密钥代替 TOTP 验证码
+//
+// 每个仪式 (注册或验证) 分两步: begin 返回给 navigator.credentials 的选项 JSON，
+// finish 接收浏览器返回的凭据 JSON。两步之间的挑战数据保存在进程内存中，由 Cookie 关联。
+// 接口只使用 JSON，不依赖浏览器，也可以用软件实现的认证器直接调用。
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	// passkeyCookieName 关联 begin 和 finish 两步，passkeyCeremonyTTL 是两步之间允许的最长时间
+	passkeyCookieName  = "op-passkey"
+	passkeyCeremonyTTL = 5 * time.Minute
+
+	// 仪式的类型
+	passkeyRegister     = "register"
+	passkeyLogin        = "login"         // 无密码登录
+	passkeySecondFactor = "second-factor" // 密码之后的第二因素
+)
+
+// Passkey 是用户注册的一个通行密钥
+type Passkey struct {
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	Credential webauthn.Credential
+}
+
+// passkeyCeremony 是一次进行中的注册或验证
+type passkeyCeremony struct {
+	Kind string
+	// Username 是注册或第二因素验证的用户，无密码登录时为空 (由凭据决定)
+	Username string
+	// ChallengeID 是第二因素验证所属的 MFAChallenge
+	ChallengeID string
+	Data        webauthn.SessionData
+	Expiry      time.Time
+}
+
+// newRelyingParty 根据 issuer 创建依赖方配置: RP ID 为 issuer 的主机名，只接受来自 issuer 源的请求。
+// 所有 realm 的 RP ID 相同，凭据中的用户句柄是用户 ID，在其他 realm 中找不到对应的用户。
+// 注意浏览器不接受 IP 地址作为 RP ID，在浏览器中使用通行密钥时 issuer 应该使用域名 (如 http://localhost:9090)
+func newRelyingParty(issuer string) (*webauthn.WebAuthn, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return nil, err
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "simple-oidc-provider",
+		RPOrigins:     []string{u.Scheme + "://" + u.Host},
+	})
+}
+
+// --- User 实现 webauthn.User 接口 ---
+
+// WebAuthnID 是凭据中保存的用户句柄，无密码登录时用它找到用户
+func (u User) WebAuthnID() []byte { return []byte(u.ID) }
+
+func (u User) WebAuthnName() string { return u.Username }
+
+func (u User) WebAuthnDisplayName() string { return u.Name }
+
+func (u User) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, len(u.Passkeys))
+	for i, pk := range u.Passkeys {
+		creds[i] = pk.Credential
+	}
+	return creds
+}
+
+// --- 仪式状态 ---
+
+// startPasskeyCeremony 保存仪式的挑战数据，并通过 Cookie 下发其 ID
+func (rlm *realm) startPasskeyCeremony(w http.ResponseWriter, ceremony passkeyCeremony) error {
+	id, err := generateRandomString(24)
+	if err != nil {
+		return err
+	}
+	ceremony.Expiry = time.Now().Add(passkeyCeremonyTTL)
+	mu.Lock()
+	rlm.passkeyCeremonies[id] = &ceremony
+	mu.Unlock()
+
+	rlm.setCookie(w, &http.Cookie{
+		Name:     passkeyCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(passkeyCeremonyTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// takePasskeyCeremony 取出并删除 Cookie 对应的仪式，挑战只能使用一次
+func takePasskeyCeremony(w http.ResponseWriter, r *http.Request, kind string) (*passkeyCeremony, error) {
+	rlm := requestRealm(r)
+	cookie, err := rlm.cookie(r, passkeyCookieName)
+	if err != nil {
+		return nil, errors.New("没有进行中的通行密钥验证")
+	}
+	rlm.setCookie(w, &http.Cookie{Name: passkeyCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+
+	mu.Lock()
+	ceremony, ok := rlm.passkeyCeremonies[cookie.Value]
+	delete(rlm.passkeyCeremonies, cookie.Value)
+	mu.Unlock()
+	if !ok || ceremony.Kind != kind || time.Now().After(ceremony.Expiry) {
+		return nil, errors.New("通行密钥验证已过期，请重试")
+	}
+	return ceremony, nil
+}
+
+// writePasskeyOptions 返回 begin 步骤的选项 JSON
+func writePasskeyOptions(w http.ResponseWriter, options interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(options)
+}
+
+// writePasskeyDone 返回 finish 步骤的结果: 浏览器接下来要跳转的地址，redirect 是 realm 内的路径
+func writePasskeyDone(w http.ResponseWriter, r *http.Request, redirect string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"redirect": requestRealm(r).path(redirect)})
+}
+
+// recordPasskeyUse 验证成功后更新凭据的签名计数器和最近使用时间。
+// 计数器没有增加说明凭据可能被复制过，拒绝这次登录。在事务中读取和保存用户，
+// 不会覆盖同时进行的 TOTP 验证或其他通行密钥的更新；事务中再比较一次计数器，同一个计数器只能用一次
+func (rlm *realm) recordPasskeyUse(username string, cred *webauthn.Credential) error {
+	errCloned := errors.New("通行密钥的签名计数器异常，可能已被复制")
+	if cred.Authenticator.CloneWarning {
+		return errCloned
+	}
+	return rlm.store.UpdateUser(username, func(user *User) error {
+		i := slices.IndexFunc(user.Passkeys, func(pk Passkey) bool { return bytes.Equal(pk.Credential.ID, cred.ID) })
+		if i < 0 {
+			return errors.New("找不到通行密钥")
+		}
+		if count := cred.Authenticator.SignCount; count != 0 && count <= user.Passkeys[i].Credential.Authenticator.SignCount {
+			return errCloned
+		}
+		// 修改副本: 内存存储返回的用户和存储中的记录共用同一个切片
+		user.Passkeys = slices.Clone(user.Passkeys)
+		user.Passkeys[i].Credential = *cred
+		user.Passkeys[i].LastUsedAt = time.Now()
+		return nil
+	})
+}
+
+// --- 注册 ---
+
+// handlePasskeyRegisterBegin 开始为当前用户注册通行密钥。要求可发现凭据和用户验证，这样它也能用于无密码登录
+func handlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess == nil || r.Method != http.MethodPost {
+		http.Error(w, "请先登录", http.StatusUnauthorized)
+		return
+	}
+	user, err := rlm.store.GetUser(sess.UserID)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+	if !passkeyRegistrationAllowed(w, r, sess, user) {
+		return
+	}
+
+	options, data, err := rlm.relyingParty.BeginRegistration(user,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		}),
+		// 同一个认证器不能重复注册
+		webauthn.WithExclusions(webauthn.Credentials(user.WebAuthnCredentials()).CredentialDescriptors()),
+	)
+	if err == nil {
+		err = rlm.startPasskeyCeremony(w, passkeyCeremony{Kind: passkeyRegister, Username: user.Username, Data: *data})
+	}
+	if err != nil {
+		http.Error(w, "创建通行密钥注册失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writePasskeyOptions(w, options)
+}
+
+// passkeyRegistrationAllowed 检查当前会话能否注册通行密钥，不能时写入错误响应并返回 false。
+// 用通行密钥无密码登录得到 amr ["hwk", "mfa"]，如果只验证了密码的会话也能注册，偷到会话 Cookie 的人
+// 就能给自己加上一个多因素的登录方式。因此要求会话完成过多因素认证；用户还没有任何第二因素时，
+// 也可以在请求体 {"password": "..."} 中重新输入密码，输错和登录一样计入登录限制
+func passkeyRegistrationAllowed(w http.ResponseWriter, r *http.Request, sess *Session, user User) bool {
+	if isMultiFactor(sess.AMR) {
+		return true
+	}
+	// 已有第二因素的用户应该先提升认证级别；通过上游登录、没有本地密码的用户只能先启用两步验证
+	if user.hasSecondFactor() || user.PasswordHash == "" {
+		http.Error(w, translate(r, "passkeys.need_mfa_register"), http.StatusForbidden)
+		return false
+	}
+	var body struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "请求格式错误", http.StatusBadRequest)
+		return false
+	}
+	if body.Password == "" {
+		http.Error(w, translate(r, "passkeys.need_password"), http.StatusForbidden)
+		return false
+	}
+	if loginThrottled(w, r, user.Username) {
+		return false
+	}
+	if ok, _ := verifyPassword(user.PasswordHash, body.Password); !ok {
+		recordFailedLogin(r, AuditEvent{Username: user.Username, SessionID: sess.Sid, Detail: "bad_password passkey_register"})
+		http.Error(w, translate(r, "passkeys.wrong_password"), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handlePasskeyRegisterFinish 验证认证器返回的新凭据并保存。name 参数是通行密钥的名称，
+// return_to 参数是注册完成后返回的页面
+func handlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess == nil || r.Method != http.MethodPost {
+		http.Error(w, "请先登录", http.StatusUnauthorized)
+		return
+	}
+	ceremony, err := takePasskeyCeremony(w, r, passkeyRegister)
+	if err != nil || ceremony.Username != sess.UserID {
+		http.Error(w, "通行密钥注册已过期，请重试", http.StatusBadRequest)
+		return
+	}
+	user, err := rlm.store.GetUser(sess.UserID)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+
+	cred, err := rlm.relyingParty.FinishRegistration(user, ceremony.Data, r)
+	if err != nil {
+		http.Error(w, "通行密钥注册失败: "+protocolErrorDetails(err), http.StatusBadRequest)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = fmt.Sprintf("通行密钥 %d", len(user.Passkeys)+1)
+	}
+	now := time.Now()
+	passkey := Passkey{Name: name, CreatedAt: now, LastUsedAt: now, Credential: *cred}
+	err = rlm.store.UpdateUser(user.Username, func(u *User) error {
+		// Clip 让 append 总是分配新的数组，不会写入和存储中的记录共用的切片
+		u.Passkeys = append(slices.Clip(u.Passkeys), passkey)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "保存通行密钥失败", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "用户注册了通行密钥", "username", user.Username, "passkey", name)
+
+	next := "/account/passkeys"
+	if returnTo := r.URL.Query().Get("return_to"); isLocalPath(returnTo) {
+		next = returnTo
+	}
+	writePasskeyDone(w, r, next)
+}
+
+// --- 无密码登录 ---
+
+// handlePasskeyLoginBegin 开始无密码登录。不指定用户，由认证器让用户选择一个可发现凭据
+func handlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只接受 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	rlm := requestRealm(r)
+	options, data, err := rlm.relyingParty.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err == nil {
+		err = rlm.startPasskeyCeremony(w, passkeyCeremony{Kind: passkeyLogin, Data: *data})
+	}
+	if err != nil {
+		http.Error(w, "创建通行密钥登录失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writePasskeyOptions(w, options)
+}
+
+// handlePasskeyLoginFinish 验证断言，根据凭据中的用户句柄找到用户并创建会话。
+// 查询参数与 /login 相同 (授权请求的参数或 return_to)
+func handlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "只接受 POST 请求", http.StatusMethodNotAllowed)
+		return
+	}
+	ceremony, err := takePasskeyCeremony(w, r, passkeyLogin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rlm := requestRealm(r)
+	found, cred, err := rlm.relyingParty.FinishPasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		user, ok := rlm.findUserByID(string(userHandle))
+		if !ok {
+			return nil, errors.New("找不到通行密钥对应的用户")
+		}
+		return user, nil
+	}, ceremony.Data, r)
+	if err != nil {
+		audit(r, AuditEvent{Type: auditLoginFailure, Detail: "passkey: " + protocolErrorDetails(err)})
+		http.Error(w, "通行密钥验证失败: "+protocolErrorDetails(err), http.StatusUnauthorized)
+		return
+	}
+	user := found.(User)
+	if err := rlm.recordPasskeyUse(user.Username, cred); err != nil {
+		audit(r, AuditEvent{Type: auditLoginFailure, Username: user.Username, Detail: "passkey: " + err.Error()})
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// 认证器验证了用户 (PIN 或生物特征)，加上持有通行密钥本身，视为多因素认证
+	amr := []string{amrHardwareKey, amrMFA}
+	sess, err := rlm.createSession(w, user.Username, amr)
+	if err != nil {
+		http.Error(w, "创建会话失败", http.StatusInternalServerError)
+		return
+	}
+	audit(r, AuditEvent{Type: auditLoginSuccess, Username: user.Username, SessionID: sess.Sid, Detail: "amr=" + strings.Join(amr, ",")})
+	slog.InfoContext(r.Context(), "用户使用通行密钥登录成功", "username", user.Username)
+	writePasskeyDone(w, r, loginNextURL(r))
+}
+
+// --- 第二因素 ---
+
+// handlePasskeySecondFactorBegin 在密码验证通过后 (或提升会话的认证级别时)，用用户已注册的通行密钥进行第二步验证
+func handlePasskeySecondFactorBegin(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	ch, _ := activeMFAChallenge(r)
+	if ch == nil || r.Method != http.MethodPost {
+		http.Error(w, "验证已过期，请重新登录", http.StatusUnauthorized)
+		return
+	}
+	user, err := rlm.store.GetUser(ch.Username)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+	if len(user.Passkeys) == 0 {
+		http.Error(w, "没有注册通行密钥", http.StatusBadRequest)
+		return
+	}
+
+	// 密码已经验证过，这里只需要证明持有通行密钥，不要求认证器再验证用户
+	options, data, err := rlm.relyingParty.BeginLogin(user, webauthn.WithUserVerification(protocol.VerificationDiscouraged))
+	if err == nil {
+		err = rlm.startPasskeyCeremony(w, passkeyCeremony{Kind: passkeySecondFactor, Username: user.Username, ChallengeID: ch.ID, Data: *data})
+	}
+	if err != nil {
+		http.Error(w, "创建通行密钥验证失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writePasskeyOptions(w, options)
+}
+
+// handlePasskeySecondFactorFinish 验证断言并完成第二步验证
+func handlePasskeySecondFactorFinish(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	ch, sess := activeMFAChallenge(r)
+	if ch == nil || r.Method != http.MethodPost {
+		http.Error(w, "验证已过期，请重新登录", http.StatusUnauthorized)
+		return
+	}
+	ceremony, err := takePasskeyCeremony(w, r, passkeySecondFactor)
+	if err != nil || ceremony.ChallengeID != ch.ID {
+		http.Error(w, "通行密钥验证已过期，请重试", http.StatusBadRequest)
+		return
+	}
+	user, err := rlm.store.GetUser(ch.Username)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+
+	cred, err := rlm.relyingParty.FinishLogin(user, ceremony.Data, r)
+	if err == nil {
+		err = rlm.recordPasskeyUse(user.Username, cred)
+	}
+	if err != nil {
+		audit(r, AuditEvent{Type: auditLoginFailure, Username: user.Username, SessionID: challengeSid(ch, sess), Detail: "passkey: " + protocolErrorDetails(err)})
+		http.Error(w, "通行密钥验证失败: "+protocolErrorDetails(err), http.StatusUnauthorized)
+		return
+	}
+	if err := completeMFAChallenge(w, r, ch, sess, amrHardwareKey); err != nil {
+		http.Error(w, "保存会话失败", http.StatusInternalServerError)
+		return
+	}
+	writePasskeyDone(w, r, loginNextURL(r))
+}
+
+// protocolErrorDetails 返回 WebAuthn 错误中更具体的原因 (go-webauthn 把原因放在 DevInfo 中)
+func protocolErrorDetails(err error) string {
+	var perr *protocol.Error
+	if errors.As(err, &perr) && perr.DevInfo != "" {
+		return perr.Details + ": " + perr.DevInfo
+	}
+	return err.Error()
+}
+
+// --- 管理页面 ---
+
+// handlePasskeySettings 列出当前用户的通行密钥，可以注册新的或删除已有的
+func handlePasskeySettings(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess == nil {
+		rlm.redirect(w, r, "/login?return_to=/account/passkeys")
+		return
+	}
+	user, err := rlm.store.GetUser(sess.UserID)
+	if err != nil {
+		http.Error(w, "找不到用户", http.StatusInternalServerError)
+		return
+	}
+
+	var message Message
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		id, _ := base64.RawURLEncoding.DecodeString(r.PostForm.Get("id"))
+		// 删除第二因素需要本会话完成过多因素认证，防止只知道密码的人移除它
+		if user.hasSecondFactor() && !isMultiFactor(sess.AMR) {
+			message = msg("passkeys.need_mfa")
+		} else {
+			var deleted *Passkey
+			err := rlm.store.UpdateUser(user.Username, func(u *User) error {
+				i := slices.IndexFunc(u.Passkeys, func(pk Passkey) bool { return bytes.Equal(pk.Credential.ID, id) })
+				if i >= 0 {
+					deleted = &u.Passkeys[i]
+					u.Passkeys = append(u.Passkeys[:i:i], u.Passkeys[i+1:]...)
+				}
+				user = *u
+				return nil
+			})
+			if err != nil {
+				http.Error(w, "保存用户失败", http.StatusInternalServerError)
+				return
+			}
+			if deleted != nil {
+				message = msg("passkeys.deleted", deleted.Name)
+				slog.InfoContext(r.Context(), "用户删除了通行密钥", "username", user.Username, "passkey", deleted.Name)
+			}
+		}
+	}
+
+	type passkeyRow struct {
+		ID, Name              string
+		CreatedAt, LastUsedAt time.Time
+	}
+	rows := make([]passkeyRow, len(user.Passkeys))
+	for i, pk := range user.Passkeys {
+		rows[i] = passkeyRow{base64.RawURLEncoding.EncodeToString(pk.Credential.ID), pk.Name, pk.CreatedAt, pk.LastUsedAt}
+	}
+	// 注册的条件见 passkeyRegistrationAllowed
+	multiFactor := isMultiFactor(sess.AMR)
+	canReauthenticate := !user.hasSecondFactor() && user.PasswordHash != ""
+	renderPage(w, r, "passkeys.html", page{
+		Title:   "title.passkeys",
+		Message: message,
+		Data: struct {
+			Passkeys              []passkeyRow
+			RegisterFinishURL     string
+			NeedPassword, NeedMFA bool
+		}{rows, rlm.path("/webauthn/register/finish?" + r.URL.RawQuery), !multiFactor && canReauthenticate, !multiFactor && !canReauthenticate},
+	})
+}
@@ -0,0 +1,606 @@
+// passkey_test.go - 通行密钥的注册、无密码登录和第二因素验证
+// 测试用一个软件实现的认证器 (进程内的 ECDSA P-256 密钥) 代替浏览器和硬件认证器，
+// 按 WebAuthn 规范拼出证明和断言 JSON，通过 HTTP 调用 Provider 的 begin/finish 接口
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// --- 测试服务器 ---
+
+// newPasskeyTestServer 启动一个只有默认 realm 的 Provider (内存存储，一个用户 alice)，
+// issuer 是测试服务器自己的地址，所以 RP ID 是 127.0.0.1，允许的源是 http://127.0.0.1:<端口>
+func newPasskeyTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(nil)
+	cfg := defaultConfig()
+	cfg.Issuer = "http://" + srv.Listener.Addr().String()
+	cfg.Audit.Sink = "none"
+	cfg.Log.Level = "error"
+	cfg.Clients = nil
+	cfg.Users = []User{{ID: "user-alice", Username: "alice", Name: "Alice"}}
+	if err := openRealms(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeRealms)
+	if err := applyConfig(&cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webauthn/register/begin", handlePasskeyRegisterBegin)
+	mux.HandleFunc("/webauthn/register/finish", handlePasskeyRegisterFinish)
+	mux.HandleFunc("/webauthn/login/begin", handlePasskeyLoginBegin)
+	mux.HandleFunc("/webauthn/login/finish", handlePasskeyLoginFinish)
+	mux.HandleFunc("/login/mfa/passkey/begin", handlePasskeySecondFactorBegin)
+	mux.HandleFunc("/login/mfa/passkey/finish", handlePasskeySecondFactorFinish)
+	srv.Config.Handler = withRealm(mux)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// browser 是带 Cookie 的 HTTP 客户端，不跟随重定向
+type browser struct {
+	t      *testing.T
+	srv    *httptest.Server
+	client *http.Client
+}
+
+func newBrowser(t *testing.T, srv *httptest.Server) *browser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &browser{t, srv, client}
+}
+
+// post 向 path 发送 JSON 请求，返回状态码和响应内容
+func (b *browser) post(path string, body []byte) (int, []byte) {
+	b.t.Helper()
+	resp, err := b.client.Post(b.srv.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// mustPost 与 post 相同，但要求响应是 200
+func (b *browser) mustPost(path string, body []byte) []byte {
+	b.t.Helper()
+	status, data := b.post(path, body)
+	if status != http.StatusOK {
+		b.t.Fatalf("POST %s: %d %s", path, status, data)
+	}
+	return data
+}
+
+// setCookies 把 handler 在 httptest.ResponseRecorder 中设置的 Cookie 交给浏览器
+func (b *browser) setCookies(rec *httptest.ResponseRecorder) {
+	u, _ := url.Parse(b.srv.URL)
+	b.client.Jar.SetCookies(u, rec.Result().Cookies())
+}
+
+// cookie 返回浏览器保存的 Cookie 的值，没有时返回空
+func (b *browser) cookie(path, name string) string {
+	u, _ := url.Parse(b.srv.URL + path)
+	for _, c := range b.client.Jar.Cookies(u) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// signIn 为 alice 创建一个完成了 amr 中认证方式的会话
+func (b *browser) signIn(amr ...string) {
+	b.t.Helper()
+	rec := httptest.NewRecorder()
+	if _, err := rootRealm.createSession(rec, "alice", amr); err != nil {
+		b.t.Fatal(err)
+	}
+	b.setCookies(rec)
+}
+
+// session 返回浏览器当前的会话
+func (b *browser) session() Session {
+	b.t.Helper()
+	sess, err := rootRealm.store.GetSession(b.cookie("/", sessionCookieName))
+	if err != nil {
+		b.t.Fatalf("没有会话: %v", err)
+	}
+	return sess
+}
+
+// --- 软件认证器 ---
+
+// softAuthenticator 是一个软件实现的认证器，只保存一个凭据。
+// 它不检查 RP ID 和源，origin 和 rpID 可以故意设置成错误的值
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	credID    []byte
+	userID    []byte
+	signCount uint32
+	origin    string
+	rpID      string
+}
+
+func newSoftAuthenticator(t *testing.T, srv *httptest.Server) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	u, _ := url.Parse(srv.URL)
+	return &softAuthenticator{key: key, credID: credID, origin: srv.URL, rpID: u.Hostname()}
+}
+
+// ceremonyOptions 是 begin 返回的选项 (navigator.credentials.create/get 的参数) 中用到的部分
+type ceremonyOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+func parseOptions(t *testing.T, data []byte) ceremonyOptions {
+	t.Helper()
+	var opts ceremonyOptions
+	if err := json.Unmarshal(data, &opts); err != nil || opts.PublicKey.Challenge == "" {
+		t.Fatalf("无效的选项 %s: %v", data, err)
+	}
+	return opts
+}
+
+var b64 = base64.RawURLEncoding.EncodeToString
+
+// clientData 是浏览器生成的 clientDataJSON
+func (a *softAuthenticator) clientData(typ, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": a.origin})
+	return data
+}
+
+// authData 是认证器数据的前 37 个字节: rpIdHash、标志和签名计数器
+func (a *softAuthenticator) authData(flags protocol.AuthenticatorFlags) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], byte(flags))
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+// create 响应注册选项，返回 "none" 格式证明的凭据 JSON
+func (a *softAuthenticator) create(t *testing.T, options []byte) []byte {
+	t.Helper()
+	opts := parseOptions(t, options)
+	userID, err := base64.RawURLEncoding.DecodeString(opts.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userID = userID
+
+	pub, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+		Curve:         int64(webauthncose.P256),
+		XCoord:        a.key.X.FillBytes(make([]byte, 32)),
+		YCoord:        a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authData := a.authData(protocol.FlagUserPresent | protocol.FlagUserVerified | protocol.FlagAttestedCredentialData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credID)))
+	authData = append(authData, a.credID...)
+	authData = append(authData, pub...)
+	attestation, err := webauthncbor.Marshal(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": authData})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := json.Marshal(map[string]any{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(a.clientData("webauthn.create", opts.PublicKey.Challenge)),
+			"attestationObject": b64(attestation),
+		},
+	})
+	return data
+}
+
+// get 响应验证选项，返回断言 JSON
+func (a *softAuthenticator) get(t *testing.T, options []byte) []byte {
+	t.Helper()
+	return a.assert(t, parseOptions(t, options).PublicKey.Challenge)
+}
+
+// assert 对给定的挑战 (base64url) 签名，返回断言 JSON。每次签名计数器加一
+func (a *softAuthenticator) assert(t *testing.T, challenge string) []byte {
+	t.Helper()
+	a.signCount++
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authData(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := json.Marshal(map[string]any{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(sig),
+			"userHandle":        b64(a.userID),
+		},
+	})
+	return data
+}
+
+// registerPasskey 让 alice 用两步验证登录并注册认证器中的通行密钥
+func registerPasskey(t *testing.T, srv *httptest.Server, auth *softAuthenticator) {
+	t.Helper()
+	b := newBrowser(t, srv)
+	b.signIn(amrPassword, amrOTP)
+	options := b.mustPost("/webauthn/register/begin", nil)
+	b.mustPost("/webauthn/register/finish?name=test", auth.create(t, options))
+}
+
+// redirectOf 返回 finish 步骤结果中的跳转地址
+func redirectOf(t *testing.T, data []byte) string {
+	t.Helper()
+	var done struct{ Redirect string }
+	if err := json.Unmarshal(data, &done); err != nil {
+		t.Fatalf("无效的结果 %s: %v", data, err)
+	}
+	return done.Redirect
+}
+
+// --- 测试 ---
+
+func TestPasskeyRegister(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+	auth := newSoftAuthenticator(t, srv)
+	b := newBrowser(t, srv)
+	b.signIn(amrPassword, amrOTP)
+
+	options := b.mustPost("/webauthn/register/begin", nil)
+	done := b.mustPost("/webauthn/register/finish?name=laptop&return_to=/account/mfa", auth.create(t, options))
+	if got := redirectOf(t, done); got != "/account/mfa" {
+		t.Errorf("redirect = %q, want /account/mfa", got)
+	}
+
+	user, err := rootRealm.store.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Passkeys) != 1 {
+		t.Fatalf("got %d passkeys, want 1", len(user.Passkeys))
+	}
+	if pk := user.Passkeys[0]; pk.Name != "laptop" || !bytes.Equal(pk.Credential.ID, auth.credID) {
+		t.Errorf("passkey = %q %x, want laptop %x", pk.Name, pk.Credential.ID, auth.credID)
+	}
+	if !bytes.Equal(auth.userID, []byte("user-alice")) {
+		t.Errorf("user handle = %q, want user-alice", auth.userID)
+	}
+
+	// 同一个认证器不能注册两次: 选项中排除了已有的凭据，认证器会拒绝，这里只检查排除列表
+	options = b.mustPost("/webauthn/register/begin", nil)
+	var excluded struct {
+		PublicKey struct {
+			ExcludeCredentials []struct{ ID string } `json:"excludeCredentials"`
+		} `json:"publicKey"`
+	}
+	json.Unmarshal(options, &excluded)
+	if ex := excluded.PublicKey.ExcludeCredentials; len(ex) != 1 || ex[0].ID != b64(auth.credID) {
+		t.Errorf("excludeCredentials = %+v, want the registered credential", ex)
+	}
+}
+
+func TestPasskeyRegisterRequiresSession(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+	b := newBrowser(t, srv)
+	if status, _ := b.post("/webauthn/register/begin", nil); status != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", status)
+	}
+}
+
+func TestPasskeyRegisterRequiresMFA(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+
+	// 只验证了密码或只通过上游登录的会话不能直接注册: 否则一个因素就能换来多因素的无密码登录
+	for _, amr := range [][]string{{amrPassword}, {amrFederated}} {
+		b := newBrowser(t, srv)
+		b.signIn(amr...)
+		if status, body := b.post("/webauthn/register/begin", nil); status != http.StatusForbidden {
+			t.Errorf("amr %v: status = %d %s, want 403", amr, status, body)
+		}
+		if b.cookie("/", passkeyCookieName) != "" {
+			t.Errorf("amr %v: a registration ceremony was started", amr)
+		}
+	}
+}
+
+func TestPasskeyRegisterWithPassword(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+	auth := newSoftAuthenticator(t, srv)
+	hash, err := hashPassword("correct-horse-battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rootRealm.store.UpdateUser("alice", func(u *User) error { u.PasswordHash = hash; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	b := newBrowser(t, srv)
+	b.signIn(amrPassword)
+
+	// 还没有第二因素的用户可以重新输入密码代替多因素认证
+	for _, body := range []string{``, `{"password": ""}`, `{"password": "wrong"}`} {
+		if status, _ := b.post("/webauthn/register/begin", []byte(body)); status != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want 403", body, status)
+		}
+	}
+	options := b.mustPost("/webauthn/register/begin", []byte(`{"password": "correct-horse-battery"}`))
+	b.mustPost("/webauthn/register/finish", auth.create(t, options))
+
+	// 有了第二因素之后，只验证了密码的会话即使输入密码也不能再注册
+	if status, _ := b.post("/webauthn/register/begin", []byte(`{"password": "correct-horse-battery"}`)); status != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", status)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+	auth := newSoftAuthenticator(t, srv)
+	registerPasskey(t, srv, auth)
+
+	b := newBrowser(t, srv)
+	options := b.mustPost("/webauthn/login/begin", nil)
+	done := b.mustPost("/webauthn/login/finish?return_to=/account/passkeys", auth.get(t, options))
+	if got := redirectOf(t, done); got != "/account/passkeys" {
+		t.Errorf("redirect = %q, want /account/passkeys", got)
+	}
+
+	sess := b.session()
+	if sess.UserID != "alice" {
+		t.Errorf("session user = %q, want alice", sess.UserID)
+	}
+	if want := []string{amrHardwareKey, amrMFA}; !reflect.DeepEqual(sess.AMR, want) {
+		t.Errorf("amr = %v, want %v", sess.AMR, want)
+	}
+	user, _ := rootRealm.store.GetUser("alice")
+	if got := user.Passkeys[0].Credential.Authenticator.SignCount; got != auth.signCount {
+		t.Errorf("stored sign count = %d, want %d", got, auth.signCount)
+	}
+}
+
+func TestPasskeyLoginRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		// respond 用认证器响应 begin 返回的选项，返回发给 finish 的断言
+		respond func(t *testing.T, auth *softAuthenticator, options []byte) []byte
+	}{
+		{"wrong challenge", func(t *testing.T, auth *softAuthenticator, options []byte) []byte {
+			challenge, _ := protocol.CreateChallenge()
+			return auth.assert(t, challenge.String())
+		}},
+		{"wrong origin", func(t *testing.T, auth *softAuthenticator, options []byte) []byte {
+			auth.origin = "https://evil.example"
+			return auth.get(t, options)
+		}},
+		{"wrong rp id", func(t *testing.T, auth *softAuthenticator, options []byte) []byte {
+			auth.rpID = "evil.example"
+			return auth.get(t, options)
+		}},
+		{"replayed sign count", func(t *testing.T, auth *softAuthenticator, options []byte) []byte {
+			auth.signCount = 0
+			return auth.get(t, options)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newPasskeyTestServer(t)
+			auth := newSoftAuthenticator(t, srv)
+			registerPasskey(t, srv, auth)
+			// 先正常登录一次，签名计数器变为 1
+			ok := newBrowser(t, srv)
+			ok.mustPost("/webauthn/login/finish", auth.get(t, ok.mustPost("/webauthn/login/begin", nil)))
+
+			b := newBrowser(t, srv)
+			options := b.mustPost("/webauthn/login/begin", nil)
+			status, body := b.post("/webauthn/login/finish", tt.respond(t, auth, options))
+			if status != http.StatusUnauthorized {
+				t.Errorf("status = %d %s, want 401", status, body)
+			}
+			if b.cookie("/", sessionCookieName) != "" {
+				t.Error("a session was created")
+			}
+		})
+	}
+}
+
+func TestPasskeyUseConcurrent(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+	auth := newSoftAuthenticator(t, srv)
+	registerPasskey(t, srv, auth)
+	user, err := rootRealm.store.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cred := user.Passkeys[0].Credential
+	cred.Authenticator.SignCount++
+
+	// 同一个计数器的多次使用只有一次成功，同时进行的 TOTP 验证保存的状态不会被覆盖
+	var wg sync.WaitGroup
+	var ok atomic.Int32
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rootRealm.recordPasskeyUse("alice", &cred) == nil {
+				ok.Add(1)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rootRealm.store.UpdateUser("alice", func(u *User) error { u.TOTPLastStep = 42; return nil })
+	}()
+	wg.Wait()
+
+	if n := ok.Load(); n != 1 {
+		t.Errorf("%d uses succeeded, want 1", n)
+	}
+	user, err = rootRealm.store.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.TOTPLastStep != 42 {
+		t.Errorf("TOTPLastStep = %d, want 42", user.TOTPLastStep)
+	}
+	if got := user.Passkeys[0].Credential.Authenticator.SignCount; got != cred.Authenticator.SignCount {
+		t.Errorf("sign count = %d, want %d", got, cred.Authenticator.SignCount)
+	}
+}
+
+func TestPasskeyCeremonyCookieReuse(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+	auth := newSoftAuthenticator(t, srv)
+	registerPasskey(t, srv, auth)
+
+	b := newBrowser(t, srv)
+	options := b.mustPost("/webauthn/login/begin", nil)
+	ceremony := b.cookie("/", passkeyCookieName)
+	if ceremony == "" {
+		t.Fatal("begin did not set the ceremony cookie")
+	}
+	b.mustPost("/webauthn/login/finish", auth.get(t, options))
+	if b.cookie("/", passkeyCookieName) != "" {
+		t.Error("finish did not clear the ceremony cookie")
+	}
+
+	// 用保存下来的 Cookie 和同一个挑战的新断言再完成一次: 仪式已经用掉了
+	replay := newBrowser(t, srv)
+	u, _ := url.Parse(srv.URL)
+	replay.client.Jar.SetCookies(u, []*http.Cookie{{Name: passkeyCookieName, Value: ceremony, Path: "/"}})
+	status, body := replay.post("/webauthn/login/finish", auth.get(t, options))
+	if status != http.StatusBadRequest {
+		t.Errorf("status = %d %s, want 400", status, body)
+	}
+	if replay.cookie("/", sessionCookieName) != "" {
+		t.Error("a session was created")
+	}
+}
+
+func TestPasskeyCeremonyKindMismatch(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+	auth := newSoftAuthenticator(t, srv)
+	b := newBrowser(t, srv)
+	b.signIn(amrPassword, amrOTP)
+
+	// 注册仪式的 Cookie 不能用来完成无密码登录
+	options := b.mustPost("/webauthn/register/begin", nil)
+	if status, _ := b.post("/webauthn/login/finish", auth.assert(t, parseOptions(t, options).PublicKey.Challenge)); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", status)
+	}
+}
+
+func TestPasskeySecondFactor(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+	auth := newSoftAuthenticator(t, srv)
+	registerPasskey(t, srv, auth)
+
+	// 密码验证通过，等待第二步验证
+	b := newBrowser(t, srv)
+	rec := httptest.NewRecorder()
+	if err := rootRealm.startMFAChallenge(rec, "alice", "", amrPassword); err != nil {
+		t.Fatal(err)
+	}
+	b.setCookies(rec)
+
+	options := b.mustPost("/login/mfa/passkey/begin?return_to=/account/mfa", nil)
+	done := b.mustPost("/login/mfa/passkey/finish?return_to=/account/mfa", auth.get(t, options))
+	if got := redirectOf(t, done); got != "/account/mfa" {
+		t.Errorf("redirect = %q, want /account/mfa", got)
+	}
+	sess := b.session()
+	if want := []string{amrPassword, amrHardwareKey}; !reflect.DeepEqual(sess.AMR, want) {
+		t.Errorf("amr = %v, want %v", sess.AMR, want)
+	}
+	if b.cookie("/login/mfa", mfaCookieName) != "" {
+		t.Error("the MFA challenge cookie was not cleared")
+	}
+
+	// 第二步验证已经结束，不能再开始新的通行密钥验证
+	if status, _ := b.post("/login/mfa/passkey/begin", nil); status != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", status)
+	}
+}
+
+func TestPasskeySecondFactorRejected(t *testing.T) {
+	srv := newPasskeyTestServer(t)
+	auth := newSoftAuthenticator(t, srv)
+	registerPasskey(t, srv, auth)
+
+	b := newBrowser(t, srv)
+	rec := httptest.NewRecorder()
+	if err := rootRealm.startMFAChallenge(rec, "alice", "", amrPassword); err != nil {
+		t.Fatal(err)
+	}
+	b.setCookies(rec)
+
+	options := b.mustPost("/login/mfa/passkey/begin", nil)
+	auth.origin = "https://evil.example"
+	if status, body := b.post("/login/mfa/passkey/finish", auth.get(t, options)); status != http.StatusUnauthorized {
+		t.Errorf("status = %d %s, want 401", status, body)
+	}
+	if b.cookie("/", sessionCookieName) != "" {
+		t.Error("a session was created")
+	}
+
+	// 失败后仪式已经用掉，同一个挑战的正确断言也不再被接受
+	auth.origin = srv.URL
+	if status, _ := b.post("/login/mfa/passkey/finish", auth.get(t, options)); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", status)
+	}
+}
@@ -0,0 +1,267 @@
+// password.go - 密码哈希与密码策略
+// 用户密码只以哈希形式保存: 新的哈希使用 argon2id，也接受 bcrypt 哈希 (例如从其他系统导入的用户)。
+// 用户登录成功时，如果哈希使用的是旧算法或旧参数，会用当前参数重新计算并保存。
+// 设置新密码时会检查密码策略，包括本地的已泄露密码列表。
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 当前的 argon2id 参数 (OWASP 推荐的最低配置: 19 MiB 内存, 2 次迭代, 1 个线程)
+const (
+	argon2Time    = 2
+	argon2Memory  = 19 * 1024
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// dummyPasswordHash 用于用户名不存在时的比较，让这种情况和密码错误花费相同的时间，避免泄露哪些用户名存在
+var dummyPasswordHash, _ = hashPassword("dummy-password")
+
+// PasswordPolicy 是设置新密码时的要求
+type PasswordPolicy struct {
+	MinLength     int  `yaml:"min_length"`
+	RequireUpper  bool `yaml:"require_upper"`
+	RequireLower  bool `yaml:"require_lower"`
+	RequireDigit  bool `yaml:"require_digit"`
+	RequireSymbol bool `yaml:"require_symbol"`
+	// BreachedList 是已泄露密码列表的文件路径，每行一个明文密码或其 SHA-1 (HIBP 格式 "SHA1:次数" 也可以)
+	BreachedList string `yaml:"breached_list"`
+
+	// breached 是从 BreachedList 加载的密码 SHA-1 集合
+	breached map[string]bool
+}
+
+// hashPassword 用当前的 argon2id 参数计算密码哈希，格式为 PHC 字符串:
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	salt, err := generateRandomBytes(argon2SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword 检查密码是否与哈希匹配。needsRehash 表示哈希不是用当前算法和参数计算的，
+// 登录成功后应该重新计算并保存
+func verifyPassword(hash, password string) (ok, needsRehash bool) {
+	if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, true
+	}
+
+	p, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false, false
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	ok = subtle.ConstantTimeCompare(key, p.key) == 1
+	needsRehash = p.time != argon2Time || p.memory != argon2Memory || p.threads != argon2Threads ||
+		len(p.key) != argon2KeyLen || len(p.salt) != argon2SaltLen
+	return ok, needsRehash
+}
+
+// argon2Params 是从 PHC 字符串中解析出的参数
+type argon2Params struct {
+	time, memory uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func parseArgon2Hash(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errors.New("不支持的密码哈希格式")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("不支持的 argon2 版本")
+	}
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, errors.New("无效的 argon2 参数")
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("无效的 argon2 盐值")
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return nil, errors.New("无效的 argon2 哈希值")
+	}
+	return &p, nil
+}
+
+// isSupportedPasswordHash 判断是否为可以验证的密码哈希 (argon2id 或 bcrypt)
+func isSupportedPasswordHash(hash string) bool {
+	if _, err := bcrypt.Cost([]byte(hash)); err == nil {
+		return true
+	}
+	_, err := parseArgon2Hash(hash)
+	return err == nil
+}
+
+// secretsEqual 以常量时间比较两个密钥，避免通过响应时间逐字节猜出客户端密钥
+func secretsEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// check 检查新密码是否符合策略，返回第一个不满足的要求
+func (p *PasswordPolicy) check(password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return &localizedError{msg("password.too_short", p.MinLength)}
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+	switch {
+	case p.RequireUpper && !upper:
+		return &localizedError{msg("password.need_upper")}
+	case p.RequireLower && !lower:
+		return &localizedError{msg("password.need_lower")}
+	case p.RequireDigit && !digit:
+		return &localizedError{msg("password.need_digit")}
+	case p.RequireSymbol && !symbol:
+		return &localizedError{msg("password.need_symbol")}
+	}
+	if p.breached[sha1Hex(password)] {
+		return &localizedError{msg("password.breached")}
+	}
+	return nil
+}
+
+// loadBreachedList 读取已泄露密码列表
+func (p *PasswordPolicy) loadBreachedList() error {
+	p.breached = make(map[string]bool)
+	if p.BreachedList == "" {
+		return nil
+	}
+	f, err := os.Open(p.BreachedList)
+	if err != nil {
+		return fmt.Errorf("无法读取已泄露密码列表: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// HIBP 格式: 40 位十六进制的 SHA-1，后面可能跟着 ":出现次数"
+		if h, _, _ := strings.Cut(line, ":"); len(h) == 40 {
+			if _, err := hex.DecodeString(h); err == nil {
+				p.breached[strings.ToUpper(h)] = true
+				continue
+			}
+		}
+		p.breached[sha1Hex(line)] = true
+	}
+	return scanner.Err()
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// handleChangePassword 是修改密码的页面，需要先登录。新密码必须符合密码策略。
+// 持有会话的人可以在这里猜当前密码，所以输错和登录一样计入登录限制
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess == nil {
+		rlm.redirect(w, r, "/login?return_to=/account/password")
+		return
+	}
+
+	var message Message
+	if r.Method == http.MethodPost {
+		if loginThrottled(w, r, sess.UserID) {
+			return
+		}
+		r.ParseForm()
+		message = changePassword(r, sess, r.PostForm.Get("current_password"), r.PostForm.Get("new_password"), r.PostForm.Get("confirm_password"))
+	}
+
+	renderPage(w, r, "password.html", page{Title: "title.password", Message: message})
+}
+
+// changePassword 验证当前密码和新密码，保存新的哈希，返回显示给用户的结果。
+// 修改成功后结束用户的其他会话 (发送 back-channel logout)，只保留当前会话
+func changePassword(r *http.Request, sess *Session, current, next, confirm string) Message {
+	rlm := requestRealm(r)
+	username := sess.UserID
+	user, err := rlm.store.GetUser(username)
+	if err != nil {
+		return msg("password.user_not_found")
+	}
+	if ok, _ := verifyPassword(user.PasswordHash, current); !ok {
+		recordFailedLogin(r, AuditEvent{Username: username, SessionID: sess.Sid, Detail: "bad_password password_change"})
+		return msg("password.wrong_current")
+	}
+	if next != confirm {
+		return msg("password.mismatch")
+	}
+	if err := rlm.currentConfig().PasswordPolicy.check(next); err != nil {
+		return messageOf(err)
+	}
+	hash, err := hashPassword(next)
+	if err != nil {
+		return msg("password.hash_failed")
+	}
+	// 在事务中保存，只有验证过的密码仍然是当前密码时才替换，不会覆盖同时进行的其他修改
+	err = rlm.store.UpdateUser(username, func(u *User) error {
+		if u.PasswordHash != user.PasswordHash {
+			return errPasswordChanged
+		}
+		u.PasswordHash = hash
+		return nil
+	})
+	if errors.Is(err, errPasswordChanged) {
+		return msg("password.wrong_current")
+	} else if err != nil {
+		return msg("password.save_failed")
+	}
+	slog.InfoContext(r.Context(), "用户修改了密码", "username", username)
+
+	// 其他地方的会话可能属于知道旧密码的人
+	ended, err := endUserSessions(r, username, sess.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "结束用户的其他会话失败", "username", username, "error", err)
+		return msg("password.save_failed")
+	}
+	if ended > 0 {
+		return msg("password.changed_signed_out", ended)
+	}
+	return msg("password.changed")
+}
+
+// errPasswordChanged 表示验证当前密码之后，密码已经被同时进行的另一个请求修改
+var errPasswordChanged = errors.New("密码已被修改")
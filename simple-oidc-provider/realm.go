@@ -0,0 +1,309 @@
+// realm.go - 多租户 realm
+// 一个 Provider 可以托管多个相互隔离的 realm (租户)。每个 realm 有自己的颁发者、发现文档、JWKS、签名密钥、
+// 客户端、用户、存储和主题: 一个 realm 签发的令牌在另一个 realm 中无法通过验证，会话、Cookie 和登录失败记录也互不相通。
+//
+// 顶层配置就是默认 realm，挂载在根路径，行为与之前完全相同。realms 中的每一项挂载在 /realms/{name}，
+// 颁发者为 <issuer>/realms/{name}，所有端点 (包括管理 API 和管理控制台) 都在这个前缀下面。
+// withRealm 根据路径找到 realm，去掉前缀后交给同一套路由，处理函数通过 requestRealm(r) 取得它。
+// 处理函数中的本站地址 (重定向、表单、链接、return_to) 都是 realm 内的路径，输出前用 realm.path 加上前缀。
+//
+// 监听地址、TLS、存储类型、审计、追踪、日志和登录限制是全局的设置。realm 可以设置自己的
+// lifetimes、password_policy、default_locale 和 admin.token，没有设置时使用顶层的值；keys、theme、clients、users 和
+// identity_providers 不会继承。设置了自己的 admin.token 的 realm 只接受这个令牌，顶层的令牌不能管理它。
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// realmPathPrefix 是 realm 的路径前缀，后面跟着 realm 的名称
+const realmPathPrefix = "/realms/"
+
+// realmNamePattern 限制 realm 的名称，名称会出现在 URL、Cookie 名称和数据库文件名中
+var realmNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// RealmConfig 是 realms 中的一项
+type RealmConfig struct {
+	// Name 是 realm 的名称，只能使用小写字母、数字和 -
+	Name string `yaml:"name"`
+	// Keys 没有设置 key_id 时使用 "<name>-signing-key"
+	Keys KeysConfig `yaml:"keys"`
+	// Lifetimes 中没有设置的项使用顶层的值
+	Lifetimes *LifetimesConfig `yaml:"lifetimes"`
+	// PasswordPolicy 设置后整体替换顶层的密码策略
+	PasswordPolicy *PasswordPolicy `yaml:"password_policy"`
+	Theme          ThemeConfig     `yaml:"theme"`
+	DefaultLocale  string          `yaml:"default_locale"`
+	// Admin 设置 realm 自己的管理令牌，取代顶层的令牌；没有设置时顶层的令牌可以管理这个 realm
+	Admin AdminConfig `yaml:"admin"`
+	// Clients 和 Users 没有设置时 realm 中没有任何客户端和用户 (不使用内置的演示数据)
+	Clients []Client `yaml:"clients"`
+	Users   []User   `yaml:"users"`
+	// IdentityProviders 是 realm 的上游 Provider，见 broker.go
+	IdentityProviders []IdentityProvider `yaml:"identity_providers"`
+}
+
+// realmConfig 返回 realm 生效的完整配置: 全局的设置来自顶层配置 c，其余来自 rc
+func (c *Config) realmConfig(rc RealmConfig) *Config {
+	cfg := *c
+	cfg.Issuer = c.Issuer + realmPathPrefix + rc.Name
+	cfg.Store.Path = realmStorePath(c.Store.Path, rc.Name)
+	cfg.Keys = rc.Keys
+	if cfg.Keys.KeyID == "" {
+		cfg.Keys.KeyID = rc.Name + "-signing-key"
+	}
+	if l := rc.Lifetimes; l != nil {
+		for _, d := range []struct{ from, to *time.Duration }{
+			{&l.IDToken, &cfg.Lifetimes.IDToken},
+			{&l.AccessToken, &cfg.Lifetimes.AccessToken},
+			{&l.AuthCode, &cfg.Lifetimes.AuthCode},
+			{&l.Session, &cfg.Lifetimes.Session},
+		} {
+			if *d.from != 0 {
+				*d.to = *d.from
+			}
+		}
+	}
+	if rc.PasswordPolicy != nil {
+		cfg.PasswordPolicy = *rc.PasswordPolicy
+	}
+	cfg.Theme = rc.Theme
+	if rc.DefaultLocale != "" {
+		cfg.DefaultLocale = rc.DefaultLocale
+	}
+	if rc.Admin.Token != "" {
+		cfg.Admin = rc.Admin
+	}
+	cfg.Clients, cfg.Users = rc.Clients, rc.Users
+	cfg.IdentityProviders = rc.IdentityProviders
+	cfg.Realms = nil
+	return &cfg
+}
+
+// realmStorePath 返回 realm 的 bolt 数据库文件: oidc-provider.db 对应 oidc-provider.<name>.db
+func realmStorePath(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// realm 是一个运行中的 realm
+type realm struct {
+	// name 是 realm 的名称，默认 realm 为空
+	name string
+	// issuer 是颁发者 URL，运行期间不会改变
+	issuer string
+	// prefix 是路径前缀，默认 realm 为空，其他为 "/realms/<name>"
+	prefix string
+	// store 保存 realm 的客户端、用户、授权码、访问令牌和会话，每个 realm 使用单独的存储
+	store Store
+	// relyingParty 是 WebAuthn 依赖方的配置，见 passkey.go
+	relyingParty *webauthn.WebAuthn
+
+	// 以下随配置一起热加载，见 reload.go
+	activeConfig    atomic.Pointer[Config]
+	activeKeys      atomic.Pointer[signingKeys]
+	activeTemplates atomic.Pointer[template.Template]
+	activeCatalog   atomic.Pointer[catalog]
+
+	// 以下是进程内存中的短期状态，由全局的 mu 保护
+	// 已经兑换过的授权码，键为授权码，用于发现重放
+	redeemedCodes map[string]RedeemedCode
+	// 已使用过的 DPoP 证明 jti，值为证明的有效期，用于防重放
+	usedDPoPJTIs map[string]time.Time
+	// 最近的 back-channel logout 投递记录
+	logoutDeliveries []*LogoutDelivery
+	// CIBA 认证请求，键为 auth_req_id
+	cibaRequests map[string]*CIBARequest
+	// 等待输入验证码的登录，键为 Cookie 中的 ID
+	mfaChallenges map[string]*MFAChallenge
+	// 进行中的通行密钥注册和验证，键为 Cookie 中的 ID
+	passkeyCeremonies map[string]*passkeyCeremony
+	// 登录失败记录，键为 "user:<用户名>" 或 "ip:<地址>"
+	loginFailures map[string]*LoginFailures
+	// 进行中的上游登录，键为 state
+	brokerLogins map[string]*brokerLogin
+	// 读取过发现文档的上游 Provider，键为 ID。upstreamsConfig 是它们对应的配置，配置重新加载后清空
+	upstreams       map[string]*upstream
+	upstreamsConfig *Config
+}
+
+var (
+	// rootRealm 是默认 realm，使用顶层配置，挂载在根路径
+	rootRealm *realm
+	// namedRealms 是 realms 配置中的 realm，键为名称。启动时创建，运行期间不会增减
+	namedRealms map[string]*realm
+)
+
+// newRealm 为 cfg (默认 realm 为顶层配置，其他为 realmConfig 的结果) 打开存储并创建 realm。
+// 配置要等 applyConfig 时才生效
+func newRealm(name string, cfg *Config) (*realm, error) {
+	s, err := openStore(cfg.Store.Type, cfg.Store.Path)
+	if err != nil {
+		return nil, err
+	}
+	rp, err := newRelyingParty(cfg.Issuer)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("无法创建 WebAuthn 配置: %w", err)
+	}
+	rlm := &realm{
+		name:              name,
+		issuer:            cfg.Issuer,
+		store:             s,
+		relyingParty:      rp,
+		redeemedCodes:     make(map[string]RedeemedCode),
+		usedDPoPJTIs:      make(map[string]time.Time),
+		cibaRequests:      make(map[string]*CIBARequest),
+		mfaChallenges:     make(map[string]*MFAChallenge),
+		passkeyCeremonies: make(map[string]*passkeyCeremony),
+		loginFailures:     make(map[string]*LoginFailures),
+		brokerLogins:      make(map[string]*brokerLogin),
+	}
+	if name != "" {
+		rlm.prefix = realmPathPrefix + name
+	}
+	return rlm, nil
+}
+
+// openRealms 在启动时创建默认 realm 和配置中的所有 realm
+func openRealms(cfg *Config) error {
+	var err error
+	if rootRealm, err = newRealm("", cfg); err != nil {
+		return err
+	}
+	namedRealms = make(map[string]*realm, len(cfg.Realms))
+	for _, rc := range cfg.Realms {
+		rlm, err := newRealm(rc.Name, cfg.realmConfig(rc))
+		if err != nil {
+			closeRealms()
+			return fmt.Errorf("realm %s: %w", rc.Name, err)
+		}
+		namedRealms[rc.Name] = rlm
+	}
+	return nil
+}
+
+// closeRealms 关闭所有 realm 的存储
+func closeRealms() {
+	for _, rlm := range allRealms() {
+		if err := rlm.store.Close(); err != nil {
+			slog.Error("关闭存储失败", "realm", rlm.name, "error", err)
+		}
+	}
+}
+
+// allRealms 返回所有 realm，默认 realm 在前，其余按名称排序
+func allRealms() []*realm {
+	list := []*realm{rootRealm}
+	names := make([]string, 0, len(namedRealms))
+	for name := range namedRealms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		list = append(list, namedRealms[name])
+	}
+	return list
+}
+
+// currentConfig 返回 realm 当前生效的配置，调用方不能修改它
+func (rlm *realm) currentConfig() *Config {
+	return rlm.activeConfig.Load()
+}
+
+// logName 是日志和审计事件中 realm 的名称，默认 realm 记为 "-"
+func (rlm *realm) logName() string {
+	if rlm.name == "" {
+		return "-"
+	}
+	return rlm.name
+}
+
+// --- 路由 ---
+
+type realmKey struct{}
+
+// globalPaths 是属于整个 Provider 的端点，不在 realm 下面提供
+var globalPaths = map[string]bool{"/metrics": true, "/healthz": true, "/readyz": true}
+
+// withRealm 找到请求所属的 realm: /realms/{name}/... 属于 realm name，去掉前缀后交给 next；其他路径属于默认 realm。
+// 请求被换成了副本，所以 withMetrics 和 withRouteSpan 必须在它里面，才能看到 ServeMux 匹配到的模式
+func withRealm(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, realmPathPrefix)
+		if !ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), realmKey{}, rootRealm)))
+			return
+		}
+		name, path, _ := strings.Cut(rest, "/")
+		rlm := namedRealms[name]
+		if rlm == nil || globalPaths["/"+path] {
+			http.NotFound(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), realmKey{}, rlm)
+		ctx = withLogAttrs(ctx, slog.String("realm", name))
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("oidc.realm", name))
+		r2 := r.WithContext(ctx)
+		u := *r.URL
+		u.Path = "/" + path
+		// realm 的名称不需要转义，前缀在 RawPath 中的形式相同
+		u.RawPath = strings.TrimPrefix(r.URL.RawPath, rlm.prefix)
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// requestRealm 返回请求所属的 realm
+func requestRealm(r *http.Request) *realm {
+	if rlm, ok := r.Context().Value(realmKey{}).(*realm); ok {
+		return rlm
+	}
+	return rootRealm
+}
+
+// path 把 realm 内的本站路径 (例如 "/login?...") 转换为实际的路径
+func (rlm *realm) path(p string) string {
+	return rlm.prefix + p
+}
+
+// redirect 重定向到 realm 内的本站路径
+func (rlm *realm) redirect(w http.ResponseWriter, r *http.Request, p string) {
+	http.Redirect(w, r, rlm.path(p), http.StatusFound)
+}
+
+// cookieName 返回 Cookie 在 realm 中的名称。默认 realm 不变，其他 realm 加上 ".<name>" 后缀，
+// 这样即使浏览器同时发送根路径和 realm 路径下的 Cookie，也不会混淆
+func (rlm *realm) cookieName(name string) string {
+	if rlm.name == "" {
+		return name
+	}
+	return name + "." + rlm.name
+}
+
+// setCookie 设置 realm 的 Cookie: 名称见 cookieName，Path 是 realm 内的路径
+func (rlm *realm) setCookie(w http.ResponseWriter, c *http.Cookie) {
+	c.Name = rlm.cookieName(c.Name)
+	c.Path = rlm.path(c.Path)
+	http.SetCookie(w, c)
+}
+
+// cookie 读取 realm 的 Cookie
+func (rlm *realm) cookie(r *http.Request, name string) (*http.Cookie, error) {
+	return r.Cookie(rlm.cookieName(name))
+}
@@ -0,0 +1,299 @@
+// reload.go - 配置热加载
+// 收到 SIGHUP，或者配置文件、(任何 realm 的) 签名密钥文件、主题目录中的文件发生变化时，重新加载配置:
+// 所有 realm 新的客户端、用户、签名密钥、有效期、页面模板和消息目录一起生效；授权码、会话等进行中的状态保存在存储中，不受影响。
+// 新配置无效时记录错误并继续使用旧配置。
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce 是文件变化后等待的时间。编辑器保存文件时往往会连续触发好几个事件，只需要加载一次
+const reloadDebounce = 300 * time.Millisecond
+
+// applyConfig 让 next 生效。prev 为 nil 表示启动时的第一次加载。
+// 所有可能失败的步骤 (读取密钥、检查密钥轮换、解析模板、打开审计日志、写入存储) 都在替换之前完成，失败时旧配置保持不变。
+// 各个 realm 的存储是分开的，写入某个 realm 的存储失败时，之前的 realm 已经写入的客户端和用户会保留，下次加载时再次写入
+func applyConfig(next, prev *Config) error {
+	// 1. 监听地址、TLS、服务器超时、存储、追踪和 realm 的列表只能在启动时设置，修改它们需要重启
+	if prev != nil {
+		if next.Issuer != prev.Issuer || next.Listen != prev.Listen || next.TLS != prev.TLS || next.Server != prev.Server || next.Store != prev.Store || next.Tracing != prev.Tracing {
+			slog.Warn("issuer、listen、tls、server、store 和 tracing 的修改需要重启才能生效，本次继续使用原来的设置")
+		}
+		next.Issuer, next.Listen, next.TLS, next.Server, next.Store, next.Tracing = prev.Issuer, prev.Listen, prev.TLS, prev.Server, prev.Store, prev.Tracing
+	}
+
+	// 2. 为每个 realm 准备签名密钥、用户、页面模板和消息目录。新增的 realm 需要重启，
+	// 从配置中删除的 realm 在重启之前继续使用原来的配置
+	var updates []*realmUpdate
+	realmConfigs := make(map[string]RealmConfig, len(next.Realms))
+	for _, rc := range next.Realms {
+		realmConfigs[rc.Name] = rc
+		if namedRealms[rc.Name] == nil {
+			slog.Warn("新增 realm 需要重启才能生效", "realm", rc.Name)
+		}
+	}
+	for _, rlm := range allRealms() {
+		cfg := next
+		if rlm.name != "" {
+			rc, ok := realmConfigs[rlm.name]
+			if !ok {
+				slog.Warn("删除 realm 需要重启才能生效，本次继续使用原来的设置", "realm", rlm.name)
+				continue
+			}
+			cfg = next.realmConfig(rc)
+		}
+		u, err := rlm.prepareConfig(cfg)
+		if err != nil {
+			if rlm.name != "" {
+				err = fmt.Errorf("realm %s: %w", rlm.name, err)
+			}
+			return err
+		}
+		updates = append(updates, u)
+	}
+
+	// 3. 打开审计事件的输出 (可能是新的文件)
+	auditOut, err := openAuditOutput(next.Audit)
+	if err != nil {
+		return err
+	}
+
+	// 4. 在每个 realm 的存储中用一个事务更新客户端和用户，删除从配置中移除的记录
+	for _, u := range updates {
+		if err := u.rlm.store.ReplaceConfigured(u.cfg.Clients, u.users, u.removedClients, u.removedUsers); err != nil {
+			auditOut.close()
+			return fmt.Errorf("更新 realm %s 的客户端和用户失败: %w", u.rlm.logName(), err)
+		}
+	}
+
+	// 5. 替换日志设置、审计输出，以及各个 realm 的密钥、模板和配置
+	setupLogging(next.Log)
+	auditor.replace(auditOut, next.Audit.Retain)
+	for _, u := range updates {
+		u.rlm.activeKeys.Store(u.keys)
+		u.rlm.activeTemplates.Store(u.tmpl)
+		u.rlm.activeCatalog.Store(u.messages)
+		u.rlm.activeConfig.Store(u.cfg)
+	}
+	activeConfig.Store(next)
+	return nil
+}
+
+// realmUpdate 是为一个 realm 准备好的新配置，applyConfig 确认所有 realm 都没有问题后才让它们生效
+type realmUpdate struct {
+	rlm      *realm
+	cfg      *Config
+	keys     *signingKeys
+	users    []User
+	tmpl     *template.Template
+	messages *catalog
+	// removedClients 和 removedUsers 是从配置中移除、需要从存储中删除的记录
+	removedClients, removedUsers []string
+}
+
+// prepareConfig 为 realm 准备 cfg 中的签名密钥、用户、页面模板和消息目录，不修改任何状态
+func (rlm *realm) prepareConfig(cfg *Config) (*realmUpdate, error) {
+	prev := rlm.currentConfig()
+
+	// 1. 准备签名密钥。热加载时如果没有配置密钥文件，沿用当前 (启动时生成的) 密钥
+	var privateKey *rsa.PrivateKey
+	var err error
+	if prev != nil && cfg.Keys.SigningKeyFile == "" {
+		privateKey = rlm.currentKeys().current
+		// 通过管理 API 轮换过的密钥不在配置中，继续使用它自己的 key_id
+		if rlm.currentKeys().rotated {
+			cfg.Keys.KeyID = rlm.currentKeys().keyID
+		}
+	} else if privateKey, err = loadSigningKey(cfg.Keys.SigningKeyFile); err != nil {
+		return nil, err
+	}
+	keys, err := nextSigningKeys(rlm.currentKeys(), privateKey, cfg.Keys.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. 把配置中的明文密码转换为哈希，保留用户自己启用的两步验证
+	users, err := rlm.prepareConfiguredUsers(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. 解析页面模板和消息目录，主题中的文件有错误时不替换
+	tmpl, err := loadTemplates(cfg.Theme.Dir)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := loadCatalog(cfg.Theme.Dir, cfg.DefaultLocale)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &realmUpdate{rlm: rlm, cfg: cfg, keys: keys, users: users, tmpl: tmpl, messages: messages}
+	if prev != nil {
+		u.removedClients = removedIDs(prev.Clients, cfg.Clients, func(c Client) string { return c.ID })
+		u.removedUsers = removedIDs(prev.Users, cfg.Users, func(u User) string { return u.Username })
+	}
+	return u, nil
+}
+
+// prepareConfiguredUsers 返回写入存储用的用户列表，其中配置里的明文密码都已转换为哈希。
+// 如果存储中的哈希已经能验证这个明文密码 (之前加载过，或登录时升级过)，就沿用它，不必每次重新计算。
+// 明文密码不符合密码策略时只打印警告，方便在演示中使用简单的密码。
+// 配置中没有 totp_secret (或与存储中的相同) 时，保留存储中的 TOTP 密钥、防重放状态和恢复码；
+// 通行密钥和关联的上游账号不能在配置中设置，总是保留。否则用户自己启用的两步验证会在每次重启或重新加载时丢失
+func (rlm *realm) prepareConfiguredUsers(cfg *Config) ([]User, error) {
+	users := make([]User, len(cfg.Users))
+	for i, user := range cfg.Users {
+		existing, err := rlm.store.GetUser(user.Username)
+		found := err == nil
+		if user.Password != "" {
+			if err := cfg.PasswordPolicy.check(user.Password); err != nil {
+				slog.Warn("配置中用户的密码不符合密码策略", "username", user.Username, "error", err)
+			}
+			if ok, needsRehash := verifyPassword(existing.PasswordHash, user.Password); found && ok && !needsRehash {
+				user.PasswordHash = existing.PasswordHash
+			} else if user.PasswordHash, err = hashPassword(user.Password); err != nil {
+				return nil, err
+			}
+			user.Password = ""
+		}
+		if found && (user.TOTPSecret == "" || user.TOTPSecret == existing.TOTPSecret) {
+			user.TOTPSecret, user.TOTPLastStep, user.RecoveryCodes = existing.TOTPSecret, existing.TOTPLastStep, existing.RecoveryCodes
+		}
+		if found {
+			user.Passkeys, user.Identities = existing.Passkeys, existing.Identities
+		}
+		users[i] = user
+	}
+	return users, nil
+}
+
+// removedIDs 返回在 prev 中但不在 next 中的记录的 ID
+func removedIDs[T any](prev, next []T, id func(T) string) []string {
+	keep := make(map[string]bool, len(next))
+	for _, item := range next {
+		keep[id(item)] = true
+	}
+	var removed []string
+	for _, item := range prev {
+		if !keep[id(item)] {
+			removed = append(removed, id(item))
+		}
+	}
+	return removed
+}
+
+// reloadConfig 重新读取配置文件、环境变量和命令行参数，并让新配置生效
+func reloadConfig(reason string) {
+	slog.Info("重新加载配置", "reason", reason)
+	prev := currentConfig()
+	next, err := loadConfig(os.Args[1:])
+	if err == nil {
+		err = applyConfig(next, prev)
+	}
+	if err != nil {
+		slog.Error("配置重新加载失败，继续使用旧配置", "error", err)
+		return
+	}
+	slog.Info("配置已重新加载", "clients", len(next.Clients), "users", len(next.Users), "key_id", next.Keys.KeyID, "realms", len(next.Realms))
+}
+
+// watchConfig 在后台等待 SIGHUP 和配置文件的变化，并触发重新加载
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// 监听文件所在的目录而不是文件本身: 很多编辑器保存时会先写临时文件再重命名，直接监听文件会丢失后续的变化
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("无法监听配置文件的变化，只支持 SIGHUP 重新加载", "error", err)
+	} else {
+		defer watcher.Close()
+	}
+	// watched 是需要关注的文件；主题目录中的任何文件变化都需要重新加载，记录在 watchedDirs 中
+	watched := make(map[string]bool)
+	watchedDirs := make(map[string]bool)
+	watchFiles := func() {
+		if watcher == nil {
+			return
+		}
+		paths := []string{currentConfig().source}
+		var themeDirs []string
+		for _, rlm := range allRealms() {
+			cfg := rlm.currentConfig()
+			paths = append(paths, cfg.Keys.SigningKeyFile)
+			if cfg.Theme.Dir != "" {
+				themeDirs = append(themeDirs, cfg.Theme.Dir)
+			}
+		}
+		for _, path := range paths {
+			if path == "" {
+				continue
+			}
+			path, _ = filepath.Abs(path)
+			if watched[path] {
+				continue
+			}
+			if err := watcher.Add(filepath.Dir(path)); err != nil {
+				slog.Warn("无法监听文件的变化", "path", path, "error", err)
+				continue
+			}
+			watched[path] = true
+		}
+		for _, themeDir := range themeDirs {
+			themeDir, _ = filepath.Abs(themeDir)
+			for _, dir := range []string{themeDir, filepath.Join(themeDir, "locales")} {
+				if watchedDirs[dir] {
+					continue
+				}
+				if _, err := os.Stat(dir); err != nil {
+					continue // 主题不一定有 locales 目录
+				}
+				if err := watcher.Add(dir); err != nil {
+					slog.Warn("无法监听目录的变化", "path", dir, "error", err)
+					continue
+				}
+				watchedDirs[dir] = true
+			}
+		}
+	}
+	watchFiles()
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if watcher != nil {
+		events, errs = watcher.Events, watcher.Errors
+	}
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	var changed string
+	for {
+		select {
+		case <-hup:
+			reloadConfig("SIGHUP")
+			watchFiles()
+		case ev := <-events:
+			path, _ := filepath.Abs(ev.Name)
+			if (watched[path] || watchedDirs[filepath.Dir(path)]) && ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+				changed = path
+				debounce.Reset(reloadDebounce)
+			}
+		case <-debounce.C:
+			reloadConfig(changed + " 已修改")
+			watchFiles()
+		case err := <-errs:
+			slog.Error("监听配置文件出错", "error", err)
+		}
+	}
+}
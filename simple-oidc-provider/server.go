@@ -0,0 +1,225 @@
+// server.go - HTTP 服务器的生命周期
+// Provider 使用带有超时设置的 http.Server，避免慢速或不活动的客户端一直占用连接。
+// 收到 SIGTERM 或 SIGINT 时优雅退出: /readyz 立即开始返回 503，服务器不再接受新的连接，
+// 等待进行中的请求完成 (最多 server.shutdown_timeout)，然后输出缓冲中的 span 并关闭存储。
+//
+// GET /healthz 是存活检查，进程能处理请求就返回 200；GET /readyz 是就绪检查，
+// 签名密钥已加载、存储可以访问并且没有在退出时返回 200，否则返回 503 并列出没有通过的检查项。
+//
+// tls.self_signed 为 true 时使用自动生成的自签名证书，只用于开发和测试。
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ServerConfig 是 HTTP 服务器的超时设置，只在启动时生效
+type ServerConfig struct {
+	// ReadHeaderTimeout 是读取请求头的最长时间
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	// ReadTimeout 是读取整个请求 (包括请求体) 的最长时间
+	ReadTimeout time.Duration `yaml:"read_timeout"`
+	// WriteTimeout 是从读完请求头到写完响应的最长时间
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// IdleTimeout 是 keep-alive 连接在两个请求之间最多空闲多久
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout 是退出时等待进行中的请求完成的最长时间，超过后强制关闭剩余的连接
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// shuttingDown 在收到退出信号后为 true，/readyz 据此返回 503
+var shuttingDown atomic.Bool
+
+// newServer 按配置创建 HTTP 服务器。tls.self_signed 时在这里准备好证书
+func newServer(cfg *Config, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		// 服务器自己的错误 (例如 TLS 握手失败) 也通过 slog 输出
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	if cfg.TLS.SelfSigned {
+		cert, err := selfSignedCertificate(cfg.TLS, certificateHosts(cfg.Issuer))
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return srv, nil
+}
+
+// runServer 开始处理请求，直到 ctx 结束 (收到退出信号) 后优雅退出。
+// 监听失败时返回错误；正常退出时返回 nil
+func runServer(ctx context.Context, srv *http.Server, tlsCfg TLSConfig, shutdownTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		switch {
+		case srv.TLSConfig != nil:
+			errc <- srv.ListenAndServeTLS("", "")
+		case tlsCfg.CertFile != "":
+			errc <- srv.ListenAndServeTLS(tlsCfg.CertFile, tlsCfg.KeyFile)
+		default:
+			errc <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true)
+	slog.Info("收到退出信号，等待进行中的请求完成", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("等待请求完成超时，强制关闭剩余的连接", "error", err)
+		srv.Close()
+	}
+	slog.Info("HTTP 服务器已停止")
+	return nil
+}
+
+// --- 健康检查 ---
+
+// handleHealthz 是存活检查: 能处理请求就说明进程还活着
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, "ok", nil)
+}
+
+// handleReadyz 是就绪检查: 所有 realm 的签名密钥、存储都可用并且没有在退出时才接受流量
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"signing_key": "ok", "store": "ok", "server": "ok"}
+	ready := true
+	for _, rlm := range allRealms() {
+		where := ""
+		if rlm.name != "" {
+			where = "realm " + rlm.name + ": "
+		}
+		if keys := rlm.currentKeys(); keys == nil || keys.current == nil {
+			checks["signing_key"], ready = where+"签名密钥没有加载", false
+		}
+		if err := rlm.store.Ping(); err != nil {
+			checks["store"], ready = where+err.Error(), false
+		}
+	}
+	if shuttingDown.Load() {
+		checks["server"], ready = "正在退出", false
+	}
+	if !ready {
+		writeHealth(w, http.StatusServiceUnavailable, "unavailable", checks)
+		return
+	}
+	writeHealth(w, http.StatusOK, "ready", checks)
+}
+
+func writeHealth(w http.ResponseWriter, status int, state string, checks map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks,omitempty"`
+	}{state, checks})
+}
+
+// --- 自签名证书 ---
+
+// certificateHosts 返回自签名证书中的主机名: 颁发者 URL 的主机，以及本机的 localhost、127.0.0.1 和 ::1
+func certificateHosts(issuer string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if u, err := url.Parse(issuer); err == nil && u.Hostname() != "" && !containsString(hosts, u.Hostname()) {
+		hosts = append([]string{u.Hostname()}, hosts...)
+	}
+	return hosts
+}
+
+// selfSignedCertificate 返回开发用的自签名证书。设置了 cert_file 和 key_file 时，第一次启动生成证书并写入这两个文件，
+// 之后直接读取它们，证书在重启后保持不变，可以把 cert_file 加入客户端的信任列表；否则每次启动在内存中生成新的证书
+func selfSignedCertificate(cfg TLSConfig, hosts []string) (tls.Certificate, error) {
+	if cfg.CertFile != "" {
+		if _, err := os.Stat(cfg.CertFile); err == nil {
+			cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+			if err != nil {
+				return tls.Certificate{}, fmt.Errorf("无法读取自签名证书: %w", err)
+			}
+			return cert, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return tls.Certificate{}, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0], Organization: []string{"simple-oidc-provider development"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		// 证书同时作为自己的 CA，这样客户端可以直接把它作为受信任的根证书
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if cfg.CertFile != "" {
+		if err := os.WriteFile(cfg.KeyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, fmt.Errorf("无法保存自签名证书的私钥: %w", err)
+		}
+		if err := os.WriteFile(cfg.CertFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, fmt.Errorf("无法保存自签名证书: %w", err)
+		}
+		slog.Info("已生成自签名证书", "cert_file", cfg.CertFile, "hosts", hosts)
+	} else {
+		slog.Info("已在内存中生成自签名证书，重启后会变化", "hosts", hosts)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,131 @@
+// session.go - Provider 端的登录会话
+// 用户在 Provider 登录后，我们为其创建一个会话 (由 Cookie 中的会话 ID 标识)，
+// 并记录在这个会话中有哪些客户端获得过授权。这样用户再次访问其他客户端时无需重新登录 (SSO)，
+// 在用户退出登录时，我们也知道需要通知哪些客户端。会话保存在 realm 的 Store 中，Cookie 也按 realm 区分。
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// sessionCookieName 是 Provider 会话 Cookie 的名称
+	sessionCookieName = "op-session"
+)
+
+// Session 是用户在 Provider 上的一次登录会话
+type Session struct {
+	// ID 是 Cookie 的值，谁知道它谁就拥有这个会话，所以只保存在服务器端，不能出现在令牌或 URL 中
+	ID string
+	// Sid 是会话对外的标识: ID Token、logout_token、front-channel logout 地址和审计事件中的 sid
+	Sid    string
+	UserID string // 用户名，即存储中用户的键
+	// BrowserState 是 OP 浏览器状态 (opbs)，用于计算 session_state
+	BrowserState string
+	CreatedAt    time.Time
+	Expiry       time.Time
+	// AMR 是本会话完成的认证方式 (如 ["pwd"] 或 ["pwd", "otp"])
+	AMR []string
+	// PendingTOTPSecret 是用户正在 /account/mfa 启用、尚未确认的 TOTP 密钥
+	PendingTOTPSecret string
+	// Clients 是在本会话中获得过授权码的客户端 ID，退出登录时需要通知它们
+	Clients []string
+}
+
+// createSession 为登录成功的用户创建会话，并通过 Cookie 下发会话 ID。amr 是用户完成的认证方式
+func (rlm *realm) createSession(w http.ResponseWriter, userID string, amr []string) (*Session, error) {
+	id, err := generateRandomString(24)
+	if err != nil {
+		return nil, err
+	}
+	sid, err := generateRandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	browserState, err := generateRandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sess := &Session{
+		ID:           id,
+		Sid:          sid,
+		UserID:       userID,
+		BrowserState: browserState,
+		CreatedAt:    now,
+		Expiry:       now.Add(rlm.currentConfig().Lifetimes.Session),
+		AMR:          amr,
+	}
+
+	if err := rlm.store.SaveSession(*sess); err != nil {
+		return nil, err
+	}
+
+	rlm.setCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(rlm.currentConfig().Lifetimes.Session.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	rlm.setBrowserStateCookie(w, browserState)
+	return sess, nil
+}
+
+// currentSession 根据请求中的 Cookie 找到当前有效的会话，没有则返回 nil
+func currentSession(r *http.Request) *Session {
+	rlm := requestRealm(r)
+	cookie, err := rlm.cookie(r, sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	sess, err := rlm.store.GetSession(cookie.Value)
+	if err != nil || time.Now().After(sess.Expiry) {
+		return nil
+	}
+	return &sess
+}
+
+// findSessionBySid 按对外的 sid 查找会话，管理 API 和控制台用它来指定会话，这样 Cookie 的值不会离开服务器
+func (rlm *realm) findSessionBySid(sid string) (Session, error) {
+	sessions, err := rlm.store.ListSessions()
+	if err != nil {
+		return Session{}, err
+	}
+	for _, sess := range sessions {
+		if sid != "" && sess.Sid == sid {
+			return sess, nil
+		}
+	}
+	return Session{}, errNotFound
+}
+
+// addSessionClient 记录某个客户端参与了该会话
+func (rlm *realm) addSessionClient(sess *Session, clientID string) error {
+	if containsString(sess.Clients, clientID) {
+		return nil
+	}
+	sess.Clients = append(sess.Clients, clientID)
+	return rlm.store.SaveSession(*sess)
+}
+
+// endSession 删除会话并清除 Cookie，返回被删除的会话 (可能为 nil)
+func endSession(w http.ResponseWriter, r *http.Request) *Session {
+	rlm := requestRealm(r)
+	sess := currentSession(r)
+	if sess != nil {
+		rlm.store.DeleteSession(sess.ID)
+	}
+	rlm.setCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	rlm.clearBrowserStateCookie(w)
+	return sess
+}
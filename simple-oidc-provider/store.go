@@ -0,0 +1,496 @@
+// store.go - 存储接口与内存实现
+// Provider 的持久化状态 (客户端、用户、授权码、访问令牌、同意授权记录和登录会话) 都通过 Store 接口读写，
+// 这样可以在内存存储 (重启即丢失，适合演示) 和嵌入式的 BoltDB 文件存储 (重启后保留) 之间切换。
+// CIBA 请求、DPoP jti 等短期状态仍然保存在进程内存中。
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errNotFound 表示存储中没有对应的记录
+var errNotFound = errors.New("记录不存在")
+
+// Store 是 Provider 的持久化存储。Get 系列方法在记录不存在时返回 errNotFound
+type Store interface {
+	GetClient(id string) (Client, error)
+	ListClients() ([]Client, error)
+	SaveClient(client Client) error
+	DeleteClient(id string) error
+
+	// 用户以用户名为键
+	GetUser(username string) (User, error)
+	ListUsers() ([]User, error)
+	SaveUser(user User) error
+	// UpdateUser 在同一个事务中读取用户、交给 fn 修改并保存。fn 返回错误时不保存，并原样返回这个错误。
+	// fn 中不能再调用 Store 的方法
+	UpdateUser(username string, fn func(user *User) error) error
+	DeleteUser(username string) error
+
+	SaveAuthCode(code string, data AuthCodeData) error
+	// TakeAuthCode 取出并删除授权码，保证授权码只能使用一次
+	TakeAuthCode(code string) (AuthCodeData, error)
+	// CountAuthCodes 返回已签发、尚未兑换也没有过期的授权码数量
+	CountAuthCodes(now time.Time) (int, error)
+
+	SaveToken(token TokenRecord) error
+	GetToken(id string) (TokenRecord, error)
+	// ListTokens 返回所有访问令牌记录，按 jti 排序
+	ListTokens() ([]TokenRecord, error)
+	DeleteToken(id string) error
+	// DeleteTokens 删除客户端代表用户 (subject 即 sub) 持有的全部访问令牌，返回删除的数量。
+	// subject 或 clientID 为空时匹配任意值
+	DeleteTokens(subject, clientID string) (int, error)
+
+	// 授权记录以 (用户登录名, 客户端 ID) 为键
+	GetGrant(userID, clientID string) (Grant, error)
+	// ListGrants 返回用户的全部授权，按客户端 ID 排序
+	ListGrants(userID string) ([]Grant, error)
+	SaveGrant(grant Grant) error
+	DeleteGrant(userID, clientID string) error
+
+	SaveSession(sess Session) error
+	GetSession(id string) (Session, error)
+	// ListSessions 返回所有会话 (包括已过期但还没有被清理的)，按创建时间排序
+	ListSessions() ([]Session, error)
+	DeleteSession(id string) error
+
+	// ReplaceConfigured 在一个事务中写入配置中的客户端和用户 (覆盖同 ID 的记录)，
+	// 并删除已经从配置中移除的客户端和用户
+	ReplaceConfigured(clients []Client, users []User, removedClients, removedUsers []string) error
+	// Reset 在一个事务中清空所有数据，只留下给出的客户端和用户 (即配置中的)
+	Reset(clients []Client, users []User) error
+
+	// DeleteExpired 删除所有已过期的授权码、访问令牌和会话，返回删除的数量
+	DeleteExpired(now time.Time) (int, error)
+	// Ping 检查存储是否可以访问，用于就绪检查
+	Ping() error
+	Close() error
+}
+
+// TokenRecord 是已签发访问令牌的记录，以 jti 为键。
+// 访问令牌本身是自包含的 JWT，只有存储中还有记录的令牌才会被 /userinfo 接受。
+type TokenRecord struct {
+	ID       string
+	ClientID string
+	Subject  string
+	Scope    string
+	IssuedAt time.Time
+	Expiry   time.Time
+}
+
+// matches 判断令牌是否由 clientID 代表 subject 持有，参数为空时匹配任意值
+func (t TokenRecord) matches(subject, clientID string) bool {
+	return (subject == "" || t.Subject == subject) && (clientID == "" || t.ClientID == clientID)
+}
+
+// openStore 根据类型打开存储: "memory" 或 "bolt" (path 为数据库文件路径)
+func openStore(kind, path string) (Store, error) {
+	switch kind {
+	case "memory", "":
+		return newMemoryStore(), nil
+	case "bolt":
+		return newBoltStore(path)
+	default:
+		return nil, fmt.Errorf("未知的存储类型: %s", kind)
+	}
+}
+
+// runExpiryCleanup 在后台定期清理过期的记录，避免授权码、令牌和会话越积越多
+func runExpiryCleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		n := 0
+		for _, rlm := range allRealms() {
+			n += rlm.deleteExpired(now)
+		}
+
+		if n > 0 {
+			slog.Debug("已清理过期记录", "count", n)
+		}
+	}
+}
+
+// deleteExpired 清理 realm 中过期的记录，返回清理的数量
+func (rlm *realm) deleteExpired(now time.Time) int {
+	n, err := rlm.store.DeleteExpired(now)
+	if err != nil {
+		slog.Error("清理过期记录失败", "realm", rlm.logName(), "error", err)
+	}
+
+	// 进程内存中的 DPoP jti、CIBA 请求、两步验证、通行密钥仪式、上游登录和登录失败记录也一并清理
+	mu.Lock()
+	defer mu.Unlock()
+	for jti, expiry := range rlm.usedDPoPJTIs {
+		if now.After(expiry) {
+			delete(rlm.usedDPoPJTIs, jti)
+			n++
+		}
+	}
+	for id, req := range rlm.cibaRequests {
+		if now.After(req.Expiry) {
+			delete(rlm.cibaRequests, id)
+			n++
+		}
+	}
+	for id, ch := range rlm.mfaChallenges {
+		if now.After(ch.Expiry) {
+			delete(rlm.mfaChallenges, id)
+			n++
+		}
+	}
+	for id, c := range rlm.passkeyCeremonies {
+		if now.After(c.Expiry) {
+			delete(rlm.passkeyCeremonies, id)
+			n++
+		}
+	}
+	for state, login := range rlm.brokerLogins {
+		if now.After(login.Expiry) {
+			delete(rlm.brokerLogins, state)
+			n++
+		}
+	}
+	return n + rlm.pruneLoginFailures(now)
+}
+
+// --- 内存存储 ---
+
+// memoryStore 把所有数据保存在 map 中，进程重启后数据丢失
+type memoryStore struct {
+	mu        sync.Mutex
+	clients   map[string]Client
+	users     map[string]User
+	authCodes map[string]AuthCodeData
+	tokens    map[string]TokenRecord
+	grants    map[grantKey]Grant
+	sessions  map[string]Session
+}
+
+// grantKey 是内存存储中授权记录的键
+type grantKey struct{ userID, clientID string }
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{}
+	s.clear()
+	return s
+}
+
+// clear 清空所有数据，调用者需要持有 s.mu (创建时除外)
+func (s *memoryStore) clear() {
+	s.clients = make(map[string]Client)
+	s.users = make(map[string]User)
+	s.authCodes = make(map[string]AuthCodeData)
+	s.tokens = make(map[string]TokenRecord)
+	s.grants = make(map[grantKey]Grant)
+	s.sessions = make(map[string]Session)
+}
+
+func (s *memoryStore) GetClient(id string) (Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, ok := s.clients[id]
+	if !ok {
+		return Client{}, errNotFound
+	}
+	return client, nil
+}
+
+func (s *memoryStore) ListClients() ([]Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		list = append(list, client)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (s *memoryStore) SaveClient(client Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[client.ID] = client
+	return nil
+}
+
+func (s *memoryStore) DeleteClient(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, id)
+	return nil
+}
+
+func (s *memoryStore) GetUser(username string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return User{}, errNotFound
+	}
+	return user, nil
+}
+
+func (s *memoryStore) ListUsers() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		list = append(list, user)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list, nil
+}
+
+func (s *memoryStore) SaveUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *memoryStore) UpdateUser(username string, fn func(user *User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return errNotFound
+	}
+	if err := fn(&user); err != nil {
+		return err
+	}
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, username)
+	return nil
+}
+
+func (s *memoryStore) SaveAuthCode(code string, data AuthCodeData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authCodes[code] = data
+	return nil
+}
+
+func (s *memoryStore) TakeAuthCode(code string) (AuthCodeData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.authCodes[code]
+	if !ok {
+		return AuthCodeData{}, errNotFound
+	}
+	delete(s.authCodes, code)
+	return data, nil
+}
+
+func (s *memoryStore) CountAuthCodes(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, data := range s.authCodes {
+		if now.Before(data.Expiry) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) SaveToken(token TokenRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.ID] = token
+	return nil
+}
+
+func (s *memoryStore) GetToken(id string) (TokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[id]
+	if !ok {
+		return TokenRecord{}, errNotFound
+	}
+	return token, nil
+}
+
+func (s *memoryStore) ListTokens() ([]TokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]TokenRecord, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		list = append(list, token)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (s *memoryStore) DeleteToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, id)
+	return nil
+}
+
+func (s *memoryStore) DeleteTokens(subject, clientID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, token := range s.tokens {
+		if token.matches(subject, clientID) {
+			delete(s.tokens, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) GetGrant(userID, clientID string) (Grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grant, ok := s.grants[grantKey{userID, clientID}]
+	if !ok {
+		return Grant{}, errNotFound
+	}
+	grant.Scopes = append([]string(nil), grant.Scopes...)
+	return grant, nil
+}
+
+func (s *memoryStore) ListGrants(userID string) ([]Grant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []Grant
+	for key, grant := range s.grants {
+		if key.userID == userID {
+			grant.Scopes = append([]string(nil), grant.Scopes...)
+			list = append(list, grant)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ClientID < list[j].ClientID })
+	return list, nil
+}
+
+func (s *memoryStore) SaveGrant(grant Grant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grant.Scopes = append([]string(nil), grant.Scopes...)
+	s.grants[grantKey{grant.UserID, grant.ClientID}] = grant
+	return nil
+}
+
+func (s *memoryStore) DeleteGrant(userID, clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.grants, grantKey{userID, clientID})
+	return nil
+}
+
+func (s *memoryStore) SaveSession(sess Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 复制切片，避免调用方之后修改切片影响到存储中的数据
+	sess.Clients = append([]string(nil), sess.Clients...)
+	sess.AMR = append([]string(nil), sess.AMR...)
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+func (s *memoryStore) GetSession(id string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return Session{}, errNotFound
+	}
+	sess.Clients = append([]string(nil), sess.Clients...)
+	sess.AMR = append([]string(nil), sess.AMR...)
+	return sess, nil
+}
+
+func (s *memoryStore) ListSessions() ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sess.Clients = append([]string(nil), sess.Clients...)
+		sess.AMR = append([]string(nil), sess.AMR...)
+		list = append(list, sess)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (s *memoryStore) DeleteSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memoryStore) ReplaceConfigured(clients []Client, users []User, removedClients, removedUsers []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range removedClients {
+		delete(s.clients, id)
+	}
+	for _, username := range removedUsers {
+		delete(s.users, username)
+	}
+	for _, client := range clients {
+		s.clients[client.ID] = client
+	}
+	for _, user := range users {
+		s.users[user.Username] = user
+	}
+	return nil
+}
+
+func (s *memoryStore) Reset(clients []Client, users []User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clear()
+	for _, client := range clients {
+		s.clients[client.ID] = client
+	}
+	for _, user := range users {
+		s.users[user.Username] = user
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for code, data := range s.authCodes {
+		if now.After(data.Expiry) {
+			delete(s.authCodes, code)
+			n++
+		}
+	}
+	for id, token := range s.tokens {
+		if now.After(token.Expiry) {
+			delete(s.tokens, id)
+			n++
+		}
+	}
+	for id, sess := range s.sessions {
+		if now.After(sess.Expiry) {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) Ping() error { return nil }
+
+func (s *memoryStore) Close() error { return nil }
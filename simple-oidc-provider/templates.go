@@ -0,0 +1,118 @@
+// templates.go - Provider 页面的模板
+// 登录、同意授权、两步验证等页面都用 html/template 渲染，插入的值会按所在位置 (HTML、属性、URL、脚本) 自动转义。
+// 默认模板在 templates/ 目录中，编译时嵌入程序。配置 theme.dir 后，该目录中同名的 .html 文件会替换默认模板，
+// 其中 static/ 子目录的文件通过 /theme/ 提供，可以放样式表和图片。每个 realm 有自己的主题。
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+// ThemeConfig 是页面主题的配置
+type ThemeConfig struct {
+	// Dir 是自定义模板所在的目录，为空时使用内置模板
+	Dir string `yaml:"dir"`
+}
+
+// page 是传给页面模板的数据。模板中用 {{.T "键" 参数...}} 输出当前语言的文字，见 i18n.go
+type page struct {
+	// Title 是标题在消息目录中的键
+	Title string
+	// Message 是页面顶部显示的提示，例如 "验证码不正确"
+	Message Message
+	// Action 是页面上表单提交的地址 (realm 内的路径)，默认是当前页面的地址
+	Action string
+	// CSRF 是 Action 对应的 CSRF 令牌，表单中用 {{template "csrf" .}} 输出
+	CSRF string
+	// Data 是各个页面自己的数据
+	Data any
+	// Lang 是页面的语言
+	Lang string
+
+	catalog *catalog
+	realm   *realm
+}
+
+// URL 把 realm 内的本站路径转换为实际的路径，模板中的链接都要经过它，例如 {{.URL "/account/mfa"}}
+func (p page) URL(path string) string {
+	return p.realm.path(path)
+}
+
+// T 返回 key 在页面语言中的文字
+func (p page) T(key string, args ...any) template.HTML {
+	return p.catalog.html(p.Lang, key, args...)
+}
+
+// Text 返回消息在页面语言中的文字。纯文字的消息 (Key 为空) 转义后返回
+func (p page) Text(m Message) template.HTML {
+	if m.Key == "" {
+		return template.HTML(template.HTMLEscapeString(m.Text))
+	}
+	return p.T(m.Key, m.Args...)
+}
+
+// loadTemplates 解析内置模板，再用 dir 中的同名模板覆盖
+func loadTemplates(dir string) (*template.Template, error) {
+	t, err := template.ParseFS(defaultTemplates, "templates/*.html")
+	if err != nil {
+		return nil, fmt.Errorf("解析内置模板失败: %w", err)
+	}
+	if dir == "" {
+		return t, nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("无法读取主题目录: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		if t, err = t.ParseFiles(files...); err != nil {
+			return nil, fmt.Errorf("解析主题模板失败: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// renderPage 用模板 name 渲染页面。先渲染到缓冲区，模板出错时返回 500 而不是半个页面
+func renderPage(w http.ResponseWriter, r *http.Request, name string, p page) {
+	rlm := requestRealm(r)
+	if p.Action == "" {
+		p.Action = r.URL.RequestURI()
+	}
+	p.Action = rlm.path(p.Action)
+	p.CSRF = csrfToken(w, r, p.Action)
+	p.catalog, p.Lang, p.realm = rlm.currentCatalog(), requestLocale(r), rlm
+
+	var buf bytes.Buffer
+	if err := rlm.activeTemplates.Load().ExecuteTemplate(&buf, name, p); err != nil {
+		slog.ErrorContext(r.Context(), "渲染页面失败", "page", name, "error", err)
+		http.Error(w, "页面渲染失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", p.Lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Write(buf.Bytes())
+}
+
+// handleThemeStatic 提供 realm 的主题目录 static/ 中的文件
+func handleThemeStatic(w http.ResponseWriter, r *http.Request) {
+	dir := requestRealm(r).currentConfig().Theme.Dir
+	if dir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	http.StripPrefix("/theme/", http.FileServer(http.Dir(filepath.Join(dir, "static")))).ServeHTTP(w, r)
+}
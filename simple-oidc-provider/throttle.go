@@ -0,0 +1,190 @@
+// throttle.go - 登录的防暴力破解
+// 分别按用户名和客户端 IP 记录连续失败的次数:
+//   - 同一用户名连续失败 free_attempts 次之内 (同一 IP 为 ip_free_attempts 次，因为多个用户可能共用一个出口 IP) 不受限制
+//   - 之后每次失败都要等待 base_delay、2×base_delay、4×base_delay ... (最多 max_delay) 才能再试 (指数退避)
+//   - 连续失败达到 user_lockout / ip_lockout 次时锁定 lockout_duration，管理员可以通过管理 API 提前解锁
+//
+// 第二步输错的验证码 (见 mfa.go) 也计入用户名的失败，用户启用了第二因素时要等第二步通过后才清除记录。
+// 被限制的请求返回 429 和 Retry-After。不存在的用户名同样计数，响应不会透露用户名是否存在。
+// 超过 lockout_duration 没有新的失败时，之前的失败记录被忘记。状态保存在进程内存中，重启后清空。
+// 限制的设置是全局的，失败记录按 realm 分开: 同一个用户名在不同的 realm 中是不同的用户。
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LoginThrottle 是登录限制的配置
+type LoginThrottle struct {
+	FreeAttempts   int           `yaml:"free_attempts"`
+	IPFreeAttempts int           `yaml:"ip_free_attempts"`
+	BaseDelay      time.Duration `yaml:"base_delay"`
+	MaxDelay       time.Duration `yaml:"max_delay"`
+	// UserLockout 和 IPLockout 为 0 表示不锁定 (仍然有退避)
+	UserLockout     int           `yaml:"user_lockout"`
+	IPLockout       int           `yaml:"ip_lockout"`
+	LockoutDuration time.Duration `yaml:"lockout_duration"`
+}
+
+// LoginFailures 是一个用户名或 IP 的连续失败记录
+type LoginFailures struct {
+	Key         string    `json:"key"` // "user:<用户名>" 或 "ip:<地址>"
+	Count       int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitzero"`
+}
+
+func userThrottleKey(username string) string { return "user:" + username }
+
+func ipThrottleKey(ip string) string { return "ip:" + ip }
+
+// clientIP 返回请求的来源 IP。只使用连接的地址，不信任 X-Forwarded-For，否则攻击者可以随意伪造
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// backoff 返回某个键第 count 次连续失败之后需要等待的时间
+func (t LoginThrottle) backoff(key string, count int) time.Duration {
+	free := t.FreeAttempts
+	if strings.HasPrefix(key, "ip:") {
+		free = t.IPFreeAttempts
+	}
+	n := count - free
+	if n < 0 {
+		return 0
+	}
+	delay := t.BaseDelay
+	for i := 0; i < n && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, t.MaxDelay)
+}
+
+// expired 判断记录是否已经可以忘记: 没有锁定，且最近一次失败已超过 lockout_duration
+func (f *LoginFailures) expired(t LoginThrottle, now time.Time) bool {
+	return now.After(f.LockedUntil) && now.Sub(f.LastFailure) > t.LockoutDuration
+}
+
+// checkLoginThrottle 检查用户名和 IP 现在是否可以尝试登录，返回还需要等待的时间 (0 表示可以) 以及是否处于锁定状态
+func (rlm *realm) checkLoginThrottle(username, ip string, now time.Time) (wait time.Duration, locked bool) {
+	t := currentConfig().LoginThrottle
+	mu.Lock()
+	defer mu.Unlock()
+	for _, key := range []string{userThrottleKey(username), ipThrottleKey(ip)} {
+		f, ok := rlm.loginFailures[key]
+		if !ok {
+			continue
+		}
+		if f.expired(t, now) {
+			delete(rlm.loginFailures, key)
+			continue
+		}
+		if now.Before(f.LockedUntil) {
+			wait, locked = max(wait, f.LockedUntil.Sub(now)), true
+		} else if next := f.LastFailure.Add(t.backoff(key, f.Count)); now.Before(next) {
+			wait = max(wait, next.Sub(now))
+		}
+	}
+	return wait, locked
+}
+
+// recordLoginFailure 记录一次失败，返回因这次失败而被锁定的键
+func (rlm *realm) recordLoginFailure(username, ip string, now time.Time) []string {
+	t := currentConfig().LoginThrottle
+	limits := map[string]int{userThrottleKey(username): t.UserLockout, ipThrottleKey(ip): t.IPLockout}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var lockedKeys []string
+	for key, limit := range limits {
+		f, ok := rlm.loginFailures[key]
+		if !ok || f.expired(t, now) {
+			f = &LoginFailures{Key: key}
+			rlm.loginFailures[key] = f
+		}
+		f.Count++
+		f.LastFailure = now
+		if limit > 0 && f.Count >= limit && !now.Before(f.LockedUntil) {
+			f.LockedUntil = now.Add(t.LockoutDuration)
+			lockedKeys = append(lockedKeys, key)
+		}
+	}
+	sort.Strings(lockedKeys)
+	return lockedKeys
+}
+
+// recordLoginSuccess 在登录成功后清除该用户名的失败记录。IP 的记录保留，
+// 否则攻击者可以用自己的账户登录一次来重置来自同一 IP 的计数
+func (rlm *realm) recordLoginSuccess(username string) {
+	mu.Lock()
+	delete(rlm.loginFailures, userThrottleKey(username))
+	mu.Unlock()
+}
+
+// listLoginFailures 返回当前所有的失败记录 (包括已锁定的)，按键排序
+func (rlm *realm) listLoginFailures(now time.Time) []LoginFailures {
+	t := currentConfig().LoginThrottle
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]LoginFailures, 0, len(rlm.loginFailures))
+	for _, f := range rlm.loginFailures {
+		if !f.expired(t, now) {
+			list = append(list, *f)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// clearLoginFailures 清除某个键的失败记录 (解锁)，返回记录是否存在
+func (rlm *realm) clearLoginFailures(key string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := rlm.loginFailures[key]
+	delete(rlm.loginFailures, key)
+	return ok
+}
+
+// pruneLoginFailures 删除可以忘记的记录，返回删除的数量。调用方需要持有 mu
+func (rlm *realm) pruneLoginFailures(now time.Time) int {
+	t := currentConfig().LoginThrottle
+	n := 0
+	for key, f := range rlm.loginFailures {
+		if f.expired(t, now) {
+			delete(rlm.loginFailures, key)
+			n++
+		}
+	}
+	return n
+}
+
+// writeLoginThrottled 返回 429 响应，Retry-After 为需要等待的秒数 (向上取整)
+func writeLoginThrottled(w http.ResponseWriter, r *http.Request, wait time.Duration, locked bool) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	message := translate(r, "login.throttled", seconds)
+	if locked {
+		message = translate(r, "login.locked", (seconds+59)/60)
+	}
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// parseThrottleKey 把管理 API 路径中的类型和值转换为记录的键
+func parseThrottleKey(kind, value string) (string, bool) {
+	switch kind {
+	case "users":
+		return userThrottleKey(value), value != ""
+	case "ips":
+		return ipThrottleKey(value), value != "" && !strings.ContainsAny(value, "/ ")
+	}
+	return "", false
+}
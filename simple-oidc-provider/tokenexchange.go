@@ -0,0 +1,218 @@
+// tokenexchange.go - OAuth 2.0 令牌交换 (RFC 8693)
+// 后端服务收到用户的访问令牌后，可以用它换取一个面向其他受众 (audience)、权限更小的新令牌。
+// 不带 actor_token 时是 "模拟" (impersonation)：新令牌看起来就像是用户本人的令牌；
+// 带 actor_token 时是 "委托" (delegation)：新令牌的 act 声明记录了是谁在代表用户行事。
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeIDToken     = "urn:ietf:params:oauth:token-type:id_token"
+	tokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// TokenExchangePolicy 描述一个客户端被允许进行的令牌交换
+type TokenExchangePolicy struct {
+	// SubjectClients 是允许交换其令牌的客户端 ID (客户端自己的令牌总是允许的)
+	SubjectClients []string `yaml:"subject_clients"`
+	// Audiences 是新令牌允许面向的受众 (客户端自己的 ID 总是允许的)
+	Audiences []string `yaml:"audiences"`
+	// AllowImpersonation 允许不带 actor_token 的交换
+	AllowImpersonation bool `yaml:"allow_impersonation"`
+	// AllowDelegation 允许带 actor_token 的交换，新令牌中会包含 act 声明
+	AllowDelegation bool `yaml:"allow_delegation"`
+	// ActorClients 是允许作为 actor_token 的令牌的客户端 ID (客户端自己的令牌总是允许的)。
+	// 签发给其他客户端的令牌 (例如另一个用户的访问令牌) 不能冒充行事方
+	ActorClients []string `yaml:"actor_clients"`
+}
+
+// ActorClaim 是 act 声明 (RFC 8693 第 4.1 节)。
+// 嵌套的 Actor 表示更早的委托链：最外层是当前的行事方。
+type ActorClaim struct {
+	Subject  string      `json:"sub"`
+	ClientID string      `json:"client_id,omitempty"`
+	Actor    *ActorClaim `json:"act,omitempty"`
+}
+
+// exchangeToken 是从 subject_token 或 actor_token 中解析出的信息
+type exchangeToken struct {
+	Subject  string
+	ClientID string
+	Scope    string
+	Actor    *ActorClaim
+}
+
+// handleTokenExchange 处理 grant_type=urn:ietf:params:oauth:grant-type:token-exchange
+func handleTokenExchange(w http.ResponseWriter, r *http.Request, client Client, proof *dpopProof) {
+	rlm := requestRealm(r)
+	policy := client.TokenExchange
+	if policy == nil {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "该客户端不允许进行令牌交换")
+		return
+	}
+
+	// 1. 解析 subject_token: 我们要代表的是谁
+	subject, err := rlm.parseExchangeToken(r.PostForm.Get("subject_token"), r.PostForm.Get("subject_token_type"))
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "subject_token 无效: "+err.Error())
+		return
+	}
+	if subject.ClientID != client.ID && !containsString(policy.SubjectClients, subject.ClientID) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "不允许交换签发给 "+subject.ClientID+" 的令牌")
+		return
+	}
+
+	// 2. 解析 actor_token: 有则为委托，无则为模拟
+	actor := subject.Actor
+	if rawActor := r.PostForm.Get("actor_token"); rawActor != "" {
+		if !policy.AllowDelegation {
+			writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "该客户端不允许委托 (actor_token)")
+			return
+		}
+		act, err := rlm.parseExchangeToken(rawActor, r.PostForm.Get("actor_token_type"))
+		if err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "actor_token 无效: "+err.Error())
+			return
+		}
+		if act.ClientID != client.ID && !containsString(policy.ActorClients, act.ClientID) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "不允许使用签发给 "+act.ClientID+" 的令牌作为 actor_token")
+			return
+		}
+		// 当前行事方放在最外层，subject_token 中已有的委托链嵌套在内层
+		actor = &ActorClaim{Subject: act.Subject, ClientID: act.ClientID, Actor: subject.Actor}
+	} else if !policy.AllowImpersonation {
+		writeOAuthError(w, http.StatusBadRequest, "unauthorized_client", "该客户端不允许模拟，必须提供 actor_token")
+		return
+	}
+
+	// 3. 确定新令牌的受众: audience 或 resource 参数，缺省为客户端自己
+	audience, err := exchangeAudience(r)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_target", err.Error())
+		return
+	}
+	if audience == "" {
+		audience = client.ID
+	}
+	if audience != client.ID && !containsString(policy.Audiences, audience) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_target", "不允许面向受众 "+audience)
+		return
+	}
+
+	// 4. 降权: 请求的 scope 必须是 subject_token 中 scope 的子集
+	scope := subject.Scope
+	if requested := r.PostForm.Get("scope"); requested != "" {
+		granted := strings.Fields(subject.Scope)
+		for _, s := range strings.Fields(requested) {
+			if !containsString(granted, s) {
+				writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "scope 超出了 subject_token 的范围: "+s)
+				return
+			}
+		}
+		scope = requested
+	}
+
+	// 5. 目前只签发访问令牌
+	if t := r.PostForm.Get("requested_token_type"); t != "" && t != tokenTypeAccessToken {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "不支持的 requested_token_type: "+t)
+		return
+	}
+
+	accessToken, tokenType, _, err := issueAccessToken(r, AccessTokenClaims{
+		Subject:  subject.Subject,
+		Audience: audience,
+		ClientID: client.ID,
+		Scope:    scope,
+		Actor:    actor,
+	}, proof)
+	if err != nil {
+		http.Error(w, "创建访问令牌失败: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":      accessToken,
+		"issued_token_type": tokenTypeAccessToken,
+		"token_type":        tokenType,
+		"expires_in":        int(rlm.currentConfig().Lifetimes.AccessToken.Seconds()),
+		"scope":             scope,
+	})
+}
+
+// exchangeAudience 从 audience 和 resource 参数中取出目标受众，目前只支持单个受众
+func exchangeAudience(r *http.Request) (string, error) {
+	var targets []string
+	targets = append(targets, r.PostForm["audience"]...)
+	targets = append(targets, r.PostForm["resource"]...)
+	switch len(targets) {
+	case 0:
+		return "", nil
+	case 1:
+		return targets[0], nil
+	default:
+		return "", errors.New("只支持一个 audience 或 resource")
+	}
+}
+
+// parseExchangeToken 解析 subject_token 或 actor_token。
+// 只接受本 realm 签发的访问令牌和 ID Token。
+func (rlm *realm) parseExchangeToken(raw, tokenType string) (*exchangeToken, error) {
+	if raw == "" {
+		return nil, errors.New("缺少令牌")
+	}
+
+	switch tokenType {
+	case tokenTypeAccessToken:
+		claims, err := rlm.parseAccessToken(raw)
+		if err != nil {
+			return nil, err
+		}
+		return &exchangeToken{
+			Subject:  claims.Subject,
+			ClientID: claims.ClientID,
+			Scope:    claims.Scope,
+			Actor:    claims.Actor,
+		}, nil
+
+	case tokenTypeIDToken, tokenTypeJWT:
+		tok, err := jwt.ParseSigned(raw)
+		if err != nil || len(tok.Headers) != 1 {
+			return nil, errors.New("ID Token 格式错误")
+		}
+		if typ, _ := tok.Headers[0].ExtraHeaders[jose.HeaderType].(string); typ != "JWT" {
+			return nil, errors.New("不是 ID Token")
+		}
+		var claims jwt.Claims
+		if err := rlm.verifyJWT(tok, &claims); err != nil {
+			return nil, errors.New("ID Token 签名无效")
+		}
+		if err := claims.ValidateWithLeeway(jwt.Expected{Issuer: rlm.issuer, Time: time.Now()}, 0); err != nil {
+			return nil, errors.New("ID Token 无效或已过期")
+		}
+		if len(claims.Audience) != 1 {
+			return nil, errors.New("ID Token 的 aud 无效")
+		}
+		return &exchangeToken{
+			Subject:  claims.Subject,
+			ClientID: claims.Audience[0],
+			Scope:    "openid",
+		}, nil
+
+	default:
+		return nil, errors.New("不支持的令牌类型: " + tokenType)
+	}
+}
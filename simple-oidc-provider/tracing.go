@@ -0,0 +1,134 @@
+// tracing.go - OpenTelemetry 分布式追踪
+// 每个 HTTP 请求都是一个 span。请求中带有 W3C traceparent 头时 (例如客户端在交换令牌时发送的)，
+// span 会加入客户端的 trace，这样一次登录在客户端和 Provider 中的所有请求会出现在同一个 trace 中。
+// Provider 主动发出的请求 (back-channel logout、CIBA ping) 也会带上 traceparent。
+//
+// span 可以输出到标准输出，或者以 OTLP JSON 格式逐行追加到文件 (与 OpenTelemetry Collector 的 file exporter 格式相同)，
+// 不需要运行 Collector 也可以离线查看，或者之后导入到 Jaeger 等工具中。
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// tracingServiceName 是 span 中的 service.name
+const tracingServiceName = "simple-oidc-provider"
+
+// TracingConfig 是分布式追踪的设置，只在启动时生效
+type TracingConfig struct {
+	// Exporter 是 span 的输出方式: none (默认，不记录 span，但仍然转发 traceparent)、stdout 或 otlp-file
+	Exporter string `yaml:"exporter"`
+	// File 是 otlp-file 输出的文件路径，每行一个 OTLP JSON 格式的 ExportTraceServiceRequest
+	File string `yaml:"file"`
+}
+
+// setupTracing 按配置设置全局的 TracerProvider 和 W3C Trace Context 传播方式。
+// 返回的函数在退出前调用，把还在缓冲中的 span 输出
+func setupTracing(cfg TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp-file":
+		exporter, err = otlptrace.New(context.Background(), &otlpFileClient{path: cfg.File})
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无法创建 span 输出: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		// 演示环境中请求不多，每秒输出一次，方便边操作边查看
+		sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(time.Second)),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracingServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// otlpFileClient 实现 otlptrace.Client，把每批 span 以 OTLP JSON 的形式作为一行追加到文件中
+type otlpFileClient struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (c *otlpFileClient) Start(ctx context.Context) error {
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	c.file = f
+	return nil
+}
+
+func (c *otlpFileClient) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+func (c *otlpFileClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	line, err := protojson.Marshal(&coltracepb.ExportTraceServiceRequest{ResourceSpans: spans})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.file.Write(append(line, '\n'))
+	return err
+}
+
+// probePaths 是监控系统频繁访问的路径，它们的 span 只会淹没有用的 trace
+var probePaths = map[string]bool{"/metrics": true, "/healthz": true, "/readyz": true}
+
+// withTracing 为每个请求创建一个服务端 span，父 span 来自请求的 traceparent 头。/metrics 的抓取和健康检查不记录
+func withTracing(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.server",
+		otelhttp.WithFilter(func(r *http.Request) bool { return !probePaths[r.URL.Path] }),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method }),
+	)
+}
+
+// withRouteSpan 在 ServeMux 匹配到路由之后，把 span 命名为 "方法 路由" (例如 "POST /token")，并记录 http.route。
+// 中间的 withCorrelationID 把请求换成了带有关联 ID 的副本，otelhttp 看不到 ServeMux 记录在副本上的模式，
+// 所以需要在 ServeMux 外面紧挨着设置
+func withRouteSpan(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if r.Pattern == "" {
+			return
+		}
+		// 模式可能带有方法前缀，例如 "GET /admin/api/users/{username}"
+		route := r.Pattern
+		if i := strings.Index(route, " "); i >= 0 {
+			route = route[i+1:]
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route))
+	})
+}